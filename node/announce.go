@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+const (
+	// relayRecordProtocol fetches a relay's signed record. Nodes publish
+	// the records of the relays they hold reservations on.
+	relayRecordProtocol = "/mesh/relay-record/1.0.0"
+	// relayFleetProtocol returns the records of every relay a relay knows
+	// through federation, its own first.
+	relayFleetProtocol = "/mesh/relay-fleet/1.0.0"
+	maxFleetBytes      = 256 << 10
+	relayAnnounceEvery = 10 * time.Minute
+	relayRecordMinGap  = time.Minute // between accepted records of one relay
+	maxRecordAddrs     = 8
+	maxRecordTTL       = time.Hour
+)
+
+var (
+	errBadRecord   = errors.New("invalid relay record")
+	errRecordSig   = errors.New("relay record not signed by the relay")
+	errStaleRecord = errors.New("relay record not newer than the last one")
+	errRecordRate  = errors.New("relay record too soon after the last one")
+)
+
+// relayRecord describes a relay: its addresses, the reservation slots it
+// had free and when the record lapses. The relay signs it, so the node
+// that publishes it vouches for having seen it but cannot alter it.
+type relayRecord struct {
+	Peer     string   `json:"peer"`
+	Addrs    []string `json:"addrs"`
+	Capacity int      `json:"capacity"`
+	Private  bool     `json:"private,omitempty"`
+	Issued   int64    `json:"issued"`
+	Expires  int64    `json:"expires"`
+
+	id    peer.ID
+	addrs []ma.Multiaddr
+}
+
+// relayAnnouncement is what goes on the "relays" topic.
+type relayAnnouncement struct {
+	Record []byte `json:"record"`
+	Sig    []byte `json:"sig"`
+}
+
+// parseRelayAnnouncement checks the schema and the relay's signature of an
+// announcement and that its record is current: issued no later than the
+// clock skew allows and expiring within maxRecordTTL from now. Fleet
+// records, which are not rate limited like the topic, rely on this.
+func parseRelayAnnouncement(data []byte) (*relayRecord, error) {
+	var ann relayAnnouncement
+	if err := json.Unmarshal(data, &ann); err != nil {
+		return nil, errBadRecord
+	}
+	var rec relayRecord
+	if err := json.Unmarshal(ann.Record, &rec); err != nil {
+		return nil, errBadRecord
+	}
+	id, err := peer.Decode(rec.Peer)
+	if err != nil {
+		return nil, errBadRecord
+	}
+	pub, err := id.ExtractPublicKey()
+	if err != nil {
+		return nil, errBadRecord
+	}
+	if ok, err := pub.Verify(ann.Record, ann.Sig); err != nil || !ok {
+		return nil, errRecordSig
+	}
+	now := time.Now()
+	issued, expires := time.Unix(rec.Issued, 0), time.Unix(rec.Expires, 0)
+	if rec.Capacity < 0 || !expires.After(now) || expires.Sub(issued) > maxRecordTTL {
+		return nil, errBadRecord
+	}
+	if issued.After(now.Add(defaultMaxClockSkew)) || expires.After(now.Add(maxRecordTTL)) {
+		return nil, errBadRecord
+	}
+	if len(rec.Addrs) == 0 || len(rec.Addrs) > maxRecordAddrs {
+		return nil, errBadRecord
+	}
+	for _, s := range rec.Addrs {
+		a, err := ma.NewMultiaddr(s)
+		if err != nil {
+			return nil, errBadRecord
+		}
+		if _, err := a.ValueForProtocol(ma.P_CIRCUIT); err == nil {
+			return nil, errBadRecord
+		}
+		rec.addrs = append(rec.addrs, a)
+	}
+	rec.id = id
+	return &rec, nil
+}
+
+// fetchRelayRecord asks relay id for a freshly signed announcement.
+func fetchRelayRecord(ctx context.Context, h host.Host, id peer.ID) ([]byte, error) {
+	s, err := h.NewStream(ctx, id, relayRecordProtocol)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+	_ = s.SetDeadline(time.Now().Add(10 * time.Second))
+	data, err := io.ReadAll(io.LimitReader(s, maxRelayAnnounce))
+	if err != nil {
+		return nil, err
+	}
+	rec, err := parseRelayAnnouncement(data)
+	if err != nil {
+		return nil, err
+	}
+	if rec.id != id {
+		return nil, errRecordSig
+	}
+	return data, nil
+}
+
+// fetchRelayFleet asks relay id for the relays it knows. Records that do
+// not verify are left out.
+func fetchRelayFleet(ctx context.Context, h host.Host, id peer.ID) ([]*relayRecord, error) {
+	s, err := h.NewStream(ctx, id, relayFleetProtocol)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+	_ = s.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, err := io.WriteString(s, "[]\n"); err != nil {
+		s.Reset()
+		return nil, err
+	}
+	var list []json.RawMessage
+	if err := json.NewDecoder(io.LimitReader(s, maxFleetBytes)).Decode(&list); err != nil {
+		return nil, err
+	}
+	var out []*relayRecord
+	for _, data := range list {
+		if rec, err := parseRelayAnnouncement(data); err == nil {
+			out = append(out, rec)
+		}
+	}
+	return out, nil
+}
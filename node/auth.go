@@ -0,0 +1,503 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// role is a gateway access level; each level includes the ones below it.
+type role int
+
+const (
+	roleNone role = iota
+	roleRead
+	roleWrite
+	roleAdmin
+)
+
+func (r role) String() string {
+	switch r {
+	case roleRead:
+		return "read"
+	case roleWrite:
+		return "write"
+	case roleAdmin:
+		return "admin"
+	}
+	return "none"
+}
+
+func parseRole(s string) (role, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "read":
+		return roleRead, nil
+	case "write":
+		return roleWrite, nil
+	case "admin":
+		return roleAdmin, nil
+	}
+	return roleNone, fmt.Errorf("unknown role %q", s)
+}
+
+const (
+	sessionCookie     = "mesh_session"
+	sessionTTL        = 24 * time.Hour
+	sessionSweepEvery = 10 * time.Minute
+)
+
+// Session kinds name the namespace a session's user lives in, so a local
+// user cannot share a chat identity with a token of the same name.
+const (
+	kindUser  = "user"
+	kindToken = "token"
+)
+
+// GatewayToken grants a role to anyone presenting Token.
+type GatewayToken struct {
+	Name  string `yaml:"name"`
+	Token string `yaml:"token"`
+	Role  string `yaml:"role"`
+}
+
+// GatewayUser is a local account; Hash is a bcrypt password hash.
+type GatewayUser struct {
+	Name string `yaml:"name" json:"name"`
+	Hash string `yaml:"password_hash" json:"hash"`
+	Role string `yaml:"role" json:"role"`
+}
+
+// GatewayConfig is the "gateway" section of config.yaml.
+type GatewayConfig struct {
+	Tokens         []GatewayToken `yaml:"tokens"`
+	Users          []GatewayUser  `yaml:"users"`
+	AllowedOrigins []string       `yaml:"allowed_origins"`
+	TLS            GatewayTLS     `yaml:"tls"`
+	Bots           []BotConfig    `yaml:"bots"`
+	MQTT           MQTTConfig     `yaml:"mqtt"`
+	IRC            IRCConfig      `yaml:"irc"`
+}
+
+// session is an authenticated caller, either from a login cookie or a
+// bearer token presented with the request.
+type session struct {
+	id      string
+	kind    string // kindUser or kindToken
+	user    string
+	role    role
+	expires time.Time
+}
+
+// identity is the identityStore key of the session's user, prefixed by
+// kind like the "bot:" and "irc:" identities.
+func (s *session) identity() string {
+	return s.kind + ":" + s.user
+}
+
+type tokenGrant struct {
+	name string
+	role role
+}
+
+// authenticator checks gateway callers against static tokens and local
+// users. With neither configured, authentication is disabled and every
+// caller is treated as admin, matching the historic behaviour.
+type authenticator struct {
+	mu        sync.Mutex
+	tokens    map[string]tokenGrant // keyed by sha256 of the token
+	users     map[string]GatewayUser
+	static    map[string]bool // users from config.yaml, not persisted
+	usersPath string
+	sessions  map[string]*session
+	origins   map[string]bool
+}
+
+func hashToken(t string) string {
+	sum := sha256.Sum256([]byte(t))
+	return hex.EncodeToString(sum[:])
+}
+
+func newAuthenticator(cfg GatewayConfig, usersPath string) *authenticator {
+	a := &authenticator{
+		tokens:    map[string]tokenGrant{},
+		users:     map[string]GatewayUser{},
+		static:    map[string]bool{},
+		usersPath: usersPath,
+		sessions:  map[string]*session{},
+		origins:   map[string]bool{},
+	}
+	tokens := cfg.Tokens
+	// GATEWAY_TOKENS=token:role[,token:role...]
+	for i, item := range strings.Split(os.Getenv("GATEWAY_TOKENS"), ",") {
+		tok, r, _ := strings.Cut(strings.TrimSpace(item), ":")
+		if tok != "" {
+			tokens = append(tokens, GatewayToken{Name: fmt.Sprintf("env-%d", i+1), Token: tok, Role: r})
+		}
+	}
+	for _, t := range tokens {
+		r, err := parseRole(t.Role)
+		if err != nil || t.Token == "" {
+			log.Printf("gateway token %q ignored: %v", t.Name, err)
+			continue
+		}
+		a.tokens[hashToken(t.Token)] = tokenGrant{name: t.Name, role: r}
+	}
+	if b, err := os.ReadFile(usersPath); err == nil {
+		var users []GatewayUser
+		if err := json.Unmarshal(b, &users); err != nil {
+			log.Println("gateway users file:", err)
+		}
+		for _, u := range users {
+			a.users[u.Name] = u
+		}
+	}
+	for _, u := range cfg.Users {
+		if _, err := parseRole(u.Role); err != nil || u.Name == "" || u.Hash == "" {
+			log.Printf("gateway user %q ignored", u.Name)
+			continue
+		}
+		a.users[u.Name] = u
+		a.static[u.Name] = true
+	}
+	if name, pw := os.Getenv("GATEWAY_ADMIN_USER"), os.Getenv("GATEWAY_ADMIN_PASSWORD"); name != "" && pw != "" {
+		if _, ok := a.users[name]; !ok {
+			if err := a.setUser(name, pw, roleAdmin); err != nil {
+				log.Println("gateway admin user:", err)
+			}
+		}
+	}
+	origins := cfg.AllowedOrigins
+	if env := os.Getenv("GATEWAY_ORIGINS"); env != "" {
+		origins = strings.Split(env, ",")
+	}
+	for _, o := range origins {
+		if o = strings.TrimRight(strings.TrimSpace(o), "/"); o != "" {
+			a.origins[strings.ToLower(o)] = true
+		}
+	}
+	return a
+}
+
+func (a *authenticator) enabled() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return len(a.tokens) > 0 || len(a.users) > 0
+}
+
+// setUser creates or updates a local user and persists the users file.
+func (a *authenticator) setUser(name, password string, r role) error {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.static[name] {
+		return errors.New("user is defined in config.yaml")
+	}
+	a.users[name] = GatewayUser{Name: name, Hash: string(hash), Role: r.String()}
+	return a.saveUsers()
+}
+
+func (a *authenticator) deleteUser(name string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.static[name] {
+		return errors.New("user is defined in config.yaml")
+	}
+	delete(a.users, name)
+	for id, s := range a.sessions {
+		if s.kind == kindUser && s.user == name {
+			delete(a.sessions, id)
+		}
+	}
+	return a.saveUsers()
+}
+
+// saveUsers writes the non-static users. mu must be held.
+func (a *authenticator) saveUsers() error {
+	users := []GatewayUser{}
+	for name, u := range a.users {
+		if !a.static[name] {
+			users = append(users, u)
+		}
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Name < users[j].Name })
+	b, _ := json.MarshalIndent(users, "", "  ")
+	if err := os.MkdirAll(filepath.Dir(a.usersPath), 0o755); err != nil {
+		return err
+	}
+	tmp := a.usersPath + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, a.usersPath)
+}
+
+// login checks a username/password or a static token and opens a session.
+func (a *authenticator) login(user, password, token string) (*session, error) {
+	s := &session{expires: time.Now().Add(sessionTTL)}
+	if token != "" {
+		a.mu.Lock()
+		g, ok := a.tokens[hashToken(token)]
+		a.mu.Unlock()
+		if !ok {
+			return nil, errors.New("invalid token")
+		}
+		s.kind, s.user, s.role = kindToken, g.name, g.role
+	} else {
+		a.mu.Lock()
+		u, ok := a.users[user]
+		a.mu.Unlock()
+		if !ok || bcrypt.CompareHashAndPassword([]byte(u.Hash), []byte(password)) != nil {
+			return nil, errors.New("invalid username or password")
+		}
+		s.kind, s.user = kindUser, u.Name
+		s.role, _ = parseRole(u.Role)
+	}
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	s.id = hex.EncodeToString(b)
+	a.mu.Lock()
+	a.sessions[s.id] = s
+	a.mu.Unlock()
+	return s, nil
+}
+
+// identify returns the caller's session, or nil if unauthenticated.
+func (a *authenticator) identify(r *http.Request) *session {
+	if !a.enabled() {
+		return &session{user: "", role: roleAdmin}
+	}
+	token := r.URL.Query().Get("token")
+	if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		token = strings.TrimPrefix(h, "Bearer ")
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if token != "" {
+		if g, ok := a.tokens[hashToken(token)]; ok {
+			return &session{kind: kindToken, user: g.name, role: g.role}
+		}
+		return nil
+	}
+	c, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return nil
+	}
+	s, ok := a.sessions[c.Value]
+	if !ok {
+		return nil
+	}
+	if time.Now().After(s.expires) {
+		delete(a.sessions, c.Value)
+		return nil
+	}
+	// users may have been removed or changed role since login
+	if u, ok := a.users[s.user]; ok && s.kind == kindUser {
+		s.role, _ = parseRole(u.Role)
+	}
+	return s
+}
+
+func (a *authenticator) logout(r *http.Request) {
+	if c, err := r.Cookie(sessionCookie); err == nil {
+		a.end(c.Value)
+	}
+}
+
+// end removes session id, as when an IRC connection that logged in closes.
+func (a *authenticator) end(id string) {
+	a.mu.Lock()
+	delete(a.sessions, id)
+	a.mu.Unlock()
+}
+
+// sweep drops the sessions that have expired.
+func (a *authenticator) sweep(now time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for id, s := range a.sessions {
+		if now.After(s.expires) {
+			delete(a.sessions, id)
+		}
+	}
+}
+
+// run sweeps expired sessions every sessionSweepEvery until ctx is done.
+func (a *authenticator) run(ctx context.Context) {
+	ticker := time.NewTicker(sessionSweepEvery)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			a.sweep(time.Now())
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// checkOrigin accepts requests without an Origin header (non-browser
+// clients), origins on the allowlist, and otherwise only same-origin ones.
+func (a *authenticator) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	a.mu.Lock()
+	allowed := a.origins[strings.ToLower(strings.TrimRight(origin, "/"))]
+	a.mu.Unlock()
+	if allowed {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
+
+type ctxKey int
+
+const sessionKey ctxKey = 0
+
+func sessionFrom(r *http.Request) *session {
+	s, _ := r.Context().Value(sessionKey).(*session)
+	return s
+}
+
+// require wraps h so it only runs for callers holding at least min.
+// Non-GET requests must also pass the origin check.
+func (a *authenticator) require(min role, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead && !a.checkOrigin(r) {
+			http.Error(w, "origin not allowed", http.StatusForbidden)
+			return
+		}
+		s := a.identify(r)
+		if s == nil {
+			http.Error(w, "authentication required", http.StatusUnauthorized)
+			return
+		}
+		if s.role < min {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		h(w, r.WithContext(context.WithValue(r.Context(), sessionKey, s)))
+	}
+}
+
+// handleLogin accepts {username, password} or {token} and sets a session
+// cookie.
+func (a *authenticator) handleLogin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if !a.checkOrigin(r) {
+		http.Error(w, "origin not allowed", http.StatusForbidden)
+		return
+	}
+	var req struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+		Token    string `json:"token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	s, err := a.login(req.Username, req.Password, req.Token)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    s.id,
+		Path:     "/",
+		Expires:  s.expires,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	})
+	_ = json.NewEncoder(w).Encode(map[string]string{"user": s.user, "role": s.role.String()})
+}
+
+func (a *authenticator) handleLogout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	a.logout(r)
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Value: "", Path: "/", MaxAge: -1})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleSession reports who the caller is; 401 tells the UI to log in.
+func (a *authenticator) handleSession(w http.ResponseWriter, r *http.Request) {
+	s := a.identify(r)
+	if s == nil {
+		http.Error(w, "authentication required", http.StatusUnauthorized)
+		return
+	}
+	_ = json.NewEncoder(w).Encode(map[string]any{"user": s.user, "role": s.role.String(), "auth": a.enabled()})
+}
+
+// handleUsers lets admins list, create/update (POST) and delete local users.
+func (a *authenticator) handleUsers(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		a.mu.Lock()
+		out := []map[string]any{}
+		for _, u := range a.users {
+			out = append(out, map[string]any{"name": u.Name, "role": u.Role, "static": a.static[u.Name]})
+		}
+		a.mu.Unlock()
+		sort.Slice(out, func(i, j int) bool { return out[i]["name"].(string) < out[j]["name"].(string) })
+		_ = json.NewEncoder(w).Encode(out)
+	case http.MethodPost:
+		var req struct {
+			Username string `json:"username"`
+			Password string `json:"password"`
+			Role     string `json:"role"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Username == "" || req.Password == "" {
+			http.Error(w, "username and password required", http.StatusBadRequest)
+			return
+		}
+		rl, err := parseRole(req.Role)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := a.setUser(req.Username, req.Password, rl); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		if err := a.deleteUser(r.URL.Query().Get("name")); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
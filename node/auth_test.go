@@ -0,0 +1,166 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func testAuth(t *testing.T, cfg GatewayConfig) *authenticator {
+	t.Helper()
+	for _, name := range []string{"GATEWAY_TOKENS", "GATEWAY_ORIGINS", "GATEWAY_ADMIN_USER", "GATEWAY_ADMIN_PASSWORD"} {
+		t.Setenv(name, "")
+	}
+	return newAuthenticator(cfg, filepath.Join(t.TempDir(), "users.json"))
+}
+
+func TestCheckOrigin(t *testing.T) {
+	a := testAuth(t, GatewayConfig{AllowedOrigins: []string{"https://chat.example.org/"}})
+	tests := []struct {
+		origin string
+		want   bool
+	}{
+		{"", true},
+		{"http://mesh.local:3000", true},
+		{"https://MESH.local:3000", true},
+		{"https://chat.example.org", true},
+		{"HTTPS://Chat.Example.Org/", true},
+		{"https://evil.example", false},
+		{"http://mesh.local:3001", false},
+		{"http://mesh.local.evil.example:3000", false},
+		{"null", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.origin, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "http://mesh.local:3000/send", nil)
+			if tt.origin != "" {
+				r.Header.Set("Origin", tt.origin)
+			}
+			if got := a.checkOrigin(r); got != tt.want {
+				t.Errorf("checkOrigin = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRequire(t *testing.T) {
+	a := testAuth(t, GatewayConfig{Tokens: []GatewayToken{
+		{Name: "reader", Token: "r-token", Role: "read"},
+		{Name: "writer", Token: "w-token", Role: "write"},
+		{Name: "broken", Token: "x-token", Role: "owner"},
+	}})
+	if err := a.setUser("carol", "secret", roleWrite); err != nil {
+		t.Fatal(err)
+	}
+	s, err := a.login("carol", "secret", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.login("carol", "wrong", ""); err == nil {
+		t.Error("login with a wrong password succeeded")
+	}
+	h := a.require(roleWrite, func(w http.ResponseWriter, r *http.Request) {
+		if sessionFrom(r) == nil {
+			t.Error("handler ran without a session")
+		}
+	})
+
+	tests := []struct {
+		name   string
+		method string
+		token  string
+		cookie string
+		origin string
+		want   int
+	}{
+		{"no credentials", http.MethodGet, "", "", "", http.StatusUnauthorized},
+		{"unknown token", http.MethodGet, "nope", "", "", http.StatusUnauthorized},
+		{"token with an invalid role", http.MethodGet, "x-token", "", "", http.StatusUnauthorized},
+		{"role too low", http.MethodPost, "r-token", "", "", http.StatusForbidden},
+		{"enough role", http.MethodPost, "w-token", "", "", http.StatusOK},
+		{"session cookie", http.MethodPost, "", s.id, "", http.StatusOK},
+		{"forged cookie", http.MethodPost, "", "0000", "", http.StatusUnauthorized},
+		{"cross-origin post", http.MethodPost, "w-token", "", "https://evil.example", http.StatusForbidden},
+		{"cross-origin get", http.MethodGet, "w-token", "", "https://evil.example", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, "http://mesh.local/send", nil)
+			if tt.token != "" {
+				r.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			if tt.cookie != "" {
+				r.AddCookie(&http.Cookie{Name: sessionCookie, Value: tt.cookie})
+			}
+			if tt.origin != "" {
+				r.Header.Set("Origin", tt.origin)
+			}
+			w := httptest.NewRecorder()
+			h(w, r)
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+
+	// removing the user ends their sessions
+	if err := a.deleteUser("carol"); err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(http.MethodGet, "http://mesh.local/send", nil)
+	r.AddCookie(&http.Cookie{Name: sessionCookie, Value: s.id})
+	w := httptest.NewRecorder()
+	h(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("deleted user: status = %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestRequireDisabled(t *testing.T) {
+	a := testAuth(t, GatewayConfig{})
+	w := httptest.NewRecorder()
+	a.require(roleAdmin, func(http.ResponseWriter, *http.Request) {})(w, httptest.NewRequest(http.MethodPost, "http://mesh.local/users", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("status = %d, want %d without auth configured", w.Code, http.StatusOK)
+	}
+}
+
+func TestSessions(t *testing.T) {
+	a := testAuth(t, GatewayConfig{Tokens: []GatewayToken{{Name: "ci", Token: "ci-token", Role: "write"}}})
+	if err := a.setUser("ci", "secret", roleWrite); err != nil {
+		t.Fatal(err)
+	}
+	tok, err := a.login("", "", "ci-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, err := a.login("ci", "secret", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tok.identity() == user.identity() {
+		t.Errorf("token and user of the same name share identity %q", tok.identity())
+	}
+
+	// deleting the user leaves the token's session alone
+	if err := a.deleteUser("ci"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := a.sessions[tok.id]; !ok {
+		t.Error("deleting a user ended a token session of the same name")
+	}
+	if _, ok := a.sessions[user.id]; ok {
+		t.Error("deleted user's session survived")
+	}
+
+	a.sweep(time.Now())
+	if _, ok := a.sessions[tok.id]; !ok {
+		t.Error("sweep dropped a live session")
+	}
+	a.sweep(tok.expires.Add(time.Second))
+	if len(a.sessions) != 0 {
+		t.Errorf("%d sessions left after they expired", len(a.sessions))
+	}
+}
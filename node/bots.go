@@ -0,0 +1,367 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Bot is an automated room participant running inside the node. Each bot
+// has its own user identity, so its messages are signed and it shows up in
+// room rosters like any gateway user. A bot reacts by also implementing
+// any of MessageHandler, CommandHandler, PresenceHandler and TimerHandler.
+type Bot interface {
+	Name() string
+}
+
+// MessageHandler receives every chat message in the bot's rooms except
+// the bot's own.
+type MessageHandler interface {
+	OnMessage(env *BotEnv, cm ChatMsg)
+}
+
+// CommandHandler answers "!cmd args" messages for the commands it lists.
+type CommandHandler interface {
+	Commands() map[string]BotCommand
+}
+
+// PresenceHandler receives the roster of a room whenever it changes.
+type PresenceHandler interface {
+	OnPresence(env *BotEnv, room string, members []rosterEntry)
+}
+
+// TimerHandler is called every Interval; a zero interval disables it.
+type TimerHandler interface {
+	Interval() time.Duration
+	OnTick(env *BotEnv)
+}
+
+// BotCommand is one "!name" command.
+type BotCommand struct {
+	Usage string // e.g. "!echo <text>"
+	Help  string
+	Run   func(env *BotEnv, cm ChatMsg, args []string)
+}
+
+// BotConfig starts one bot. Type names a registered bot; Name defaults to
+// Type and keys the bot's identity.
+type BotConfig struct {
+	Type     string   `yaml:"type"`
+	Name     string   `yaml:"name"`
+	Nick     string   `yaml:"nick"`
+	Rooms    []string `yaml:"rooms"`    // default: the node's room
+	Interval string   `yaml:"interval"` // for bots with a timer, e.g. "1h"
+}
+
+var botTypes = map[string]func(BotConfig) Bot{}
+
+// registerBot makes a bot type available to BotConfig.Type. Bots written
+// for this node call it from an init function in their own file.
+func registerBot(typ string, factory func(BotConfig) Bot) {
+	botTypes[typ] = factory
+}
+
+// loadBotConfigs merges the configured bots with BOTS=type[,type...], which
+// starts built-in bots in the node's room.
+func loadBotConfigs(cfg []BotConfig) []BotConfig {
+	out := append([]BotConfig(nil), cfg...)
+	for _, typ := range strings.Split(os.Getenv("BOTS"), ",") {
+		if typ = strings.TrimSpace(typ); typ != "" {
+			out = append(out, BotConfig{Type: typ})
+		}
+	}
+	return out
+}
+
+// BotEnv is what a running bot uses to act in its rooms.
+type BotEnv struct {
+	g      *Gateway
+	bots   *botRunner
+	client *WSClient
+	rooms  []string
+}
+
+// Rooms lists the rooms the bot joined.
+func (e *BotEnv) Rooms() []string { return append([]string(nil), e.rooms...) }
+
+// Nick returns the bot's current nick.
+func (e *BotEnv) Nick() string { return e.client.ident.Nick() }
+
+// Say posts text to room as the bot.
+func (e *BotEnv) Say(room, text string) error {
+	_, err := e.g.publish(context.Background(), room, ChatMsg{Text: text}, e.client.ident)
+	return err
+}
+
+// Reply answers cm in its room as a reply.
+func (e *BotEnv) Reply(cm ChatMsg, text string) error {
+	_, err := e.g.publish(context.Background(), cm.Room, ChatMsg{Text: text, Kind: kindReply, Ref: cm.MsgID}, e.client.ident)
+	return err
+}
+
+// Uptime is how long the node's gateway has been running.
+func (e *BotEnv) Uptime() time.Duration { return time.Since(e.g.started).Round(time.Second) }
+
+// ConnectedPeers counts the libp2p peers this node is connected to.
+func (e *BotEnv) ConnectedPeers() int { return len(e.g.h.Network().Peers()) }
+
+// RoomPeers counts the pubsub peers subscribed to room.
+func (e *BotEnv) RoomPeers(room string) int { return len(e.g.psub.ListPeers("room:" + room)) }
+
+// Members returns the roster of room.
+func (e *BotEnv) Members(room string) []rosterEntry { return e.g.presence(room).Members }
+
+// Commands lists every command of every running bot, sorted by name.
+func (e *BotEnv) Commands() []BotCommand {
+	e.bots.mu.Lock()
+	defer e.bots.mu.Unlock()
+	names := make([]string, 0, len(e.bots.commands))
+	for name := range e.bots.commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	out := make([]BotCommand, 0, len(names))
+	for _, name := range names {
+		out = append(out, e.bots.commands[name].cmd)
+	}
+	return out
+}
+
+type ownedCommand struct {
+	bot string
+	cmd BotCommand
+}
+
+// botRunner starts the configured bots and owns the command table, so that
+// each command is answered by exactly one bot.
+type botRunner struct {
+	g        *Gateway
+	configs  []BotConfig
+	mu       sync.Mutex
+	commands map[string]ownedCommand
+	users    map[string]bool // identities of the running bots
+}
+
+func newBotRunner(g *Gateway, configs []BotConfig) *botRunner {
+	return &botRunner{g: g, configs: configs, commands: map[string]ownedCommand{}, users: map[string]bool{}}
+}
+
+// Start launches every bot. It runs once the gateway consumes its rooms.
+func (r *botRunner) Start(ctx context.Context) {
+	seen := map[string]bool{}
+	for _, cfg := range r.configs {
+		factory, ok := botTypes[cfg.Type]
+		if !ok {
+			log.Printf("bot %q ignored: unknown type", cfg.Type)
+			continue
+		}
+		if cfg.Name == "" {
+			cfg.Name = cfg.Type
+		}
+		if seen[cfg.Name] {
+			log.Printf("bot %q ignored: duplicate name", cfg.Name)
+			continue
+		}
+		seen[cfg.Name] = true
+		if err := r.start(ctx, factory(cfg), cfg); err != nil {
+			log.Printf("bot %s: %v", cfg.Name, err)
+		}
+	}
+}
+
+func (r *botRunner) start(ctx context.Context, bot Bot, cfg BotConfig) error {
+	ident, err := r.g.idents.get("bot:" + cfg.Name)
+	if err != nil {
+		return err
+	}
+	nick := cfg.Nick
+	if nick == "" && ident.Nick() == "bot:"+cfg.Name {
+		nick = cfg.Name // first run: replace the identity's default nick
+	}
+	if nick != "" && ident.Nick() != nick {
+		if err := ident.SetNick(nick); err != nil {
+			return err
+		}
+	}
+	rooms := cfg.Rooms
+	if len(rooms) == 0 {
+		rooms = []string{r.g.room}
+	}
+	c, err := r.g.attach(ctx, ident, roleWrite, rooms)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	r.users[ident.id] = true
+	r.mu.Unlock()
+	if ch, ok := bot.(CommandHandler); ok {
+		r.mu.Lock()
+		for name, cmd := range ch.Commands() {
+			if prev, taken := r.commands[name]; taken {
+				log.Printf("bot %s: command !%s already handled by %s", cfg.Name, name, prev.bot)
+				continue
+			}
+			r.commands[name] = ownedCommand{bot: cfg.Name, cmd: cmd}
+		}
+		r.mu.Unlock()
+	}
+	env := &BotEnv{g: r.g, bots: r, client: c, rooms: rooms}
+	go r.run(ctx, bot, cfg, env)
+	log.Printf("🤖 bot %s (%s) running in %s", cfg.Name, ident.Nick(), strings.Join(rooms, ", "))
+	return nil
+}
+
+// run feeds the bot from its client queue until the gateway shuts down.
+func (r *botRunner) run(ctx context.Context, bot Bot, cfg BotConfig, env *BotEnv) {
+	defer r.g.dropClient(env.client)
+	var tick <-chan time.Time
+	if th, ok := bot.(TimerHandler); ok && th.Interval() > 0 {
+		t := time.NewTicker(th.Interval())
+		defer t.Stop()
+		tick = t.C
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-r.g.quit:
+			return
+		case <-tick:
+			bot.(TimerHandler).OnTick(env)
+		case b, ok := <-env.client.send:
+			if !ok {
+				return
+			}
+			r.dispatch(bot, cfg.Name, env, parseFrame(b))
+		}
+	}
+}
+
+func (r *botRunner) dispatch(bot Bot, name string, env *BotEnv, f Frame) {
+	switch f.Type {
+	case frameMessage:
+		var cm ChatMsg
+		if err := json.Unmarshal(f.Payload, &cm); err != nil || cm.User == env.client.ident.id || cm.Deleted {
+			return
+		}
+		if cmdName, args, ok := parseCommand(cm); ok {
+			// bots never take commands from each other, so replies that
+			// quote a command cannot start a loop
+			r.mu.Lock()
+			oc, found := r.commands[cmdName]
+			fromBot := r.users[cm.User]
+			r.mu.Unlock()
+			if found && oc.bot == name && !fromBot {
+				oc.cmd.Run(env, cm, args)
+			}
+		}
+		if mh, ok := bot.(MessageHandler); ok {
+			mh.OnMessage(env, cm)
+		}
+	case framePresence:
+		if ph, ok := bot.(PresenceHandler); ok {
+			var p presencePayload
+			if err := json.Unmarshal(f.Payload, &p); err == nil {
+				ph.OnPresence(env, p.Room, p.Members)
+			}
+		}
+	}
+}
+
+// parseCommand splits "!name arg1 arg2" from a plain message or reply.
+func parseCommand(cm ChatMsg) (string, []string, bool) {
+	if cm.Kind != kindText && cm.Kind != kindReply {
+		return "", nil, false
+	}
+	fields := strings.Fields(cm.Text)
+	if len(fields) == 0 || len(fields[0]) < 2 || fields[0][0] != '!' {
+		return "", nil, false
+	}
+	return strings.ToLower(fields[0][1:]), fields[1:], true
+}
+
+// Built-in bots.
+
+func init() {
+	registerBot("help", func(BotConfig) Bot { return helpBot{} })
+	registerBot("echo", func(BotConfig) Bot { return echoBot{} })
+	registerBot("stats", func(cfg BotConfig) Bot {
+		d, _ := time.ParseDuration(cfg.Interval)
+		return statsBot{interval: d}
+	})
+}
+
+// helpBot lists the commands of all running bots.
+type helpBot struct{}
+
+func (helpBot) Name() string { return "help" }
+
+func (helpBot) Commands() map[string]BotCommand {
+	return map[string]BotCommand{
+		"help": {Usage: "!help", Help: "list bot commands", Run: func(env *BotEnv, cm ChatMsg, _ []string) {
+			lines := []string{"Commands:"}
+			for _, c := range env.Commands() {
+				lines = append(lines, c.Usage+" — "+c.Help)
+			}
+			_ = env.Reply(cm, strings.Join(lines, "\n"))
+		}},
+	}
+}
+
+// echoBot repeats its arguments.
+type echoBot struct{}
+
+func (echoBot) Name() string { return "echo" }
+
+func (echoBot) Commands() map[string]BotCommand {
+	return map[string]BotCommand{
+		"echo": {Usage: "!echo <text>", Help: "repeat text", Run: func(env *BotEnv, cm ChatMsg, args []string) {
+			if len(args) > 0 {
+				_ = env.Reply(cm, strings.Join(args, " "))
+			}
+		}},
+	}
+}
+
+// statsBot reports uptime and peer counts on request and, with an
+// interval, posts them to its rooms periodically.
+type statsBot struct {
+	interval time.Duration
+}
+
+func (statsBot) Name() string { return "stats" }
+
+func (b statsBot) Interval() time.Duration { return b.interval }
+
+func (b statsBot) OnTick(env *BotEnv) {
+	for _, room := range env.Rooms() {
+		_ = env.Say(room, b.report(env, room))
+	}
+}
+
+func (b statsBot) Commands() map[string]BotCommand {
+	return map[string]BotCommand{
+		"uptime": {Usage: "!uptime", Help: "node uptime", Run: func(env *BotEnv, cm ChatMsg, _ []string) {
+			_ = env.Reply(cm, "up "+env.Uptime().String())
+		}},
+		"peers": {Usage: "!peers", Help: "connected peers and room members", Run: func(env *BotEnv, cm ChatMsg, _ []string) {
+			_ = env.Reply(cm, b.report(env, cm.Room))
+		}},
+	}
+}
+
+func (statsBot) report(env *BotEnv, room string) string {
+	online := 0
+	for _, m := range env.Members(room) {
+		if m.Status == statusOnline {
+			online++
+		}
+	}
+	return fmt.Sprintf("up %s • %d peers connected • %d in room topic • %d members online", env.Uptime(), env.ConnectedPeers(), env.RoomPeers(room), online)
+}
@@ -7,14 +7,20 @@ import (
 )
 
 type Config struct {
-	AppRoom           string   `yaml:"app_room"`
-	RelayListen       string   `yaml:"relay_listen"`
-	RelayAddr         string   `yaml:"relay_addr"`
-	EnableRelayClient bool     `yaml:"enable_relay_client"`
-	EnableHolePunch   bool     `yaml:"enable_holepunch"`
-	EnableUPnP        bool     `yaml:"enable_upnp"`
-	BootstrapPeers    []string `yaml:"bootstrap_peers"`
-	AnnounceAddrs     []string `yaml:"announce_addrs"`
+	AppRoom           string        `yaml:"app_room"`
+	RelayListen       string        `yaml:"relay_listen"`
+	RelayAddr         string        `yaml:"relay_addr"`
+	RelayToken        string        `yaml:"relay_token"`
+	RelayCount        int           `yaml:"relay_count"`
+	EnableRelayClient bool          `yaml:"enable_relay_client"`
+	EnableHolePunch   bool          `yaml:"enable_holepunch"`
+	EnableUPnP        bool          `yaml:"enable_upnp"`
+	BootstrapPeers    []string      `yaml:"bootstrap_peers"`
+	AnnounceAddrs     []string      `yaml:"announce_addrs"`
+	Gateway           GatewayConfig `yaml:"gateway"`
+	ShutdownTimeout   string        `yaml:"shutdown_timeout"`
+	Webhooks          []Webhook     `yaml:"webhooks"`
+	PubSub            PubSubConfig  `yaml:"pubsub"`
 }
 
 func loadConfig() Config {
@@ -0,0 +1,467 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	cid "github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/routing"
+	mh "github.com/multiformats/go-multihash"
+)
+
+const (
+	fileProtocol     = "/mesh/file/1.0.0"
+	fileChunkSize    = 256 * 1024
+	defaultMaxFile   = 16 << 20
+	fileFetchTimeout = 30 * time.Second
+	maxFileProviders = 8
+)
+
+var (
+	errFileTooLarge  = errors.New("file exceeds size limit")
+	errBlockNotFound = errors.New("block not found")
+	errBadBlock      = errors.New("block does not match its CID")
+	errBadManifest   = errors.New("manifest size does not match its chunks")
+	errBadMime       = errors.New("manifest has an invalid media type")
+)
+
+// inlineTypes are the media types a download is shown inline as. Anything
+// else, SVG and HTML included, is served as an opaque attachment, since
+// the type comes unchecked from the uploader.
+var inlineTypes = map[string]bool{"image/png": true, "image/jpeg": true, "image/gif": true, "image/webp": true}
+
+// validMime reports whether s is empty or a well-formed media type.
+func validMime(s string) bool {
+	if s == "" {
+		return true
+	}
+	_, _, err := mime.ParseMediaType(s)
+	return err == nil && len(s) <= 255
+}
+
+// inlineType returns the lowercased media type of s if a download of that
+// type may be shown inline, or "" if it must be an attachment.
+func inlineType(s string) string {
+	mt, _, err := mime.ParseMediaType(s)
+	if err != nil || !inlineTypes[mt] {
+		return ""
+	}
+	return mt
+}
+
+// Attachment references a shared file from a ChatMsg.
+type Attachment struct {
+	CID  string `json:"cid"`
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+	Mime string `json:"mime,omitempty"`
+}
+
+// fileManifest is stored as its own block; its CID identifies the file.
+type fileManifest struct {
+	Name   string   `json:"name"`
+	Size   int64    `json:"size"`
+	Mime   string   `json:"mime,omitempty"`
+	Chunks []string `json:"chunks"`
+}
+
+// fileStore keeps content-addressed blocks in the data dir and serves them
+// to other peers over fileProtocol.
+type fileStore struct {
+	dir     string
+	h       host.Host
+	router  routing.ContentRouting // optional, used to provide/find files
+	maxSize int64
+}
+
+func newFileStore(h host.Host, router routing.ContentRouting, dir string, maxSize int64) *fileStore {
+	fs := &fileStore{dir: dir, h: h, router: router, maxSize: maxSize}
+	h.SetStreamHandler(fileProtocol, fs.handleStream)
+	return fs
+}
+
+// Close stops serving blocks to other peers.
+func (fs *fileStore) Close() {
+	fs.h.RemoveStreamHandler(fileProtocol)
+}
+
+// blockCID builds a raw CIDv1 over data, the same way bootstrapCID is made.
+func blockCID(data []byte) (cid.Cid, error) {
+	h, err := mh.Sum(data, mh.SHA2_256, -1)
+	if err != nil {
+		return cid.Undef, err
+	}
+	return cid.NewCidV1(cid.Raw, h), nil
+}
+
+func (fs *fileStore) path(c cid.Cid) string {
+	return filepath.Join(fs.dir, c.String())
+}
+
+func (fs *fileStore) put(data []byte) (cid.Cid, error) {
+	c, err := blockCID(data)
+	if err != nil {
+		return cid.Undef, err
+	}
+	p := fs.path(c)
+	if _, err := os.Stat(p); err == nil {
+		return c, nil
+	}
+	if err := os.MkdirAll(fs.dir, 0o755); err != nil {
+		return cid.Undef, err
+	}
+	tmp := p + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return cid.Undef, err
+	}
+	return c, os.Rename(tmp, p)
+}
+
+func (fs *fileStore) get(c cid.Cid) ([]byte, error) {
+	b, err := os.ReadFile(fs.path(c))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, errBlockNotFound
+	}
+	return b, err
+}
+
+// Add chunks r into blocks, stores them with a manifest and announces the
+// manifest CID on the DHT.
+func (fs *fileStore) Add(ctx context.Context, r io.Reader, name, ctype string) (Attachment, error) {
+	if !validMime(ctype) {
+		ctype = ""
+	}
+	m := fileManifest{Name: name, Mime: ctype}
+	buf := make([]byte, fileChunkSize)
+	for {
+		if err := ctx.Err(); err != nil {
+			return Attachment{}, err
+		}
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			m.Size += int64(n)
+			if m.Size > fs.maxSize {
+				return Attachment{}, errFileTooLarge
+			}
+			c, perr := fs.put(buf[:n])
+			if perr != nil {
+				return Attachment{}, perr
+			}
+			m.Chunks = append(m.Chunks, c.String())
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return Attachment{}, err
+		}
+	}
+	mb, _ := json.Marshal(m)
+	c, err := fs.put(mb)
+	if err != nil {
+		return Attachment{}, err
+	}
+	fs.provide(c)
+	return Attachment{CID: c.String(), Name: name, Size: m.Size, Mime: ctype}, nil
+}
+
+func (fs *fileStore) provide(c cid.Cid) {
+	if fs.router == nil {
+		return
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		if err := fs.router.Provide(ctx, c, true); err != nil {
+			log.Println("file provide:", err)
+		}
+	}()
+}
+
+// Fetch makes sure the manifest and every chunk of file c are stored
+// locally, fetching missing blocks from hints or DHT providers. The
+// manifest's Size is checked against the chunks, so it can be trusted as
+// the file's length.
+func (fs *fileStore) Fetch(ctx context.Context, c cid.Cid, hints []peer.ID) (fileManifest, error) {
+	var m fileManifest
+	local := true
+	mb, err := fs.get(c)
+	if err == errBlockNotFound {
+		local = false
+		hints = append(hints, fs.providers(ctx, c)...)
+		mb, err = fs.fetchBlock(ctx, c, hints)
+	}
+	if err != nil {
+		return m, err
+	}
+	if err := json.Unmarshal(mb, &m); err != nil {
+		return m, fmt.Errorf("invalid manifest: %w", err)
+	}
+	if m.Size > fs.maxSize || int64(len(m.Chunks)) > fs.maxSize/fileChunkSize+1 {
+		return m, errFileTooLarge
+	}
+	if !validMime(m.Mime) {
+		return m, errBadMime
+	}
+	var size int64
+	for _, s := range m.Chunks {
+		cc, err := cid.Decode(s)
+		if err != nil {
+			return m, fmt.Errorf("invalid chunk cid: %w", err)
+		}
+		if fi, err := os.Stat(fs.path(cc)); err == nil {
+			size += fi.Size()
+			continue
+		}
+		if local {
+			// the manifest was ours but a chunk went missing; look again
+			local = false
+			hints = append(hints, fs.providers(ctx, c)...)
+		}
+		data, err := fs.fetchBlock(ctx, cc, hints)
+		if err != nil {
+			return m, err
+		}
+		size += int64(len(data))
+	}
+	if size != m.Size {
+		return m, errBadManifest
+	}
+	if !local {
+		fs.provide(c)
+	}
+	return m, nil
+}
+
+func (fs *fileStore) providers(ctx context.Context, c cid.Cid) []peer.ID {
+	if fs.router == nil {
+		return nil
+	}
+	var out []peer.ID
+	for pi := range fs.router.FindProvidersAsync(ctx, c, maxFileProviders) {
+		if pi.ID == fs.h.ID() {
+			continue
+		}
+		fs.h.Peerstore().AddAddrs(pi.ID, pi.Addrs, time.Hour)
+		out = append(out, pi.ID)
+	}
+	return out
+}
+
+// fetchBlock asks each candidate peer in turn for c, verifies the data
+// against the CID and stores it.
+func (fs *fileStore) fetchBlock(ctx context.Context, c cid.Cid, peers []peer.ID) ([]byte, error) {
+	lastErr := errBlockNotFound
+	seen := map[peer.ID]bool{}
+	for _, p := range peers {
+		if p == fs.h.ID() || seen[p] {
+			continue
+		}
+		seen[p] = true
+		data, err := fs.requestBlock(ctx, p, c)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if got, err := blockCID(data); err != nil || !got.Equals(c) {
+			lastErr = errBadBlock
+			continue
+		}
+		if _, err := fs.put(data); err != nil {
+			return nil, err
+		}
+		return data, nil
+	}
+	return nil, lastErr
+}
+
+func (fs *fileStore) requestBlock(ctx context.Context, p peer.ID, c cid.Cid) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, fileFetchTimeout)
+	defer cancel()
+	s, err := fs.h.NewStream(ctx, p, fileProtocol)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+	if dl, ok := ctx.Deadline(); ok {
+		_ = s.SetDeadline(dl)
+	}
+	if _, err := s.Write([]byte(c.String() + "\n")); err != nil {
+		s.Reset()
+		return nil, err
+	}
+	_ = s.CloseWrite()
+	r := bufio.NewReader(s)
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if n == 0 {
+		return nil, errBlockNotFound
+	}
+	if n > fileChunkSize {
+		s.Reset()
+		return nil, errBadBlock
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// handleStream answers a single block request: a CID line in, a uvarint
+// length followed by the block out (length 0 if we do not have it).
+func (fs *fileStore) handleStream(s network.Stream) {
+	defer s.Close()
+	_ = s.SetDeadline(time.Now().Add(fileFetchTimeout))
+	line, err := bufio.NewReader(io.LimitReader(s, 256)).ReadString('\n')
+	if err != nil {
+		s.Reset()
+		return
+	}
+	var data []byte
+	if c, err := cid.Decode(strings.TrimSpace(line)); err == nil {
+		data, _ = fs.get(c)
+	}
+	hdr := binary.AppendUvarint(nil, uint64(len(data)))
+	if _, err := s.Write(append(hdr, data...)); err != nil {
+		s.Reset()
+	}
+}
+
+// WriteTo streams the content of a locally complete file to w.
+func (fs *fileStore) WriteTo(w io.Writer, m fileManifest) error {
+	for _, s := range m.Chunks {
+		c, err := cid.Decode(s)
+		if err != nil {
+			return err
+		}
+		data, err := fs.get(c)
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// handleUpload stores a multipart "file" part and returns its attachment.
+// With ?room= the file is also announced in that room.
+func (g *Gateway) handleUpload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, g.files.maxSize+1<<20)
+	mr, err := r.MultipartReader()
+	if err != nil {
+		http.Error(w, "multipart body required", http.StatusBadRequest)
+		return
+	}
+	var att Attachment
+	for {
+		part, err := mr.NextPart()
+		if err != nil {
+			http.Error(w, "missing file part", http.StatusBadRequest)
+			return
+		}
+		if part.FormName() != "file" {
+			continue
+		}
+		name := filepath.Base(part.FileName())
+		if name == "." || name == string(filepath.Separator) {
+			name = "file"
+		}
+		att, err = g.files.Add(r.Context(), part, name, part.Header.Get("Content-Type"))
+		if errors.Is(err, errFileTooLarge) || errors.As(err, new(*http.MaxBytesError)) {
+			http.Error(w, errFileTooLarge.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err != nil {
+			log.Println("file add:", err)
+			http.Error(w, "store failed", http.StatusInternalServerError)
+			return
+		}
+		break
+	}
+	if room := r.URL.Query().Get("room"); room != "" {
+		ident, err := g.identityFor(sessionFrom(r))
+		if err != nil {
+			http.Error(w, "identity unavailable", http.StatusInternalServerError)
+			return
+		}
+		cm, err := g.publish(r.Context(), room, ChatMsg{Text: att.Name, Attachment: &att}, ident)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(cm)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(att)
+}
+
+// handleDownload serves /files/<cid>, fetching missing blocks from the
+// mesh first. ?from=<peer> names a peer known to have the file.
+func (g *Gateway) handleDownload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	c, err := cid.Decode(strings.TrimPrefix(r.URL.Path, "/files/"))
+	if err != nil {
+		http.Error(w, "invalid cid", http.StatusBadRequest)
+		return
+	}
+	var hints []peer.ID
+	if id, err := peer.Decode(r.URL.Query().Get("from")); err == nil {
+		hints = append(hints, id)
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Minute)
+	defer cancel()
+	m, err := g.files.Fetch(ctx, c, hints)
+	switch {
+	case errors.Is(err, errBlockNotFound):
+		http.Error(w, "file not found", http.StatusNotFound)
+		return
+	case errors.Is(err, errFileTooLarge):
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	case err != nil:
+		http.Error(w, "fetch failed: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	ctype, disposition := "application/octet-stream", "attachment"
+	if mt := inlineType(m.Mime); mt != "" {
+		ctype, disposition = mt, "inline"
+	}
+	w.Header().Set("Content-Type", ctype)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": m.Name}))
+	w.Header().Set("Content-Length", strconv.FormatInt(m.Size, 10))
+	w.Header().Set("Content-Security-Policy", "sandbox")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if err := g.files.WriteTo(w, m); err != nil {
+		log.Println("file write:", err)
+	}
+}
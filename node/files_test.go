@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	cid "github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+func testFileStore(t *testing.T, maxSize int64) *fileStore {
+	t.Helper()
+	h, err := libp2p.New(libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { h.Close() })
+	return newFileStore(h, nil, t.TempDir(), maxSize)
+}
+
+func TestFileRoundTrip(t *testing.T) {
+	fs := testFileStore(t, defaultMaxFile)
+	data := make([]byte, 2*fileChunkSize+100)
+	_, _ = rand.Read(data)
+	att, err := fs.Add(context.Background(), bytes.NewReader(data), "a.bin", "application/octet-stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if att.Size != int64(len(data)) {
+		t.Errorf("size = %d, want %d", att.Size, len(data))
+	}
+	c, err := cid.Decode(att.CID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := fs.Fetch(context.Background(), c, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Chunks) != 3 {
+		t.Errorf("%d chunks, want 3", len(m.Chunks))
+	}
+	var out bytes.Buffer
+	if err := fs.WriteTo(&out, m); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), data) {
+		t.Error("file content changed")
+	}
+
+	if _, err := fs.Add(context.Background(), bytes.NewReader(make([]byte, defaultMaxFile+1)), "big", ""); !errors.Is(err, errFileTooLarge) {
+		t.Errorf("oversized upload: %v, want %v", err, errFileTooLarge)
+	}
+}
+
+func TestFetchManifestChecks(t *testing.T) {
+	fs := testFileStore(t, 4*fileChunkSize)
+	chunk, err := fs.put([]byte("chunk"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	missing, _ := blockCID([]byte("not stored"))
+	many := make([]string, 6)
+	for i := range many {
+		many[i] = chunk.String()
+	}
+
+	tests := []struct {
+		name    string
+		m       any
+		want    error
+		anyFail bool
+	}{
+		{"valid", fileManifest{Name: "a", Size: 5, Chunks: []string{chunk.String()}}, nil, false},
+		{"size over the limit", fileManifest{Name: "a", Size: 4*fileChunkSize + 1, Chunks: []string{chunk.String()}}, errFileTooLarge, false},
+		{"too many chunks", fileManifest{Name: "a", Size: 5, Chunks: many}, errFileTooLarge, false},
+		{"size shorter than the chunks", fileManifest{Name: "a", Size: 3, Chunks: []string{chunk.String()}}, errBadManifest, false},
+		{"size longer than the chunks", fileManifest{Name: "a", Size: fileChunkSize, Chunks: []string{chunk.String()}}, errBadManifest, false},
+		{"malformed media type", fileManifest{Name: "a", Size: 5, Mime: "text/html; ;", Chunks: []string{chunk.String()}}, errBadMime, false},
+		{"missing chunk", fileManifest{Name: "a", Size: 5, Chunks: []string{missing.String()}}, errBlockNotFound, false},
+		{"malformed chunk cid", fileManifest{Name: "a", Size: 5, Chunks: []string{"nope"}}, nil, true},
+		{"not a manifest", "just a string", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mb, _ := json.Marshal(tt.m)
+			c, err := fs.put(mb)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = fs.Fetch(context.Background(), c, nil)
+			if tt.anyFail {
+				if err == nil {
+					t.Error("Fetch accepted the manifest")
+				}
+				return
+			}
+			if !errors.Is(err, tt.want) {
+				t.Errorf("Fetch = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestFetchBlockVerifiesCID(t *testing.T) {
+	server := testFileStore(t, defaultMaxFile)
+	client := testFileStore(t, defaultMaxFile)
+	if err := client.h.Connect(context.Background(), peer.AddrInfo{ID: server.h.ID(), Addrs: server.h.Addrs()}); err != nil {
+		t.Fatal(err)
+	}
+	good, err := server.put([]byte("good block"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a block stored under another block's CID, as a lying peer would serve it
+	forged, _ := blockCID([]byte("expected"))
+	if err := os.WriteFile(server.path(forged), []byte("something else"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	peers := []peer.ID{server.h.ID()}
+	if data, err := client.fetchBlock(context.Background(), good, peers); err != nil || string(data) != "good block" {
+		t.Errorf("good block: %q, %v", data, err)
+	}
+	if _, err := client.get(good); err != nil {
+		t.Errorf("good block not stored: %v", err)
+	}
+	if _, err := client.fetchBlock(context.Background(), forged, peers); !errors.Is(err, errBadBlock) {
+		t.Errorf("forged block: %v, want %v", err, errBadBlock)
+	}
+	if _, err := client.get(forged); !errors.Is(err, errBlockNotFound) {
+		t.Errorf("forged block was stored: %v", err)
+	}
+	missing, _ := blockCID([]byte("nobody has this"))
+	if _, err := client.fetchBlock(context.Background(), missing, peers); !errors.Is(err, errBlockNotFound) {
+		t.Errorf("missing block: %v, want %v", err, errBlockNotFound)
+	}
+}
+
+func TestDownloadHeaders(t *testing.T) {
+	g := &Gateway{files: testFileStore(t, defaultMaxFile)}
+	tests := []struct {
+		mime        string
+		ctype       string
+		disposition string
+	}{
+		{"image/png", "image/png", "inline"},
+		{"IMAGE/JPEG; quality=high", "image/jpeg", "inline"},
+		{"image/webp", "image/webp", "inline"},
+		{"image/svg+xml", "application/octet-stream", "attachment"},
+		{"image/svg+xml; charset=utf-8", "application/octet-stream", "attachment"},
+		{"IMAGE/SVG+XML", "application/octet-stream", "attachment"},
+		{"text/html", "application/octet-stream", "attachment"},
+		{"", "application/octet-stream", "attachment"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mime, func(t *testing.T) {
+			mb, _ := json.Marshal(fileManifest{Name: "f", Mime: tt.mime})
+			c, err := g.files.put(mb)
+			if err != nil {
+				t.Fatal(err)
+			}
+			w := httptest.NewRecorder()
+			g.handleDownload(w, httptest.NewRequest(http.MethodGet, "/files/"+c.String(), nil))
+			if w.Code != http.StatusOK {
+				t.Fatalf("status %d: %s", w.Code, w.Body)
+			}
+			h := w.Header()
+			if got := h.Get("Content-Type"); got != tt.ctype {
+				t.Errorf("Content-Type = %q, want %q", got, tt.ctype)
+			}
+			if got, _, _ := mime.ParseMediaType(h.Get("Content-Disposition")); got != tt.disposition {
+				t.Errorf("Content-Disposition = %q, want %s", h.Get("Content-Disposition"), tt.disposition)
+			}
+			if got := h.Get("Content-Security-Policy"); got != "sandbox" {
+				t.Errorf("Content-Security-Policy = %q, want sandbox", got)
+			}
+		})
+	}
+}
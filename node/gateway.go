@@ -3,13 +3,19 @@ package main
 import (
 	"context"
 	"crypto/sha256"
+	"crypto/tls"
 	_ "embed"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"net"
 	"net/http"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -17,70 +23,263 @@ import (
 	cpuid "github.com/klauspost/cpuid/v2"
 	pubsub "github.com/libp2p/go-libp2p-pubsub"
 	host "github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/routing"
 )
 
 type ChatMsg struct {
-	From string `json:"from"`
-	ID   string `json:"id"`
-	Text string `json:"text"`
-	Ts   int64  `json:"ts"`
+	From   string `json:"from"`
+	ID     string `json:"id"`
+	Text   string `json:"text"`
+	Ts     int64  `json:"ts"`
+	Room   string `json:"room,omitempty"`
+	MsgID  string `json:"msg_id,omitempty"`
+	Kind   string `json:"kind,omitempty"`   // reply, edit, delete, reaction
+	Ref    string `json:"ref,omitempty"`    // msg_id the kind refers to
+	Remove bool   `json:"remove,omitempty"` // withdraw a reaction
+
+	Attachment *Attachment `json:"attachment,omitempty"`
+	Mod        *ModAction  `json:"mod,omitempty"` // kind "mod" only
+
+	// set when a gateway user, not the node itself, wrote the message
+	User string `json:"user,omitempty"`
+	Sig  []byte `json:"sig,omitempty"`
+
+	// state folded in by the history store; reset on every received message
+	Edited  int64 `json:"edited,omitempty"`
+	Deleted bool  `json:"deleted,omitempty"`
 }
 
+// wsCloseWait is how long Shutdown waits for clients to answer the close
+// frame before dropping their connections.
+const wsCloseWait = 2 * time.Second
+
+// WSClient is a websocket connection or, with conn nil, an SSE stream.
 type WSClient struct {
-	conn *websocket.Conn
-	send chan []byte
+	conn  *websocket.Conn
+	send  chan []byte
+	rooms map[string]bool // guarded by Gateway.mu
+	ident *userIdentity   // nil when the caller is anonymous
+	role  role
+}
+
+// gatewayRoom is a joined room topic together with its subscription and
+// the room's presence topic and roster.
+type gatewayRoom struct {
+	name      string
+	topic     *pubsub.Topic
+	sub       *pubsub.Subscription
+	presTopic *pubsub.Topic
+	presSub   *pubsub.Subscription
+	roster    *roster
+	cancel    context.CancelFunc
 }
 
 type Gateway struct {
 	h        host.Host
 	psub     *pubsub.PubSub
-	topic    *pubsub.Topic
-	sub      *pubsub.Subscription
+	guard    *topicGuard
+	mods     *moderationStore
+	rooms    map[string]*gatewayRoom
 	clients  map[*WSClient]bool
+	history  *historyStore
+	files    *fileStore
+	auth     *authenticator
+	idents   *identityStore
+	hooks    *webhookDispatcher
+	relays   *relayManager
+	bots     *botRunner
+	mqtt     *mqttBridge
+	irc      *ircServer
+	ctx      context.Context
 	mu       sync.RWMutex
 	upgrader websocket.Upgrader
 	nick     string
 	room     string
+	status   string
+	srv      *http.Server
+	closing  bool          // set by Shutdown; no new clients or rooms
+	quit     chan struct{} // closed by Shutdown to end event streams and bots
+	started  time.Time
 }
 
-func NewGateway(h host.Host, psub *pubsub.PubSub, topic *pubsub.Topic, sub *pubsub.Subscription, nick, room string) *Gateway {
+func NewGateway(h host.Host, psub *pubsub.PubSub, files *fileStore, auth *authenticator, topic *pubsub.Topic, sub *pubsub.Subscription, nick, room string) *Gateway {
 	return &Gateway{
 		h:       h,
 		psub:    psub,
-		topic:   topic,
-		sub:     sub,
+		rooms:   map[string]*gatewayRoom{room: {name: room, topic: topic, sub: sub}},
 		clients: make(map[*WSClient]bool),
+		history: newHistoryStore(filepath.Join(dataDir, "history")),
+		files:   files,
+		auth:    auth,
+		idents:  newIdentityStore(filepath.Join(dataDir, "identities")),
 		upgrader: websocket.Upgrader{
 			ReadBufferSize:  1024,
 			WriteBufferSize: 1024,
-			CheckOrigin:     func(r *http.Request) bool { return true },
+			CheckOrigin:     auth.checkOrigin,
 		},
-		nick: nick,
-		room: room,
+		nick:    nick,
+		room:    room,
+		status:  statusOnline,
+		quit:    make(chan struct{}),
+		started: time.Now(),
 	}
 }
 
-func (g *Gateway) Start(ctx context.Context, webAddr string) error {
+func (g *Gateway) Start(ctx context.Context, webAddr string, tlsConf *tls.Config) error {
 
 	// consume pubsub -> fanout to websockets
-	go g.consume(ctx)
+	g.mu.Lock()
+	g.ctx = ctx
+	for _, rm := range g.rooms {
+		if err := g.joinPresence(rm); err != nil {
+			log.Println("presence join:", err)
+		}
+		g.startConsume(rm)
+		go g.heartbeat(ctx, rm.name)
+	}
+	g.mu.Unlock()
+	go g.presenceLoop(ctx)
+	go g.auth.run(ctx)
+	if g.bots != nil {
+		g.bots.Start(ctx)
+	}
+	if g.mqtt != nil {
+		if err := g.mqtt.Start(ctx); err != nil {
+			log.Println("mqtt bridge:", err)
+		}
+	}
+	if g.irc != nil {
+		if err := g.irc.Start(ctx); err != nil {
+			log.Println("irc server:", err)
+		}
+	}
 
 	http.HandleFunc("/", g.serveIndex)
-	http.HandleFunc("/ws", g.serveWS)
-	http.HandleFunc("/config", g.handleConfig)
+	http.HandleFunc("/login", g.auth.handleLogin)
+	http.HandleFunc("/logout", g.auth.handleLogout)
+	http.HandleFunc("/session", g.auth.handleSession)
+	http.HandleFunc("/users", g.auth.require(roleAdmin, g.auth.handleUsers))
+	http.HandleFunc("/ws", g.auth.require(roleRead, g.serveWS))
+	http.HandleFunc("/config", g.auth.require(roleRead, g.handleConfig))
+	http.HandleFunc("/files", g.auth.require(roleWrite, g.handleUpload))
+	http.HandleFunc("/files/", g.auth.require(roleRead, g.handleDownload))
+	http.HandleFunc("/rooms/", g.auth.require(roleRead, g.handleRooms))
+	http.HandleFunc("/webhooks/deliveries", g.auth.require(roleAdmin, g.hooks.handleDeliveries))
+	http.HandleFunc("/relays", g.auth.require(roleRead, g.relays.handleRelays))
+
+	if !g.auth.enabled() {
+		log.Println("⚠️  gateway authentication disabled: set GATEWAY_TOKENS or GATEWAY_ADMIN_USER/GATEWAY_ADMIN_PASSWORD")
+	}
 
+	srv := &http.Server{Addr: webAddr, TLSConfig: tlsConf}
+	g.mu.Lock()
+	if g.closing {
+		g.mu.Unlock()
+		return http.ErrServerClosed
+	}
+	g.srv = srv
+	g.mu.Unlock()
+	if tlsConf != nil {
+		log.Printf("🌐 Chat UI on https://0.0.0.0%s  (room=%s nick=%s)\n", webAddr, g.room, g.nick)
+		return srv.ListenAndServeTLS("", "")
+	}
 	log.Printf("🌐 Chat UI on http://0.0.0.0%s  (room=%s nick=%s)\n", webAddr, g.room, g.nick)
-	return http.ListenAndServe(webAddr, nil)
+	return srv.ListenAndServe()
 }
 
-func (g *Gateway) consume(ctx context.Context) {
+// Shutdown stops the gateway in order: no new HTTP requests or websockets,
+// a close frame to every client, an offline presence notice in each room,
+// then the room subscriptions and the history files. Clients that do not
+// complete the close handshake are dropped when ctx expires.
+func (g *Gateway) Shutdown(ctx context.Context) {
+	g.mu.Lock()
+	if g.closing {
+		g.mu.Unlock()
+		return
+	}
+	g.closing = true
+	close(g.quit)
+	srv := g.srv
+	clients := make([]*WSClient, 0, len(g.clients))
+	for c := range g.clients {
+		clients = append(clients, c)
+	}
+	g.mu.Unlock()
+
+	if srv != nil {
+		// hijacked websocket connections are not tracked by the server
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Println("gateway http shutdown:", err)
+		}
+	}
+	msg := websocket.FormatCloseMessage(websocket.CloseGoingAway, "node shutting down")
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(time.Second)
+	}
+	for _, c := range clients {
+		if c.conn != nil {
+			_ = c.conn.WriteControl(websocket.CloseMessage, msg, deadline)
+		}
+	}
+	// the readers see the close reply and unregister their clients
+	wait := time.Now().Add(wsCloseWait)
+	for g.clientCount() > 0 && ctx.Err() == nil && time.Now().Before(wait) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if g.clientCount() > 0 {
+		for _, c := range clients {
+			if c.conn != nil {
+				_ = c.conn.Close()
+			}
+		}
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for name, rm := range g.rooms {
+		if rm.presTopic != nil {
+			b, _ := json.Marshal(PresenceMsg{Nick: g.nick, Peer: g.h.ID().String(), Status: statusOffline, Ts: time.Now().Unix()})
+			if err := rm.presTopic.Publish(ctx, b); err != nil {
+				log.Println("presence publish:", err)
+			}
+			rm.presSub.Cancel()
+			rm.presTopic.Close()
+		}
+		if rm.cancel != nil {
+			rm.cancel()
+		}
+		rm.sub.Cancel()
+		rm.topic.Close()
+		delete(g.rooms, name)
+	}
+	g.files.Close()
+	if err := g.history.Close(); err != nil {
+		log.Println("history close:", err)
+	}
+}
+
+func (g *Gateway) clientCount() int {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	return len(g.clients)
+}
+
+// startConsume runs the pubsub reader for rm. mu must be held.
+func (g *Gateway) startConsume(rm *gatewayRoom) {
+	ctx, cancel := context.WithCancel(g.ctx)
+	rm.cancel = cancel
+	go g.consume(ctx, rm)
+	if rm.presSub != nil {
+		go g.consumePresence(ctx, rm)
+	}
+}
+
+func (g *Gateway) consume(ctx context.Context, rm *gatewayRoom) {
 	for {
-		g.mu.RLock()
-		sub := g.sub
-		g.mu.RUnlock()
-		msg, err := sub.Next(ctx)
+		msg, err := rm.sub.Next(ctx)
 		if err != nil {
-			if ctx.Err() != nil {
+			if ctx.Err() != nil || err == pubsub.ErrSubscriptionCancelled {
 				return
 			}
 			log.Println("pubsub sub.Next:", err)
@@ -90,8 +289,149 @@ func (g *Gateway) consume(ctx context.Context) {
 		if err := json.Unmarshal(msg.Data, &cm); err != nil {
 			continue
 		}
+		// the pubsub signature vouches for the sender, not the payload
+		cm.ID = msg.GetFrom().String()
+		cm.Room = rm.name
+		cm.Edited, cm.Deleted = 0, false
+		if cm.MsgID == "" {
+			cm.MsgID = derivedMsgID(msg.ID)
+		}
+		if err := verifyMsg(cm); err != nil {
+			continue
+		}
+		if cm.Kind == kindModerate {
+			if checkModMsg(rm.name, cm) == nil {
+				recs := []ChatMsg{cm}
+				if cm.Mod.Action == modSync {
+					recs = cm.Mod.Records
+				}
+				g.applyModeration(rm.name, recs)
+			}
+			continue
+		}
+		if err := g.validate(rm.name, cm); err != nil {
+			continue
+		}
+		g.history.Add(rm.name, cm)
 		g.broadcast(cm)
+		g.hooks.Emit(webhookEvent{Type: eventMessage, Room: rm.name, Message: &cm})
+		if rm.roster != nil {
+			if e, ok := rm.roster.stopTyping(msg.GetFrom(), cm.User); ok {
+				g.pushTyping(rm.name, *e)
+			}
+		}
+	}
+}
+
+// joinRoom subscribes the node to a room topic if it is not joined yet and
+// adds the room to c's rooms under the same lock, so that a client leaving
+// the room meanwhile cannot release it. c may be nil.
+func (g *Gateway) joinRoom(c *WSClient, name string) (*gatewayRoom, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	rm, err := g.openRoom(name)
+	if err == nil && c != nil {
+		c.rooms[name] = true
+	}
+	return rm, err
+}
+
+// openRoom subscribes the node to a room topic if it is not joined yet. mu
+// must be held.
+func (g *Gateway) openRoom(name string) (*gatewayRoom, error) {
+	if rm, ok := g.rooms[name]; ok {
+		return rm, nil
+	}
+	if g.closing {
+		return nil, errors.New("gateway is shutting down")
+	}
+	topic, err := g.guard.join(g.psub, "room:"+name)
+	if err != nil {
+		return nil, err
+	}
+	sub, err := topic.Subscribe()
+	if err != nil {
+		topic.Close()
+		return nil, err
+	}
+	rm := &gatewayRoom{name: name, topic: topic, sub: sub}
+	if err := g.joinPresence(rm); err != nil {
+		log.Println("presence join:", err)
 	}
+	g.rooms[name] = rm
+	if g.ctx != nil {
+		g.startConsume(rm)
+		go g.heartbeat(g.ctx, name)
+	}
+	return rm, nil
+}
+
+// releaseRoom leaves a room topic once neither the node's default room nor
+// any websocket client refers to it. mu must be held.
+func (g *Gateway) releaseRoom(name string) {
+	rm, ok := g.rooms[name]
+	if !ok || name == g.room {
+		return
+	}
+	for c := range g.clients {
+		if c.rooms[name] {
+			return
+		}
+	}
+	if rm.presTopic != nil {
+		b, _ := json.Marshal(PresenceMsg{Nick: g.nick, Peer: g.h.ID().String(), Status: statusOffline, Ts: time.Now().Unix()})
+		_ = rm.presTopic.Publish(context.Background(), b)
+		rm.presSub.Cancel()
+		rm.presTopic.Close()
+	}
+	if rm.cancel != nil {
+		rm.cancel()
+	}
+	rm.sub.Cancel()
+	rm.topic.Close()
+	delete(g.rooms, name)
+}
+
+// publish sends a chat message to room, written by user u or, when u is
+// nil, by the node itself. cm carries the text and, for non-plain kinds, the
+// kind and ref, plus From to override the author's nick; the remaining
+// fields are filled in here.
+func (g *Gateway) publish(ctx context.Context, room string, cm ChatMsg, u *userIdentity) (ChatMsg, error) {
+	g.mu.RLock()
+	rm, ok := g.rooms[room]
+	nick := g.nick
+	g.mu.RUnlock()
+	if u != nil {
+		nick = u.Nick()
+	}
+	if cm.From == "" {
+		cm.From = nick
+	}
+	cm.ID = g.h.ID().String()
+	cm.Ts = time.Now().Unix()
+	cm.Room = room
+	cm.MsgID = newMsgID()
+	cm.Edited, cm.Deleted = 0, false
+	cm.User, cm.Sig = "", nil
+	if !ok {
+		return cm, fmt.Errorf("room %q not joined", room)
+	}
+	if u != nil {
+		if err := u.sign(&cm); err != nil {
+			return cm, err
+		}
+	}
+	if err := g.guard.checkChat(cm); err != nil {
+		return cm, rejectError{err}
+	}
+	if err := g.validate(room, cm); err != nil {
+		return cm, rejectError{err}
+	}
+	if err := g.guard.allowOwn("room:" + room); err != nil {
+		return cm, rejectError{err}
+	}
+	payload, _ := json.Marshal(cm)
+	return cm, rm.topic.Publish(ctx, payload)
 }
 
 //go:embed web/index.html
@@ -102,13 +442,36 @@ func (g *Gateway) serveIndex(w http.ResponseWriter, r *http.Request) {
 	_, _ = w.Write(indexHTML)
 }
 
+// identityFor returns the chat identity of an authenticated caller, or nil
+// when they act as the node (authentication disabled).
+func (g *Gateway) identityFor(s *session) (*userIdentity, error) {
+	if s == nil || s.user == "" {
+		return nil, nil
+	}
+	return g.idents.get(s.identity())
+}
+
 func (g *Gateway) serveWS(w http.ResponseWriter, r *http.Request) {
+	s := sessionFrom(r)
+	ident, err := g.identityFor(s)
+	if err != nil {
+		log.Println("user identity:", err)
+		http.Error(w, "identity unavailable", http.StatusInternalServerError)
+		return
+	}
 	conn, err := g.upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		return
 	}
-	client := &WSClient{conn: conn, send: make(chan []byte, 32)}
+	client := &WSClient{conn: conn, send: make(chan []byte, 32), rooms: map[string]bool{}, ident: ident, role: s.role}
 	g.mu.Lock()
+	if g.closing {
+		g.mu.Unlock()
+		_ = conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, "node shutting down"))
+		_ = conn.Close()
+		return
+	}
+	client.rooms[g.room] = true
 	g.clients[client] = true
 	g.mu.Unlock()
 
@@ -119,12 +482,10 @@ func (g *Gateway) serveWS(w http.ResponseWriter, r *http.Request) {
 		}
 	}()
 
-	// reader -> publish to GossipSub
+	// reader -> handle frames
 	go func() {
 		defer func() {
-			g.mu.Lock()
-			delete(g.clients, client)
-			g.mu.Unlock()
+			g.dropClient(client)
 			_ = conn.Close()
 		}()
 		for {
@@ -132,28 +493,239 @@ func (g *Gateway) serveWS(w http.ResponseWriter, r *http.Request) {
 			if err != nil {
 				return
 			}
-			g.mu.RLock()
-			nick := g.nick
-			g.mu.RUnlock()
-			cm := ChatMsg{
-				From: nick,
-				ID:   g.h.ID().String(),
-				Text: string(data),
-				Ts:   time.Now().Unix(),
-			}
-			payload, _ := json.Marshal(cm)
-			if err := g.topic.Publish(context.Background(), payload); err != nil {
+			g.handleFrame(client, parseFrame(data))
+		}
+	}()
+}
+
+// attach registers an in-process client acting as u in rooms, joining them
+// as needed. Frames for those rooms arrive on the client's send channel;
+// dropClient detaches it.
+func (g *Gateway) attach(ctx context.Context, u *userIdentity, r role, rooms []string) (*WSClient, error) {
+	c := &WSClient{send: make(chan []byte, sseBuffer), rooms: map[string]bool{}, ident: u, role: r}
+	g.mu.Lock()
+	if g.closing {
+		g.mu.Unlock()
+		return nil, errors.New("gateway is shutting down")
+	}
+	g.clients[c] = true
+	g.mu.Unlock()
+	for _, room := range rooms {
+		if _, err := g.joinRoom(c, room); err != nil {
+			g.dropClient(c)
+			return nil, fmt.Errorf("join %s: %w", room, err)
+		}
+	}
+	for _, room := range rooms {
+		go g.publishPresence(ctx, room, u, "", false)
+	}
+	return c, nil
+}
+
+// dropClient unregisters c, ends its writer and leaves the rooms nobody
+// else needs.
+func (g *Gateway) dropClient(c *WSClient) {
+	g.mu.Lock()
+	delete(g.clients, c)
+	close(c.send) // nothing queues once unregistered
+	rooms := make([]string, 0, len(c.rooms))
+	for name := range c.rooms {
+		rooms = append(rooms, name)
+	}
+	g.mu.Unlock()
+	for _, name := range rooms {
+		g.userLeft(c.ident, name)
+	}
+	g.mu.Lock()
+	for _, name := range rooms {
+		g.releaseRoom(name)
+	}
+	g.mu.Unlock()
+}
+
+// reply queues a frame for a single client without blocking.
+func (c *WSClient) reply(b []byte) {
+	select {
+	case c.send <- b:
+	default:
+	}
+}
+
+// handleFrame dispatches one websocket request and answers it with an ack,
+// a typed response or an error frame carrying the request ID.
+func (g *Gateway) handleFrame(c *WSClient, f Frame) {
+	if f.V > protocolVersion {
+		c.reply(errorFrame(f.ID, errUnsupported, fmt.Sprintf("protocol version %d not supported", f.V)))
+		return
+	}
+	if (f.Type == frameSend || f.Type == frameTyping || f.Type == frameModerate) && c.role < roleWrite {
+		c.reply(errorFrame(f.ID, errForbidden, "write access required"))
+		return
+	}
+	switch f.Type {
+	case frameSend:
+		var p sendPayload
+		if err := json.Unmarshal(f.Payload, &p); err != nil {
+			c.reply(errorFrame(f.ID, errBadRequest, "invalid send payload"))
+			return
+		}
+		room, ok := g.clientRoom(c, p.Room)
+		if !ok {
+			c.reply(errorFrame(f.ID, errNotJoined, "not joined to room "+room))
+			return
+		}
+		if p.Text == "" && p.Attachment != nil {
+			p.Text = p.Attachment.Name
+		}
+		cm, err := g.publish(context.Background(), room, ChatMsg{Text: p.Text, Kind: p.Kind, Ref: p.Ref, Remove: p.Remove, Attachment: p.Attachment}, c.ident)
+		if err != nil {
+			code := errPublishFailed
+			if errors.As(err, new(rejectError)) {
+				code = errRejected
+			} else {
 				log.Println("topic.Publish:", err)
 			}
+			c.reply(errorFrame(f.ID, code, err.Error()))
+			return
 		}
-	}()
+		c.reply(newFrame(frameAck, f.ID, cm))
+	case frameJoin:
+		var p roomPayload
+		if err := json.Unmarshal(f.Payload, &p); err != nil || strings.TrimSpace(p.Room) == "" {
+			c.reply(errorFrame(f.ID, errBadRequest, "join requires room"))
+			return
+		}
+		if g.bannedFrom(p.Room, c.ident) {
+			c.reply(errorFrame(f.ID, errForbidden, errBanned.Error()))
+			return
+		}
+		if _, err := g.joinRoom(c, p.Room); err != nil {
+			c.reply(errorFrame(f.ID, errJoinFailed, err.Error()))
+			return
+		}
+		c.reply(newFrame(frameAck, f.ID, p))
+	case frameLeave:
+		var p roomPayload
+		if err := json.Unmarshal(f.Payload, &p); err != nil || p.Room == "" {
+			c.reply(errorFrame(f.ID, errBadRequest, "leave requires room"))
+			return
+		}
+		g.mu.Lock()
+		joined := c.rooms[p.Room]
+		delete(c.rooms, p.Room)
+		g.mu.Unlock()
+		if !joined {
+			c.reply(newFrame(frameAck, f.ID, p))
+			return
+		}
+		g.userLeft(c.ident, p.Room)
+		g.mu.Lock()
+		g.releaseRoom(p.Room)
+		g.mu.Unlock()
+		c.reply(newFrame(frameAck, f.ID, p))
+	case frameHistory:
+		var p historyRequest
+		_ = json.Unmarshal(f.Payload, &p)
+		room, ok := g.clientRoom(c, p.Room)
+		if !ok {
+			c.reply(errorFrame(f.ID, errNotJoined, "not joined to room "+room))
+			return
+		}
+		c.reply(newFrame(frameHistory, f.ID, historyPayload{Room: room, Messages: g.history.Recent(room, p.Limit)}))
+	case framePresence:
+		var p presenceRequest
+		_ = json.Unmarshal(f.Payload, &p)
+		room, ok := g.clientRoom(c, p.Room)
+		if !ok {
+			c.reply(errorFrame(f.ID, errNotJoined, "not joined to room "+room))
+			return
+		}
+		if p.Status != "" {
+			if c.role < roleWrite {
+				c.reply(errorFrame(f.ID, errForbidden, "write access required"))
+				return
+			}
+			if p.Status != statusOnline && p.Status != statusAway {
+				c.reply(errorFrame(f.ID, errBadRequest, "status must be online or away"))
+				return
+			}
+			if c.ident != nil {
+				c.ident.SetStatus(p.Status)
+			} else {
+				g.mu.Lock()
+				g.status = p.Status
+				g.mu.Unlock()
+			}
+			for _, name := range g.roomNames() {
+				_ = g.publishPresence(context.Background(), name, c.ident, p.Status, false)
+			}
+		}
+		c.reply(newFrame(framePresence, f.ID, g.presence(room)))
+	case frameTyping:
+		var p typingRequest
+		_ = json.Unmarshal(f.Payload, &p)
+		room, ok := g.clientRoom(c, p.Room)
+		if !ok {
+			c.reply(errorFrame(f.ID, errNotJoined, "not joined to room "+room))
+			return
+		}
+		if err := g.publishPresence(context.Background(), room, c.ident, "", p.Typing); err != nil {
+			c.reply(errorFrame(f.ID, errPublishFailed, err.Error()))
+			return
+		}
+		c.reply(newFrame(frameAck, f.ID, nil))
+	case frameModerate:
+		var p moderatePayload
+		if err := json.Unmarshal(f.Payload, &p); err != nil || p.Action == "" {
+			c.reply(errorFrame(f.ID, errBadRequest, "moderate requires action"))
+			return
+		}
+		room, ok := g.clientRoom(c, p.Room)
+		if !ok {
+			c.reply(errorFrame(f.ID, errNotJoined, "not joined to room "+room))
+			return
+		}
+		cm, err := g.moderate(context.Background(), room, p, c.ident)
+		if err != nil {
+			code := errPublishFailed
+			if errors.As(err, new(rejectError)) {
+				code = errRejected
+			} else {
+				log.Println("moderate:", err)
+			}
+			c.reply(errorFrame(f.ID, code, err.Error()))
+			return
+		}
+		c.reply(newFrame(frameAck, f.ID, cm))
+	default:
+		c.reply(errorFrame(f.ID, errUnknownType, "unknown frame type "+f.Type))
+	}
+}
+
+// clientRoom resolves the room a request refers to, defaulting to the
+// node's room, and reports whether the client has joined it.
+func (g *Gateway) clientRoom(c *WSClient, room string) (string, bool) {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	if room == "" {
+		room = g.room
+	}
+	return room, c.rooms[room]
 }
 
 func (g *Gateway) broadcast(cm ChatMsg) {
-	b, _ := json.Marshal(cm)
+	g.sendRoom(cm.Room, newFrame(frameMessage, "", cm))
+}
+
+// sendRoom queues a frame for every client joined to room, except clients
+// of users banned from it.
+func (g *Gateway) sendRoom(room string, b []byte) {
 	g.mu.RLock()
 	defer g.mu.RUnlock()
 	for c := range g.clients {
+		if !c.rooms[room] || c.ident != nil && g.bannedFrom(room, c.ident) {
+			continue
+		}
 		select {
 		case c.send <- b:
 		default:
@@ -164,15 +736,25 @@ func (g *Gateway) broadcast(cm ChatMsg) {
 func (g *Gateway) handleConfig(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case http.MethodGet:
+		s := sessionFrom(r)
+		ident, _ := g.identityFor(s)
 		g.mu.RLock()
 		resp := struct {
 			Nick string `json:"nick"`
 			Room string `json:"room"`
 			ID   string `json:"id"`
-		}{g.nick, g.room, g.h.ID().String()}
+			User string `json:"user,omitempty"`
+			Role string `json:"role"`
+		}{g.nick, g.room, g.h.ID().String(), "", s.role.String()}
 		g.mu.RUnlock()
+		if ident != nil {
+			resp.Nick, resp.User = ident.Nick(), ident.id
+		}
 		_ = json.NewEncoder(w).Encode(resp)
 	case http.MethodPost:
+		// the nick belongs to the caller's own identity (the node's when
+		// anonymous); changing the node's room is an admin operation
+		s := sessionFrom(r)
 		var req struct {
 			Nick string `json:"nick"`
 			Room string `json:"room"`
@@ -181,12 +763,36 @@ func (g *Gateway) handleConfig(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, "bad request", http.StatusBadRequest)
 			return
 		}
+		g.mu.RLock()
+		roomChange := req.Room != "" && req.Room != g.room
+		g.mu.RUnlock()
+		ident, err := g.identityFor(s)
+		switch {
+		case err != nil:
+			http.Error(w, "identity unavailable", http.StatusInternalServerError)
+			return
+		case roomChange && s.role < roleAdmin, req.Nick != "" && ident == nil && s.role < roleAdmin:
+			http.Error(w, "admin access required", http.StatusForbidden)
+			return
+		case req.Nick != "" && s.role < roleWrite:
+			http.Error(w, "write access required", http.StatusForbidden)
+			return
+		}
 		if req.Nick != "" {
-			g.mu.Lock()
-			g.nick = req.Nick
-			g.mu.Unlock()
+			if ident != nil {
+				if err := ident.SetNick(req.Nick); err != nil {
+					log.Println("save nick:", err)
+				}
+			} else {
+				g.mu.Lock()
+				g.nick = req.Nick
+				g.mu.Unlock()
+			}
+			for _, name := range g.roomNames() {
+				go g.publishPresence(context.Background(), name, ident, "", false)
+			}
 		}
-		if req.Room != "" && req.Room != g.room {
+		if roomChange {
 			if err := g.setRoom(req.Room); err != nil {
 				http.Error(w, "room change failed", http.StatusInternalServerError)
 				return
@@ -198,27 +804,23 @@ func (g *Gateway) handleConfig(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// setRoom changes the node's default room. Clients that were following the
+// old default room are moved along with it.
 func (g *Gateway) setRoom(r string) error {
 	g.mu.Lock()
 	defer g.mu.Unlock()
-	if g.sub != nil {
-		g.sub.Cancel()
-	}
-	if g.topic != nil {
-		g.topic.Close()
-	}
-	topic, err := g.psub.Join("room:" + r)
-	if err != nil {
+	if _, err := g.openRoom(r); err != nil {
 		return err
 	}
-	sub, err := topic.Subscribe()
-	if err != nil {
-		topic.Close()
-		return err
-	}
-	g.topic = topic
-	g.sub = sub
+	old := g.room
 	g.room = r
+	for c := range g.clients {
+		if c.rooms[old] {
+			delete(c.rooms, old)
+			c.rooms[r] = true
+		}
+	}
+	g.releaseRoom(old)
 	return nil
 }
 
@@ -237,7 +839,7 @@ func defaultNick() string {
 	return hex.EncodeToString(sum[:6])
 }
 
-func RunWebGateway(ctx context.Context, h host.Host, psub *pubsub.PubSub, topic *pubsub.Topic, sub *pubsub.Subscription, room string) {
+func RunWebGateway(ctx context.Context, cfg GatewayConfig, h host.Host, psub *pubsub.PubSub, guard *topicGuard, router routing.ContentRouting, hooks *webhookDispatcher, relays *relayManager, topic *pubsub.Topic, sub *pubsub.Subscription, room string) *Gateway {
 	webAddr := os.Getenv("WEB_ADDR")
 	if webAddr == "" {
 		webAddr = ":3000"
@@ -246,10 +848,33 @@ func RunWebGateway(ctx context.Context, h host.Host, psub *pubsub.PubSub, topic
 	if nick == "" {
 		nick = defaultNick()
 	}
-	gw := NewGateway(h, psub, topic, sub, nick, room)
+	maxFile := int64(defaultMaxFile)
+	if v, err := strconv.ParseInt(os.Getenv("MAX_FILE_SIZE"), 10, 64); err == nil && v > 0 {
+		maxFile = v
+	}
+	files := newFileStore(h, router, filepath.Join(dataDir, "files"), maxFile)
+	auth := newAuthenticator(cfg, filepath.Join(dataDir, "gateway_users.json"))
+	tlsConf, err := loadGatewayTLS(cfg.TLS, h.Peerstore().PrivKey(h.ID()), dataDir)
+	if err != nil {
+		log.Println("gateway tls:", err)
+		return nil
+	}
+	gw := NewGateway(h, psub, files, auth, topic, sub, nick, room)
+	gw.guard = guard
+	gw.mods = guard.mods
+	gw.hooks = hooks
+	gw.relays = relays
+	gw.bots = newBotRunner(gw, loadBotConfigs(cfg.Bots))
+	if mc := loadMQTTConfig(cfg.MQTT); mc.enabled() {
+		gw.mqtt = newMQTTBridge(gw, mc)
+	}
+	if ic := loadIRCConfig(cfg.IRC); ic.Listen != "" {
+		gw.irc = newIRCServer(gw, ic)
+	}
 	go func() {
-		if err := gw.Start(ctx, webAddr); err != nil {
+		if err := gw.Start(ctx, webAddr, tlsConf); err != nil && !errors.Is(err, http.ErrServerClosed) {
 			log.Println("gateway.Start:", err)
 		}
 	}()
+	return gw
 }
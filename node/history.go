@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// historyLimit is the number of messages kept per room.
+const historyLimit = 200
+
+// historyStore keeps the most recent messages of every room in memory and
+// appends them to one JSON-lines file per room so they survive restarts.
+type historyStore struct {
+	dir   string
+	mu    sync.Mutex
+	rooms map[string][]ChatMsg
+	files map[string]*os.File
+}
+
+func newHistoryStore(dir string) *historyStore {
+	return &historyStore{dir: dir, rooms: map[string][]ChatMsg{}, files: map[string]*os.File{}}
+}
+
+// safeFileName maps an arbitrary name (room, user) to a file name made of
+// safe characters, adding a short hash when characters had to be replaced.
+func safeFileName(name string) string {
+	safe := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' {
+			return r
+		}
+		return '_'
+	}, name)
+	if safe != name {
+		sum := sha256.Sum256([]byte(name))
+		safe += "-" + hex.EncodeToString(sum[:4])
+	}
+	return safe
+}
+
+// roomFile maps a room name to a file inside the history dir.
+func (hs *historyStore) roomFile(room string) string {
+	return filepath.Join(hs.dir, safeFileName(room)+".jsonl")
+}
+
+// open loads a room's history from disk, compacts the file to the last
+// historyLimit entries and keeps it open for appending. mu must be held.
+func (hs *historyStore) open(room string) []ChatMsg {
+	if msgs, ok := hs.rooms[room]; ok {
+		return msgs
+	}
+	path := hs.roomFile(room)
+	var msgs []ChatMsg
+	if f, err := os.Open(path); err == nil {
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			var cm ChatMsg
+			if json.Unmarshal(scanner.Bytes(), &cm) == nil {
+				msgs = append(msgs, cm)
+				applyMsg(msgs, cm)
+			}
+		}
+		f.Close()
+	}
+	if len(msgs) > historyLimit {
+		msgs = append([]ChatMsg(nil), msgs[len(msgs)-historyLimit:]...)
+	}
+	hs.rooms[room] = msgs
+	_ = os.MkdirAll(hs.dir, 0o755)
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return msgs
+	}
+	w := bufio.NewWriter(f)
+	for _, cm := range msgs {
+		b, _ := json.Marshal(cm)
+		w.Write(append(b, '\n'))
+	}
+	_ = w.Flush()
+	hs.files[room] = f
+	return msgs
+}
+
+// Add records a message for room.
+func (hs *historyStore) Add(room string, cm ChatMsg) {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	msgs := append(hs.open(room), cm)
+	applyMsg(msgs, cm)
+	if len(msgs) > historyLimit {
+		msgs = msgs[len(msgs)-historyLimit:]
+	}
+	hs.rooms[room] = msgs
+	if f := hs.files[room]; f != nil {
+		b, _ := json.Marshal(cm)
+		_, _ = f.Write(append(b, '\n'))
+	}
+}
+
+// Find looks up a message in room by its message ID.
+func (hs *historyStore) Find(room, msgID string) (ChatMsg, bool) {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	msgs := hs.open(room)
+	for i := len(msgs) - 1; i >= 0; i-- {
+		if msgs[i].MsgID == msgID {
+			return msgs[i], true
+		}
+	}
+	return ChatMsg{}, false
+}
+
+// Recent returns up to n of the latest messages for room, oldest first.
+func (hs *historyStore) Recent(room string, n int) []ChatMsg {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	msgs := hs.open(room)
+	if n <= 0 || n > len(msgs) {
+		n = len(msgs)
+	}
+	return append([]ChatMsg(nil), msgs[len(msgs)-n:]...)
+}
+
+// Close syncs and closes all open history files.
+func (hs *historyStore) Close() error {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	var firstErr error
+	for room, f := range hs.files {
+		if err := f.Sync(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		if err := f.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		delete(hs.files, room)
+	}
+	return firstErr
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+var (
+	errBadUser = errors.New("invalid user identity")
+	errBadSig  = errors.New("invalid user signature")
+)
+
+// userIdentity is the chat identity of one gateway user: their own nick,
+// status and an Ed25519 key that signs their messages. Keys are generated
+// and kept server-side in the data dir, so a user keeps the same identity
+// across browsers and sessions on this node.
+type userIdentity struct {
+	name string // identityStore key, e.g. "user:alice" or "bot:echo"
+	id   string // public key in PeerID encoding, sent as ChatMsg.User
+	key  crypto.PrivKey
+	path string
+
+	mu     sync.Mutex
+	nick   string
+	status string
+}
+
+type userProfile struct {
+	Nick string `json:"nick"`
+	Key  []byte `json:"key"`
+}
+
+// identityStore loads or creates identities on first use.
+type identityStore struct {
+	dir   string
+	mu    sync.Mutex
+	users map[string]*userIdentity
+}
+
+func newIdentityStore(dir string) *identityStore {
+	return &identityStore{dir: dir, users: map[string]*userIdentity{}}
+}
+
+// get returns the identity of a gateway user, creating it on first use.
+func (s *identityStore) get(name string) (*userIdentity, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if u, ok := s.users[name]; ok {
+		return u, nil
+	}
+	path := filepath.Join(s.dir, safeFileName(name)+".json")
+	migrateIdentity(s.dir, name, path)
+	var prof userProfile
+	if b, err := os.ReadFile(path); err == nil {
+		if err := json.Unmarshal(b, &prof); err != nil {
+			return nil, err
+		}
+	}
+	var key crypto.PrivKey
+	var err error
+	if len(prof.Key) > 0 {
+		key, err = crypto.UnmarshalPrivateKey(prof.Key)
+	} else {
+		key, _, err = crypto.GenerateEd25519Key(rand.Reader)
+	}
+	if err != nil {
+		return nil, err
+	}
+	id, err := peer.IDFromPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if prof.Nick == "" {
+		prof.Nick = identityNick(name)
+	}
+	u := &userIdentity{name: name, id: id.String(), key: key, path: path, nick: prof.Nick, status: statusOnline}
+	if len(prof.Key) == 0 {
+		if err := u.save(); err != nil {
+			return nil, err
+		}
+	}
+	s.users[name] = u
+	return u, nil
+}
+
+// identityNick is the nick of a new identity: the account or token name for
+// gateway users, the full name for bots, bridges and the node.
+func identityNick(name string) string {
+	for _, kind := range []string{kindUser, kindToken} {
+		if bare, ok := strings.CutPrefix(name, kind+":"); ok {
+			return bare
+		}
+	}
+	return name
+}
+
+// migrateIdentity moves the profile of a local user saved before identities
+// were prefixed by kind to its "user:" name, so the user keeps their key.
+func migrateIdentity(dir, name, path string) {
+	bare, ok := strings.CutPrefix(name, kindUser+":")
+	if !ok || strings.Contains(bare, ":") {
+		return
+	}
+	if _, err := os.Stat(path); err == nil {
+		return
+	}
+	_ = os.Rename(filepath.Join(dir, safeFileName(bare)+".json"), path)
+}
+
+// save persists the profile. u.mu must not be held by the caller.
+func (u *userIdentity) save() error {
+	raw, err := crypto.MarshalPrivateKey(u.key)
+	if err != nil {
+		return err
+	}
+	u.mu.Lock()
+	b, _ := json.Marshal(userProfile{Nick: u.nick, Key: raw})
+	u.mu.Unlock()
+	if err := os.MkdirAll(filepath.Dir(u.path), 0o700); err != nil {
+		return err
+	}
+	tmp := u.path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, u.path)
+}
+
+func (u *userIdentity) Nick() string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.nick
+}
+
+func (u *userIdentity) SetNick(nick string) error {
+	u.mu.Lock()
+	u.nick = nick
+	u.mu.Unlock()
+	return u.save()
+}
+
+func (u *userIdentity) Status() string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.status
+}
+
+func (u *userIdentity) SetStatus(status string) {
+	u.mu.Lock()
+	u.status = status
+	u.mu.Unlock()
+}
+
+// signedFields is the part of a ChatMsg covered by a user signature. The
+// node PeerID and room are included so a message cannot be replayed through
+// another node or into another room.
+type signedFields struct {
+	User       string      `json:"user"`
+	Node       string      `json:"node"`
+	Room       string      `json:"room"`
+	MsgID      string      `json:"msg_id"`
+	From       string      `json:"from"`
+	Text       string      `json:"text"`
+	Ts         int64       `json:"ts"`
+	Kind       string      `json:"kind"`
+	Ref        string      `json:"ref"`
+	Remove     bool        `json:"remove"`
+	Attachment *Attachment `json:"attachment"`
+	Mod        *ModAction  `json:"mod,omitempty"` // omitted so older signatures still verify
+}
+
+func signingBytes(cm ChatMsg) []byte {
+	b, _ := json.Marshal(signedFields{
+		User: cm.User, Node: cm.ID, Room: cm.Room, MsgID: cm.MsgID, From: cm.From,
+		Text: cm.Text, Ts: cm.Ts, Kind: cm.Kind, Ref: cm.Ref, Remove: cm.Remove,
+		Attachment: cm.Attachment, Mod: cm.Mod,
+	})
+	return b
+}
+
+// sign stamps cm with the user's identity and signature.
+func (u *userIdentity) sign(cm *ChatMsg) error {
+	cm.User = u.id
+	sig, err := u.key.Sign(signingBytes(*cm))
+	if err != nil {
+		return err
+	}
+	cm.Sig = sig
+	return nil
+}
+
+// verifyMsg checks the user signature of cm, if it carries a user identity.
+// Messages without one are authored by the node itself, which the pubsub
+// signature already proves.
+func verifyMsg(cm ChatMsg) error {
+	if cm.User == "" {
+		if len(cm.Sig) > 0 {
+			return errBadSig
+		}
+		return nil
+	}
+	id, err := peer.Decode(cm.User)
+	if err != nil {
+		return errBadUser
+	}
+	pub, err := id.ExtractPublicKey()
+	if err != nil {
+		return errBadUser
+	}
+	ok, err := pub.Verify(signingBytes(cm), cm.Sig)
+	if err != nil || !ok {
+		return errBadSig
+	}
+	return nil
+}
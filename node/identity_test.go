@@ -0,0 +1,122 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestIdentityStore(t *testing.T) {
+	dir := t.TempDir()
+	store := newIdentityStore(dir)
+	alice, err := store.get("user:alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if alice.Nick() != "alice" {
+		t.Errorf("default nick = %q, want %q", alice.Nick(), "alice")
+	}
+	if err := alice.SetNick("Alice"); err != nil {
+		t.Fatal(err)
+	}
+	if same, _ := store.get("user:alice"); same != alice {
+		t.Error("second get returned another identity")
+	}
+	if bob, err := store.get("user:bob"); err != nil || bob.id == alice.id {
+		t.Errorf("bob shares alice's key (err %v)", err)
+	}
+	if token, err := store.get("token:alice"); err != nil || token.id == alice.id || token.Nick() != "alice" {
+		t.Errorf("token:alice shares user alice's key or has nick %q (err %v)", token.Nick(), err)
+	}
+
+	// a restart loads the same key and nick
+	again, err := newIdentityStore(dir).get("user:alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.id != alice.id || again.Nick() != "Alice" {
+		t.Errorf("reloaded %s %q, want %s %q", again.id, again.Nick(), alice.id, "Alice")
+	}
+}
+
+func TestMigrateIdentity(t *testing.T) {
+	legacy, err := newIdentityStore(t.TempDir()).get("bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	if err := os.Rename(legacy.path, filepath.Join(dir, safeFileName("bob")+".json")); err != nil {
+		t.Fatal(err)
+	}
+
+	store := newIdentityStore(dir)
+	u, err := store.get("user:bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.id != legacy.id {
+		t.Errorf("user:bob got a new key, want the legacy one")
+	}
+	if tok, err := store.get("token:bob"); err != nil || tok.id == legacy.id {
+		t.Errorf("token:bob took the legacy key (err %v)", err)
+	}
+}
+
+func TestIdentityNick(t *testing.T) {
+	tests := []struct{ name, want string }{
+		{"user:alice", "alice"},
+		{"token:ci", "ci"},
+		{"bot:echo", "bot:echo"},
+		{"node", "node"},
+	}
+	for _, tt := range tests {
+		if got := identityNick(tt.name); got != tt.want {
+			t.Errorf("identityNick(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestVerifyMsg(t *testing.T) {
+	store := newIdentityStore(t.TempDir())
+	u, err := store.get("user:alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := store.get("user:bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := func(edit func(*ChatMsg)) ChatMsg {
+		cm := ChatMsg{From: "a", ID: "node", Room: "lobby", MsgID: newMsgID(), Text: "hi", Ts: 1}
+		if err := u.sign(&cm); err != nil {
+			t.Fatal(err)
+		}
+		if edit != nil {
+			edit(&cm)
+		}
+		return cm
+	}
+
+	tests := []struct {
+		name string
+		cm   ChatMsg
+		want error
+	}{
+		{"signed", signed(nil), nil},
+		{"node message", ChatMsg{From: "node", Text: "hi"}, nil},
+		{"signature without user", ChatMsg{From: "node", Sig: []byte{1}}, errBadSig},
+		{"edited text", signed(func(cm *ChatMsg) { cm.Text = "bye" }), errBadSig},
+		{"other room", signed(func(cm *ChatMsg) { cm.Room = "other" }), errBadSig},
+		{"other node", signed(func(cm *ChatMsg) { cm.ID = "elsewhere" }), errBadSig},
+		{"claimed by another user", signed(func(cm *ChatMsg) { cm.User = other.id }), errBadSig},
+		{"malformed user", signed(func(cm *ChatMsg) { cm.User = "nobody" }), errBadUser},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := verifyMsg(tt.cm); !errors.Is(err, tt.want) {
+				t.Errorf("verifyMsg = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,715 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+const (
+	defaultIRCName = "mesh"
+	ircWriteWait   = 10 * time.Second
+	ircMaxLine     = 8 << 10 // generous; clients send at most 512 bytes
+)
+
+// IRCConfig runs a minimal IRC server in front of the gateway. Channel
+// "#name" is room "name" and a client's nick is the From of its messages.
+type IRCConfig struct {
+	Listen string `yaml:"listen"` // e.g. 127.0.0.1:6667
+	Name   string `yaml:"name"`   // server name shown to clients
+}
+
+// loadIRCConfig applies IRC_LISTEN and IRC_NAME over cfg.
+func loadIRCConfig(cfg IRCConfig) IRCConfig {
+	cfg.Listen = firstNonEmpty(os.Getenv("IRC_LISTEN"), cfg.Listen)
+	cfg.Name = firstNonEmpty(os.Getenv("IRC_NAME"), cfg.Name, defaultIRCName)
+	return cfg
+}
+
+// ircServer accepts IRC connections. Each registered connection is an
+// in-process gateway client, so it publishes and receives through the same
+// path as websocket clients.
+type ircServer struct {
+	g     *Gateway
+	cfg   IRCConfig
+	mu    sync.Mutex
+	conns map[*ircConn]bool
+}
+
+func newIRCServer(g *Gateway, cfg IRCConfig) *ircServer {
+	return &ircServer{g: g, cfg: cfg, conns: map[*ircConn]bool{}}
+}
+
+// Start listens and serves until the gateway shuts down.
+func (s *ircServer) Start(ctx context.Context) error {
+	ln, err := net.Listen("tcp", s.cfg.Listen)
+	if err != nil {
+		return err
+	}
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-s.g.quit:
+		}
+		_ = ln.Close()
+		s.mu.Lock()
+		for c := range s.conns {
+			c.send("ERROR :Closing link: node shutting down")
+			_ = c.conn.Close()
+		}
+		s.mu.Unlock()
+	}()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				if !errors.Is(err, net.ErrClosed) {
+					log.Println("irc accept:", err)
+				}
+				return
+			}
+			c := &ircConn{s: s, conn: conn, host: "mesh"}
+			s.mu.Lock()
+			s.conns[c] = true
+			s.mu.Unlock()
+			go c.serve(ctx)
+		}
+	}()
+	if !s.g.auth.enabled() {
+		log.Println("⚠️  IRC server accepts any client: gateway authentication is disabled")
+	}
+	log.Println("💬 IRC server on", s.cfg.Listen)
+	return nil
+}
+
+// nickInUse reports whether another connection registered nick.
+func (s *ircServer) nickInUse(nick string, self *ircConn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for c := range s.conns {
+		if c != self && strings.EqualFold(c.currentNick(), nick) {
+			return true
+		}
+	}
+	return false
+}
+
+// ircConn is one IRC client. Until NICK and USER arrive it is unregistered
+// and has no gateway client.
+type ircConn struct {
+	s    *ircServer
+	conn net.Conn
+	host string
+	wmu  sync.Mutex
+
+	mu      sync.Mutex
+	nick    string
+	user    string
+	pass    string
+	session string // gateway session opened by PASS, ended on disconnect
+	ident   *userIdentity
+	role    role
+	client  *WSClient
+	members map[string]map[string]rosterEntry // room -> last roster, for JOIN/PART/NICK lines
+}
+
+func (c *ircConn) currentNick() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.nick
+}
+
+// send writes one line to the client.
+func (c *ircConn) send(line string) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	_ = c.conn.SetWriteDeadline(time.Now().Add(ircWriteWait))
+	_, _ = c.conn.Write([]byte(line + "\r\n"))
+}
+
+// reply sends a numeric reply addressed to the client.
+func (c *ircConn) reply(code, text string) {
+	nick := c.currentNick()
+	if nick == "" {
+		nick = "*"
+	}
+	c.send(fmt.Sprintf(":%s %s %s %s", c.s.cfg.Name, code, nick, text))
+}
+
+// prefix is the client's own source, nick!user@host.
+func (c *ircConn) prefix() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.nick + "!" + c.user + "@" + c.host
+}
+
+func (c *ircConn) serve(ctx context.Context) {
+	defer func() {
+		c.s.mu.Lock()
+		delete(c.s.conns, c)
+		c.s.mu.Unlock()
+		c.mu.Lock()
+		client, session := c.client, c.session
+		c.mu.Unlock()
+		if client != nil {
+			c.s.g.dropClient(client)
+		}
+		if session != "" {
+			c.s.g.auth.end(session)
+		}
+		_ = c.conn.Close()
+	}()
+	sc := bufio.NewScanner(c.conn)
+	sc.Buffer(make([]byte, 512), ircMaxLine)
+	for sc.Scan() {
+		cmd, params := parseIRCLine(sc.Text())
+		if cmd == "" {
+			continue
+		}
+		if !c.handle(ctx, cmd, params) {
+			return
+		}
+	}
+}
+
+// parseIRCLine splits a line into its upper-cased command and parameters,
+// dropping any source prefix.
+func parseIRCLine(line string) (string, []string) {
+	line = strings.TrimRight(line, "\r")
+	if strings.HasPrefix(line, ":") {
+		_, line, _ = strings.Cut(line, " ")
+	}
+	var params []string
+	for {
+		line = strings.TrimLeft(line, " ")
+		if line == "" {
+			break
+		}
+		if line[0] == ':' {
+			params = append(params, line[1:])
+			break
+		}
+		p, rest, _ := strings.Cut(line, " ")
+		params = append(params, p)
+		line = rest
+	}
+	if len(params) == 0 {
+		return "", nil
+	}
+	return strings.ToUpper(params[0]), params[1:]
+}
+
+// handle runs one command and reports whether the connection stays open.
+func (c *ircConn) handle(ctx context.Context, cmd string, params []string) bool {
+	c.mu.Lock()
+	registered := c.client != nil
+	c.mu.Unlock()
+	switch cmd {
+	case "CAP":
+		if len(params) > 0 && strings.EqualFold(params[0], "LS") {
+			c.send(":" + c.s.cfg.Name + " CAP * LS :")
+		}
+		return true
+	case "PING":
+		c.send(":" + c.s.cfg.Name + " PONG " + c.s.cfg.Name + " :" + strings.Join(params, " "))
+		return true
+	case "PONG":
+		return true
+	case "QUIT":
+		c.send("ERROR :Closing link")
+		return false
+	case "PASS":
+		if registered {
+			c.reply("462", ":You may not reregister")
+		} else if len(params) > 0 {
+			c.mu.Lock()
+			c.pass = params[0]
+			c.mu.Unlock()
+		}
+		return true
+	case "NICK":
+		if len(params) == 0 || params[0] == "" {
+			c.reply("431", ":No nickname given")
+			return true
+		}
+		return c.setNick(ctx, params[0])
+	case "USER":
+		if registered {
+			c.reply("462", ":You may not reregister")
+			return true
+		}
+		if len(params) < 4 {
+			c.reply("461", "USER :Not enough parameters")
+			return true
+		}
+		c.mu.Lock()
+		c.user = ircName(params[0])
+		c.mu.Unlock()
+		return c.register(ctx)
+	}
+	if !registered {
+		c.reply("451", ":You have not registered")
+		return true
+	}
+	switch cmd {
+	case "JOIN":
+		if len(params) == 0 {
+			c.reply("461", "JOIN :Not enough parameters")
+			return true
+		}
+		for _, ch := range strings.Split(params[0], ",") {
+			c.join(ctx, ch)
+		}
+	case "PART":
+		if len(params) == 0 {
+			c.reply("461", "PART :Not enough parameters")
+			return true
+		}
+		for _, ch := range strings.Split(params[0], ",") {
+			c.part(ch)
+		}
+	case "PRIVMSG", "NOTICE":
+		if len(params) < 2 {
+			c.reply("412", ":No text to send")
+			return true
+		}
+		c.privmsg(ctx, cmd, params[0], params[1])
+	case "NAMES":
+		if len(params) == 0 {
+			c.reply("366", "* :End of /NAMES list")
+			return true
+		}
+		for _, ch := range strings.Split(params[0], ",") {
+			c.names(ch)
+		}
+	case "WHO":
+		if len(params) == 0 {
+			c.reply("315", "* :End of /WHO list")
+			return true
+		}
+		c.who(params[0])
+	default:
+		c.reply("421", cmd+" :Unknown command")
+	}
+	return true
+}
+
+// setNick records the nick before registration, or renames the
+// connection's identity afterwards.
+func (c *ircConn) setNick(ctx context.Context, nick string) bool {
+	if !validIRCNick(nick) {
+		c.reply("432", nick+" :Erroneous nickname")
+		return true
+	}
+	if c.s.nickInUse(nick, c) {
+		c.reply("433", nick+" :Nickname is already in use")
+		return true
+	}
+	c.mu.Lock()
+	ident, client, r := c.ident, c.client, c.role
+	if client == nil {
+		c.nick = nick
+		c.mu.Unlock()
+		return c.register(ctx)
+	}
+	c.mu.Unlock()
+	if r < roleWrite {
+		c.reply("484", ":Your connection is restricted: write access required")
+		return true
+	}
+	if err := ident.SetNick(nick); err != nil {
+		log.Println("irc nick:", err)
+	}
+	prefix := c.prefix()
+	c.mu.Lock()
+	c.nick = nick
+	c.mu.Unlock()
+	c.send(":" + prefix + " NICK :" + nick)
+	g := c.s.g
+	g.mu.RLock()
+	rooms := make([]string, 0, len(client.rooms))
+	for room := range client.rooms {
+		rooms = append(rooms, room)
+	}
+	g.mu.RUnlock()
+	for _, room := range rooms {
+		go g.publishPresence(ctx, room, ident, "", false)
+	}
+	return true
+}
+
+// register completes login once both NICK and USER are known. With gateway
+// authentication enabled, PASS must be "user:password" or an access token;
+// the connection then acts as that user. Otherwise each nick gets an
+// identity of its own.
+func (c *ircConn) register(ctx context.Context) bool {
+	c.mu.Lock()
+	nick, user, pass := c.nick, c.user, c.pass
+	c.mu.Unlock()
+	if nick == "" || user == "" {
+		return true
+	}
+	g := c.s.g
+	name, r := "irc:"+strings.ToLower(nick), roleAdmin
+	if g.auth.enabled() {
+		var s *session
+		var err error
+		if u, pw, ok := strings.Cut(pass, ":"); ok {
+			s, err = g.auth.login(u, pw, "")
+		} else {
+			s, err = g.auth.login("", "", pass)
+		}
+		if err != nil {
+			c.reply("464", ":Password incorrect")
+			c.send("ERROR :Closing link: authentication failed")
+			return false
+		}
+		name, r = s.identity(), s.role
+		c.mu.Lock()
+		c.session = s.id
+		c.mu.Unlock()
+	}
+	ident, err := g.idents.get(name)
+	if err != nil {
+		log.Println("irc identity:", err)
+		c.send("ERROR :Closing link: identity unavailable")
+		return false
+	}
+	if ident.Nick() != nick && r >= roleWrite {
+		if err := ident.SetNick(nick); err != nil {
+			log.Println("irc nick:", err)
+		}
+	}
+	client, err := g.attach(ctx, ident, r, nil)
+	if err != nil {
+		c.send("ERROR :Closing link: " + err.Error())
+		return false
+	}
+	c.mu.Lock()
+	c.ident, c.role, c.client = ident, r, client
+	c.members = map[string]map[string]rosterEntry{}
+	c.mu.Unlock()
+	go c.pump(client)
+
+	srv := c.s.cfg.Name
+	c.reply("001", ":Welcome to the mesh, "+c.prefix())
+	c.reply("002", ":Your host is "+srv)
+	c.reply("003", ":This server was created "+g.started.Format(time.RFC1123))
+	c.reply("004", srv+" p2p-mesh o o")
+	c.reply("005", "CHANTYPES=# NICKLEN=32 :are supported by this server")
+	c.reply("422", ":Channels are mesh rooms; try JOIN #"+g.room)
+	return true
+}
+
+func (c *ircConn) join(ctx context.Context, ch string) {
+	room, ok := channelRoom(ch)
+	if !ok {
+		c.reply("403", ch+" :No such channel")
+		return
+	}
+	g := c.s.g
+	c.mu.Lock()
+	client, ident := c.client, c.ident
+	c.mu.Unlock()
+	g.mu.RLock()
+	already := client.rooms[room]
+	g.mu.RUnlock()
+	if already {
+		return
+	}
+	if g.bannedFrom(room, ident) {
+		c.reply("474", ch+" :Cannot join channel (you are banned)")
+		return
+	}
+	if _, err := g.joinRoom(client, room); err != nil {
+		c.reply("403", ch+" :Cannot join: "+err.Error())
+		return
+	}
+	c.mu.Lock()
+	seen := map[string]rosterEntry{}
+	for _, m := range g.presence(room).Members {
+		if m.Status != statusOffline && m.User != ident.id {
+			seen[m.Peer+"/"+m.User] = m
+		}
+	}
+	c.members[room] = seen
+	c.mu.Unlock()
+	go g.publishPresence(ctx, room, ident, "", false)
+	c.send(":" + c.prefix() + " JOIN " + ch)
+	c.reply("331", ch+" :No topic is set")
+	c.names(ch)
+}
+
+func (c *ircConn) part(ch string) {
+	room, ok := channelRoom(ch)
+	if !ok {
+		c.reply("403", ch+" :No such channel")
+		return
+	}
+	g := c.s.g
+	c.mu.Lock()
+	client, ident := c.client, c.ident
+	delete(c.members, room)
+	c.mu.Unlock()
+	g.mu.Lock()
+	joined := client.rooms[room]
+	delete(client.rooms, room)
+	g.mu.Unlock()
+	if !joined {
+		c.reply("442", ch+" :You're not on that channel")
+		return
+	}
+	g.userLeft(ident, room)
+	g.mu.Lock()
+	g.releaseRoom(room)
+	g.mu.Unlock()
+	c.send(":" + c.prefix() + " PART " + ch)
+}
+
+// privmsg publishes channel text to its room. There are no private
+// messages: mesh rooms have no direct-message equivalent.
+func (c *ircConn) privmsg(ctx context.Context, cmd, target, text string) {
+	room, ok := channelRoom(target)
+	if !ok {
+		if cmd == "PRIVMSG" {
+			c.reply("401", target+" :No such channel; private messages are not supported")
+		}
+		return
+	}
+	c.mu.Lock()
+	client, ident, r := c.client, c.ident, c.role
+	c.mu.Unlock()
+	g := c.s.g
+	if _, joined := g.clientRoom(client, room); !joined || r < roleWrite {
+		c.reply("404", target+" :Cannot send to channel")
+		return
+	}
+	if action, ok := strings.CutPrefix(text, "\x01ACTION "); ok {
+		text = "* " + ident.Nick() + " " + strings.TrimSuffix(action, "\x01")
+	}
+	if _, err := g.publish(ctx, room, ChatMsg{Text: text}, ident); err != nil {
+		if !errors.As(err, new(rejectError)) {
+			log.Println("topic.Publish:", err)
+		}
+		c.reply("404", target+" :Cannot send to channel: "+err.Error())
+	}
+}
+
+// names lists the members of a room that are online or away.
+func (c *ircConn) names(ch string) {
+	room, ok := channelRoom(ch)
+	if !ok {
+		c.reply("366", ch+" :End of /NAMES list")
+		return
+	}
+	var nicks []string
+	for _, m := range c.s.g.presence(room).Members {
+		if m.Status != statusOffline {
+			nicks = append(nicks, ircName(m.Nick))
+		}
+	}
+	sort.Strings(nicks)
+	for len(nicks) > 0 {
+		n := min(len(nicks), 20)
+		c.reply("353", "= "+ch+" :"+strings.Join(nicks[:n], " "))
+		nicks = nicks[n:]
+	}
+	c.reply("366", ch+" :End of /NAMES list")
+}
+
+// who describes each member of a room, with user and host as in
+// ircSource.
+func (c *ircConn) who(ch string) {
+	if room, ok := channelRoom(ch); ok {
+		for _, m := range c.s.g.presence(room).Members {
+			if m.Status == statusOffline {
+				continue
+			}
+			user, here := m.User, "H"
+			if user == "" {
+				user = m.Peer
+			}
+			if m.Status == statusAway {
+				here = "G"
+			}
+			c.reply("352", fmt.Sprintf("%s %s %s %s %s %s :0 %s", ch, shortID(user), shortID(m.Peer), c.s.cfg.Name, ircName(m.Nick), here, m.Nick))
+		}
+	}
+	c.reply("315", ch+" :End of /WHO list")
+}
+
+// pump turns the client's frames into PRIVMSG, JOIN and PART lines.
+func (c *ircConn) pump(client *WSClient) {
+	for b := range client.send {
+		f := parseFrame(b)
+		switch f.Type {
+		case frameMessage:
+			var cm ChatMsg
+			if err := json.Unmarshal(f.Payload, &cm); err == nil {
+				c.deliver(cm)
+			}
+		case framePresence:
+			var p presencePayload
+			if err := json.Unmarshal(f.Payload, &p); err == nil {
+				c.roster(p)
+			}
+		case frameModerate:
+			var ev moderationEvent
+			if err := json.Unmarshal(f.Payload, &ev); err == nil {
+				c.moderated(ev)
+			}
+		}
+	}
+}
+
+// deliver relays a room message. The connection's own messages are not
+// echoed, as IRC clients display what they send themselves.
+func (c *ircConn) deliver(cm ChatMsg) {
+	c.mu.Lock()
+	own := c.ident != nil && cm.User == c.ident.id
+	c.mu.Unlock()
+	if own || cm.Deleted {
+		return
+	}
+	text := cm.Text
+	switch cm.Kind {
+	case kindText, kindReply:
+	case kindEdit:
+		text = "(edit) " + text
+	default:
+		return // deletes and reactions have no IRC form
+	}
+	src := ircSource(cm.From, cm.User, cm.ID)
+	for _, line := range ircLines(text) {
+		c.send(":" + src + " PRIVMSG #" + cm.Room + " :" + line)
+	}
+}
+
+// ircLines splits mesh text into IRC message lines. CR and LF both end a
+// line, as many clients treat a bare CR as one; other control characters
+// are dropped and tabs become spaces. Empty lines are left out.
+func ircLines(text string) []string {
+	var out []string
+	for _, line := range strings.FieldsFunc(text, func(r rune) bool { return r == '\r' || r == '\n' }) {
+		line = strings.Map(func(r rune) rune {
+			switch {
+			case r == '\t':
+				return ' '
+			case unicode.IsControl(r):
+				return -1
+			}
+			return r
+		}, line)
+		if strings.TrimSpace(line) != "" {
+			out = append(out, line)
+		}
+	}
+	return out
+}
+
+// moderated tells the client it was kicked or banned from a channel; the
+// gateway has already taken the room away from it.
+func (c *ircConn) moderated(ev moderationEvent) {
+	if ev.Action != modKick && ev.Action != modBan {
+		return
+	}
+	c.mu.Lock()
+	self := ev.Target == c.ident.id || ev.Target == c.s.g.h.ID().String()
+	if self {
+		delete(c.members, ev.Room)
+	}
+	nick := c.nick
+	c.mu.Unlock()
+	if self {
+		reason := strings.Join(ircLines(ev.Reason), " ")
+		c.send(":" + ircSource(ev.Nick, ev.Actor, ev.Actor) + " KICK #" + ev.Room + " " + nick + " :" + firstNonEmpty(reason, ev.Action))
+	}
+}
+
+// roster turns changes to a room's roster into JOIN, PART and NICK lines,
+// ignoring the connection's own identity.
+func (c *ircConn) roster(p presencePayload) {
+	c.mu.Lock()
+	prev, ok := c.members[p.Room]
+	if !ok {
+		c.mu.Unlock()
+		return
+	}
+	own := c.ident.id
+	next := map[string]rosterEntry{}
+	for _, m := range p.Members {
+		if m.Status != statusOffline && m.User != own {
+			next[m.Peer+"/"+m.User] = m
+		}
+	}
+	c.members[p.Room] = next
+	c.mu.Unlock()
+	ch := "#" + p.Room
+	for key, m := range next {
+		was, had := prev[key]
+		switch {
+		case !had:
+			c.send(":" + ircSource(m.Nick, m.User, m.Peer) + " JOIN " + ch)
+		case was.Nick != m.Nick:
+			c.send(":" + ircSource(was.Nick, m.User, m.Peer) + " NICK :" + ircName(m.Nick))
+		}
+	}
+	for key, m := range prev {
+		if _, has := next[key]; !has {
+			c.send(":" + ircSource(m.Nick, m.User, m.Peer) + " PART " + ch)
+		}
+	}
+}
+
+// channelRoom maps "#room" to its room.
+func channelRoom(ch string) (string, bool) {
+	room, ok := strings.CutPrefix(ch, "#")
+	return room, ok && room != ""
+}
+
+// validIRCNick accepts nicks that survive the IRC line format.
+func validIRCNick(nick string) bool {
+	return len(nick) <= 32 && nick != "" && !strings.ContainsAny(nick, " ,*?!@:#\x00\r\n") && nick[0] != '$'
+}
+
+// ircName makes a mesh nick usable as an IRC nick or user.
+func ircName(s string) string {
+	s = strings.Map(func(r rune) rune {
+		if strings.ContainsRune(" ,*?!@:\x00\r\n", r) {
+			return '_'
+		}
+		return r
+	}, s)
+	if s == "" {
+		return "_"
+	}
+	return s
+}
+
+// ircSource is the nick!user@host source of a mesh member: the user part
+// is the gateway user, or the node for its own messages, and the host the
+// peer.
+func ircSource(nick, user, peer string) string {
+	if user == "" {
+		user = peer
+	}
+	return ircName(nick) + "!" + shortID(user) + "@" + shortID(peer)
+}
+
+// shortID shortens a peer or user ID for display.
+func shortID(id string) string {
+	if len(id) > 12 {
+		return id[len(id)-12:]
+	}
+	return id
+}
@@ -6,12 +6,14 @@ import (
 	"crypto/ed25519"
 	"crypto/rand"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
@@ -22,6 +24,7 @@ import (
 	"github.com/libp2p/go-libp2p/core/network"
 	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/libp2p/go-libp2p/core/peerstore"
+	"github.com/libp2p/go-libp2p/core/protocol"
 	"github.com/libp2p/go-libp2p/p2p/discovery/mdns"
 	routingdisc "github.com/libp2p/go-libp2p/p2p/discovery/routing"
 	"github.com/libp2p/go-libp2p/p2p/host/autonat"
@@ -29,6 +32,7 @@ import (
 	rcmgr "github.com/libp2p/go-libp2p/p2p/host/resource-manager"
 	"github.com/libp2p/go-libp2p/p2p/muxer/yamux"
 	clientv2 "github.com/libp2p/go-libp2p/p2p/protocol/circuitv2/client"
+	relayproto "github.com/libp2p/go-libp2p/p2p/protocol/circuitv2/proto"
 	quic "github.com/libp2p/go-libp2p/p2p/transport/quic"
 	tcp "github.com/libp2p/go-libp2p/p2p/transport/tcp"
 
@@ -39,11 +43,17 @@ import (
 
 	cid "github.com/ipfs/go-cid"
 	mh "github.com/multiformats/go-multihash"
+	"github.com/multiformats/go-multistream"
 
 	"github.com/joho/godotenv"
 )
 
-const keyFile = "/data/peerkey.bin"
+const (
+	dataDir = "/data"
+	keyFile = dataDir + "/peerkey.bin"
+
+	relayAuthProtocol = "/mesh/relay-auth/1.0.0"
+)
 
 var bootstrapCID = func() cid.Cid {
 	h, _ := mh.Sum([]byte("mesh-bootstrap"), mh.SHA2_256, -1)
@@ -115,7 +125,18 @@ func main() {
 			relayAddrs = append(relayAddrs, maddr)
 		}
 	}
-	relayCh := make(chan ma.Multiaddr, 16)
+	// tokens signed by private relays, presented before reserving
+	var relayTokens []string
+	for _, t := range strings.Split(firstNonEmpty(os.Getenv("RELAY_TOKEN"), cfg.RelayToken), ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			relayTokens = append(relayTokens, t)
+		}
+	}
+	relayCh := make(chan []byte, 16)
+	relayCount, _ := strconv.Atoi(os.Getenv("RELAY_COUNT"))
+	if relayCount <= 0 {
+		relayCount = cfg.RelayCount
+	}
 	enableRelayClient := getenvBool("ENABLE_RELAY_CLIENT", cfg.EnableRelayClient)
 	enableHP := getenvBool("ENABLE_HOLEPUNCH", cfg.EnableHolePunch)
 	enableUPnP := getenvBool("ENABLE_UPNP", cfg.EnableUPnP)
@@ -211,22 +232,36 @@ func main() {
 	if enableHP {
 		opts = append(opts, libp2p.EnableHolePunching())
 	}
-	if len(announceAddrs) > 0 {
-		opts = append(opts, libp2p.AddrsFactory(func(addrs []ma.Multiaddr) []ma.Multiaddr {
-			return append(addrs, announceAddrs...)
-		}))
-	}
+	relays := newRelayManager(relayAddrs, relayTokens, relayCount, peerDB, relayCh)
+	opts = append(opts, libp2p.AddrsFactory(func(addrs []ma.Multiaddr) []ma.Multiaddr {
+		addrs = append(addrs, announceAddrs...)
+		return append(addrs, relays.circuitAddrs()...)
+	}))
 
 	h, err := libp2p.New(opts...)
 	must(err)
 	defer h.Close()
 
+	hooks := newWebhookDispatcher(loadWebhooks(cfg.Webhooks), filepath.Join(dataDir, "webhooks"), h.ID())
+	hooks.Start(ctx)
+
 	h.Network().Notify(&network.NotifyBundle{
 		ConnectedF: func(net network.Network, conn network.Conn) {
 			peerDB.Add(conn.RemoteMultiaddr(), conn.RemotePeer())
+			if len(net.ConnsToPeer(conn.RemotePeer())) == 1 {
+				hooks.Emit(webhookEvent{Type: eventPeerJoined, Peer: conn.RemotePeer().String(), Addr: conn.RemoteMultiaddr().String()})
+			}
 		},
 		DisconnectedF: func(net network.Network, conn network.Conn) {
 			go reconnectOnDisconnect(ctx, h, conn.RemotePeer())
+			if net.Connectedness(conn.RemotePeer()) != network.Connected {
+				ev := webhookEvent{Type: eventPeerLeft, Peer: conn.RemotePeer().String(), Addr: conn.RemoteMultiaddr().String()}
+				hooks.Emit(ev)
+				if isRelayPeer(h, conn.RemotePeer()) {
+					ev.Type = eventRelayLost
+					hooks.Emit(ev)
+				}
+			}
 		},
 	})
 
@@ -240,11 +275,11 @@ func main() {
 
 	// mDNS for LAN
 	ser := mdns.NewMdnsService(h, room, &mdnsNotifee{h: h})
-	defer ser.Close()
 
-	// Maintain connections to any configured relay addresses.
-	if len(relayAddrs) > 0 {
-		go maintainRelayConnections(ctx, h, relayAddrs, peerDB, relayCh)
+	// Hold and refresh reservations on configured, announced or known relays.
+	relays.h = h
+	if enableRelayClient || len(relayAddrs) > 0 {
+		go relays.run(ctx)
 	}
 
 	// connect to any configured bootstrap peers
@@ -372,20 +407,22 @@ func main() {
 	}()
 
 	// PubSub topic
-	psub, err := pubsub.NewGossipSub(ctx, h)
+	mods := newModerationStore(filepath.Join(dataDir, "moderation"))
+	guard := newTopicGuard(loadPubSubConfig(cfg.PubSub), h.ID(), mods)
+	psub, err := pubsub.NewGossipSub(ctx, h, guard.options()...)
 	must(err)
-	topic, err := psub.Join("room:" + room)
+	topic, err := guard.join(psub, "room:"+room)
 	must(err)
 	sub, err := topic.Subscribe()
 	must(err)
 
-	relayTopic, err := psub.Join("relays")
+	relayTopic, err := guard.join(psub, "relays")
 	must(err)
 	relaySub, err := relayTopic.Subscribe()
 	must(err)
-	go relayAnnounce(ctx, h, relayTopic, relaySub, relayCh)
+	go relayAnnounce(ctx, relayTopic, relaySub, relayCh, relays)
 
-	RunWebGateway(ctx, h, psub, topic, sub, room)
+	gw := RunWebGateway(ctx, cfg.Gateway, h, psub, guard, kdht, hooks, relays, topic, sub, room)
 
 	// simple handler: print any direct stream
 	h.SetStreamHandler("/echo/1.0.0", func(s network.Stream) {
@@ -393,15 +430,18 @@ func main() {
 		io.Copy(os.Stdout, s)
 	})
 
-	// publisher: read stdin and publish to the topic
+	// publisher: read stdin and publish to the room as the node
 	go func() {
+		if gw == nil {
+			return
+		}
 		scanner := bufio.NewScanner(os.Stdin)
 		for scanner.Scan() {
 			line := strings.TrimSpace(scanner.Text())
 			if line == "" {
 				continue
 			}
-			if err := topic.Publish(ctx, []byte(line)); err != nil {
+			if _, err := gw.publish(ctx, room, ChatMsg{Text: line}, nil); err != nil {
 				fmt.Println("publish error:", err)
 			}
 		}
@@ -413,66 +453,74 @@ func main() {
 	sig := make(chan os.Signal, 1)
 	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
 	<-sig
-}
 
-func maintainRelayConnections(ctx context.Context, h host.Host, addrs []ma.Multiaddr, ps *peerStore, announce chan<- ma.Multiaddr) {
-	ticker := time.NewTicker(30 * time.Second)
-	defer ticker.Stop()
-	for {
-		if !isAnyRelayConnected(h, addrs) {
-			connected := false
-			for _, maddr := range addrs {
-				if err := connectToRelay(ctx, h, maddr); err == nil {
-					fmt.Println("Relay connected via", maddr.String())
-					if announce != nil {
-						select {
-						case announce <- maddr:
-						default:
-						}
-					}
-					connected = true
-					break
-				}
-			}
-			if !connected {
-				for _, addr := range ps.List() {
-					maddr, err := ma.NewMultiaddr(addr)
-					if err != nil {
-						continue
-					}
-					if err := connectToRelay(ctx, h, maddr); err == nil {
-						fmt.Println("Relay fallback via", maddr.String())
-						addrs = append(addrs, maddr)
-						if announce != nil {
-							select {
-							case announce <- maddr:
-							default:
-							}
-						}
-						break
-					}
-				}
-			}
-		}
-		select {
-		case <-ticker.C:
-		case <-ctx.Done():
-			return
+	timeout := shutdownTimeout(cfg.ShutdownTimeout)
+	fmt.Printf("🛑 Shutting down (timeout %s)...\n", timeout)
+	sctx, scancel := context.WithTimeout(context.Background(), timeout)
+	defer scancel()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if gw != nil {
+			gw.Shutdown(sctx)
 		}
+		hooks.Close()
+		cancel()
+		relaySub.Cancel()
+		_ = relayTopic.Close()
+		_ = ser.Close()
+		_ = kdht.Close()
+		_ = h.Close()
+	}()
+	select {
+	case <-done:
+		fmt.Println("👋 Shutdown complete")
+	case <-sctx.Done():
+		fmt.Println("shutdown timed out, exiting")
+		os.Exit(1)
+	case <-sig:
+		fmt.Println("second signal, exiting")
+		os.Exit(1)
 	}
 }
 
-func relayAnnounce(ctx context.Context, h host.Host, topic *pubsub.Topic, sub *pubsub.Subscription, in <-chan ma.Multiaddr) {
+// shutdownTimeout bounds the shutdown sequence; SHUTDOWN_TIMEOUT overrides
+// the config value (both Go durations, e.g. "15s").
+func shutdownTimeout(cfgValue string) time.Duration {
+	if d, err := time.ParseDuration(firstNonEmpty(os.Getenv("SHUTDOWN_TIMEOUT"), cfgValue)); err == nil && d > 0 {
+		return d
+	}
+	return 10 * time.Second
+}
+
+// relayAnnounce publishes the relay records handed over by rm, asking for
+// them again when a peer joins the topic, and offers the records received
+// from other nodes to rm. The topic validator has already checked their
+// signatures.
+func relayAnnounce(ctx context.Context, topic *pubsub.Topic, sub *pubsub.Subscription, in <-chan []byte, rm *relayManager) {
 	go func() {
 		for {
 			select {
 			case <-ctx.Done():
 				return
-			case maddr := <-in:
-				_ = topic.Publish(ctx, []byte(maddr.String()))
+			case data := <-in:
+				_ = topic.Publish(ctx, data)
 			}
 		}
 	}()
+	if evts, err := topic.EventHandler(); err == nil {
+		go func() {
+			for {
+				ev, err := evts.NextPeerEvent(ctx)
+				if err != nil {
+					return
+				}
+				if ev.Type == pubsub.PeerJoin {
+					rm.reannounce()
+				}
+			}
+		}()
+	}
 	for {
 		msg, err := sub.Next(ctx)
 		if err != nil {
@@ -481,43 +529,68 @@ func relayAnnounce(ctx context.Context, h host.Host, topic *pubsub.Topic, sub *p
 			}
 			continue
 		}
-		addrStr := strings.TrimSpace(string(msg.Data))
-		maddr, err := ma.NewMultiaddr(addrStr)
+		rec, err := parseRelayAnnouncement(msg.Data)
 		if err != nil {
 			continue
 		}
-		if err := connectToRelay(ctx, h, maddr); err == nil {
-			fmt.Println("Relay connected via announcement", maddr.String())
-		}
+		rm.offer(rec)
 	}
 }
 
-func isAnyRelayConnected(h host.Host, addrs []ma.Multiaddr) bool {
-	for _, maddr := range addrs {
-		pi, err := peer.AddrInfoFromP2pAddr(maddr)
-		if err != nil {
-			continue
-		}
-		if h.Network().Connectedness(pi.ID) == network.Connected {
-			return true
-		}
-
-	}
-	return false
+// isRelayPeer reports whether p offered the Circuit Relay v2 hop protocol,
+// as recorded by identify.
+func isRelayPeer(h host.Host, p peer.ID) bool {
+	protos, err := h.Peerstore().SupportsProtocols(p, relayproto.ProtoIDv2Hop)
+	return err == nil && len(protos) > 0
 }
 
-func connectToRelay(ctx context.Context, h host.Host, maddr ma.Multiaddr) error {
+func connectToRelay(ctx context.Context, h host.Host, maddr ma.Multiaddr, tokens []string) (*clientv2.Reservation, error) {
 	pi, err := peer.AddrInfoFromP2pAddr(maddr)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	h.Peerstore().AddAddrs(pi.ID, pi.Addrs, peerstore.PermanentAddrTTL)
 	if err := h.Connect(ctx, *pi); err != nil {
-		return err
+		return nil, err
+	}
+	if err := presentRelayToken(ctx, h, pi.ID, tokens); err != nil {
+		return nil, err
+	}
+	return clientv2.Reserve(ctx, h, *pi)
+}
+
+// presentRelayToken offers tokens to a private relay until one is
+// accepted. Public relays do not speak relayAuthProtocol and need none; any
+// other failure to open the stream is returned.
+func presentRelayToken(ctx context.Context, h host.Host, id peer.ID, tokens []string) error {
+	if len(tokens) == 0 {
+		return nil
+	}
+	var refused error
+	for _, tok := range tokens {
+		s, err := h.NewStream(ctx, id, relayAuthProtocol)
+		if errors.Is(err, multistream.ErrNotSupported[protocol.ID]{}) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		_ = s.SetDeadline(time.Now().Add(10 * time.Second))
+		if _, err := io.WriteString(s, tok+"\n"); err != nil {
+			s.Reset()
+			return err
+		}
+		line, err := bufio.NewReader(io.LimitReader(s, 256)).ReadString('\n')
+		s.Close()
+		if err != nil {
+			return err
+		}
+		if line = strings.TrimSpace(line); line == "ok" {
+			return nil
+		}
+		refused = fmt.Errorf("relay %s refused token: %s", short(id), strings.TrimPrefix(line, "denied: "))
 	}
-	// Reserve slot (optional; ensures we can use relay/circuit)
-	_, err = clientv2.Reserve(ctx, h, *pi)
-	return err
+	return refused
 }
 
 func reconnectOnDisconnect(ctx context.Context, h host.Host, id peer.ID) {
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+func testHost(t *testing.T) host.Host {
+	t.Helper()
+	h, err := libp2p.New(libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { h.Close() })
+	return h
+}
+
+func TestPresentRelayToken(t *testing.T) {
+	public := testHost(t)
+	private := testHost(t)
+	private.SetStreamHandler(relayAuthProtocol, func(s network.Stream) {
+		defer s.Close()
+		line, _ := bufio.NewReader(s).ReadString('\n')
+		if line == "good\n" {
+			_, _ = io.WriteString(s, "ok\n")
+			return
+		}
+		_, _ = io.WriteString(s, "denied: bad signature\n")
+	})
+	unreachable, _ := peer.Decode("12D3KooWRHkoPrP8DzDNDRWCBwKMuDynZAGgaeANVNJ1VWJQosT7")
+
+	tests := []struct {
+		name    string
+		relay   peer.ID
+		tokens  []string
+		wantErr bool
+	}{
+		{"public relay", public.ID(), []string{"good"}, false},
+		{"accepted token", private.ID(), []string{"bad", "good"}, false},
+		{"refused token", private.ID(), []string{"bad"}, true},
+		{"unreachable relay", unreachable, []string{"good"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := testHost(t)
+			for _, r := range []host.Host{public, private} {
+				h.Peerstore().AddAddrs(r.ID(), r.Addrs(), time.Minute)
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := presentRelayToken(ctx, h, tt.relay, tt.tokens); (err != nil) != tt.wantErr {
+				t.Errorf("presentRelayToken = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strings"
+
+	cid "github.com/ipfs/go-cid"
+)
+
+// Message kinds. Plain chat messages leave Kind empty; every other kind
+// refers to an earlier message through Ref.
+const (
+	kindText     = ""
+	kindReply    = "reply"
+	kindEdit     = "edit"
+	kindDelete   = "delete"
+	kindReaction = "reaction"
+	kindModerate = "mod" // a moderation action; see ModAction
+)
+
+// maxReactionLen bounds the reaction text (an emoji or short token).
+const maxReactionLen = 32
+
+var (
+	errRefMissing   = errors.New("message kind requires ref")
+	errRefNotFound  = errors.New("referenced message not found")
+	errNotAuthor    = errors.New("only the author may change a message")
+	errRefDeleted   = errors.New("referenced message was deleted")
+	errUnknownKind  = errors.New("unknown message kind")
+	errEmptyText    = errors.New("message text is empty")
+	errBadReaction  = errors.New("reaction must be a short non-empty token")
+	errNotEditable  = errors.New("referenced message cannot be changed")
+	errDuplicateMsg = errors.New("duplicate message id")
+	errBadAttach    = errors.New("attachment needs a valid cid and name")
+)
+
+// rejectError marks a message refused by validation, as opposed to one
+// that failed to publish.
+type rejectError struct{ error }
+
+// newMsgID returns a random message ID.
+func newMsgID() string {
+	b := make([]byte, 12)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// derivedMsgID gives messages from older nodes that carry no msg_id a
+// stable ID based on the pubsub message ID, so every node agrees on it.
+func derivedMsgID(pubsubID string) string {
+	sum := sha256.Sum256([]byte(pubsubID))
+	return hex.EncodeToString(sum[:12])
+}
+
+// author identifies who wrote a message: the gateway user whose signature
+// it carries, or else the node. ID is set from the verified pubsub sender on
+// receipt, so neither can be forged by the payload.
+func author(cm ChatMsg) string {
+	if cm.User != "" {
+		return cm.User
+	}
+	return cm.ID
+}
+
+// validateMsg checks a message against its room history: edits and deletes
+// must come from the target's author, and references must resolve.
+// Moderation messages are checked by the moderation store instead.
+func (hs *historyStore) validateMsg(room string, cm ChatMsg) error {
+	if cm.MsgID != "" {
+		if _, ok := hs.Find(room, cm.MsgID); ok {
+			return errDuplicateMsg
+		}
+	}
+	if a := cm.Attachment; a != nil {
+		if _, err := cid.Decode(a.CID); err != nil || a.Name == "" || a.Size < 0 || !validMime(a.Mime) {
+			return errBadAttach
+		}
+	}
+	if cm.Kind == kindText || cm.Kind == kindReply {
+		if strings.TrimSpace(cm.Text) == "" {
+			return errEmptyText
+		}
+		if cm.Kind == kindReply && cm.Ref == "" {
+			return errRefMissing
+		}
+		return nil
+	}
+	if cm.Ref == "" {
+		return errRefMissing
+	}
+	target, ok := hs.Find(room, cm.Ref)
+	if !ok {
+		return errRefNotFound
+	}
+	if target.Kind != kindText && target.Kind != kindReply {
+		return errNotEditable
+	}
+	if target.Deleted {
+		return errRefDeleted
+	}
+	switch cm.Kind {
+	case kindEdit:
+		if strings.TrimSpace(cm.Text) == "" {
+			return errEmptyText
+		}
+		fallthrough
+	case kindDelete:
+		if author(target) != author(cm) {
+			return errNotAuthor
+		}
+	case kindReaction:
+		if t := strings.TrimSpace(cm.Text); t == "" || len(t) > maxReactionLen {
+			return errBadReaction
+		}
+	default:
+		return errUnknownKind
+	}
+	return nil
+}
+
+// applyMsg folds an edit or delete into the stored copy of its target so
+// that history replays show the current text.
+func applyMsg(msgs []ChatMsg, cm ChatMsg) {
+	if cm.Kind != kindEdit && cm.Kind != kindDelete {
+		return
+	}
+	for i := len(msgs) - 1; i >= 0; i-- {
+		if msgs[i].MsgID != cm.Ref {
+			continue
+		}
+		if cm.Kind == kindEdit {
+			msgs[i].Text = cm.Text
+			msgs[i].Edited = cm.Ts
+		} else {
+			msgs[i].Text = ""
+			msgs[i].Deleted = true
+		}
+		return
+	}
+}
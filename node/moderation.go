@@ -0,0 +1,619 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// Moderation actions, carried in ChatMsg.Mod of a kindModerate message.
+// Every action except sync is signed by a user identity and checked
+// against the room's roles by each node that applies it.
+const (
+	modClaim  = "claim"  // become the room owner; see roomModeration for rival claims
+	modGrant  = "grant"  // owner: make target a moderator
+	modRevoke = "revoke" // owner: take the moderator role back
+	modBan    = "ban"    // no reading, joining or posting
+	modUnban  = "unban"
+	modMute   = "mute" // no posting
+	modUnmute = "unmute"
+	modKick   = "kick" // drop target's clients from the room once
+	modSync   = "sync" // node-published copy of a room's role and ban records
+)
+
+const (
+	maxSyncRecords = 50               // records per sync message
+	modSyncEvery   = 30 * time.Second // at most one sync per room and interval
+	maxModReason   = 200
+
+	// claimWindow is how much earlier than the owner's claim a rival
+	// claim may be dated and still take the room over.
+	claimWindow = defaultMaxClockSkew
+)
+
+var (
+	errModUnsigned = errors.New("moderation requires a user identity")
+	errModAction   = errors.New("unknown moderation action")
+	errModTarget   = errors.New("moderation action needs a valid target")
+	errOwned       = errors.New("room already has an owner")
+	errNotOwner    = errors.New("only the room owner may do this")
+	errNotMod      = errors.New("only room moderators may do this")
+	errModProtect  = errors.New("target cannot be moderated by you")
+	errModStale    = errors.New("a newer moderation record for the target exists")
+	errBanned      = errors.New("you are banned from this room")
+	errMuted       = errors.New("you are muted in this room")
+)
+
+// ModAction is a moderation command. Target is a user ID or, to cover
+// every user of a node, a peer ID.
+type ModAction struct {
+	Action  string    `json:"action"`
+	At      int64     `json:"at"` // unix milliseconds; orders actions on the same target
+	Target  string    `json:"target,omitempty"`
+	Until   int64     `json:"until,omitempty"` // end of a ban or mute, unix seconds; 0 = permanent
+	Reason  string    `json:"reason,omitempty"`
+	Records []ChatMsg `json:"records,omitempty"` // sync only
+}
+
+// moderationState is a room's roles and restrictions as reported to
+// clients.
+type moderationState struct {
+	Room       string           `json:"room"`
+	Owner      string           `json:"owner,omitempty"`
+	Moderators []string         `json:"moderators"`
+	Bans       map[string]int64 `json:"bans"`
+	Mutes      map[string]int64 `json:"mutes"`
+}
+
+// roomModeration is the replayed state of one room. records is the
+// smallest set of signed actions that reproduces it: the owner claim, all
+// role changes and the latest ban and mute record per target, in the order
+// this node applied them. It is what gets persisted and synced.
+//
+// Records are applied in the order they arrive, never by the time their
+// author claims, so a record dated before the room's claim cannot take
+// effect ahead of it. The author's time only decides which of two records
+// on the same target is newer, and both of those are signed by someone the
+// room allowed to act.
+//
+// Claims are the exception, so that nodes which see rival claims in a
+// different order agree on the owner: the earliest claim wins, the lower
+// user ID on a tie. A rival claim dated more than claimWindow before the
+// owner's could not have been made live, since peers bound a message's
+// time to their clock, and is refused. One that wins replaces the owner's
+// claim and the state is replayed from it, dropping the records the former
+// owner's role allowed.
+type roomModeration struct {
+	records    []ChatMsg
+	owner      string
+	claimAt    int64 // Mod.At of the owner's claim
+	moderators map[string]bool
+	bans       map[string]int64
+	mutes      map[string]int64
+	latest     map[string]int64 // Mod.At of the newest applied record per targetKey
+}
+
+// targetKey groups the records that supersede each other: role changes,
+// bans and mutes of one target. Claims and kicks have none.
+func targetKey(a *ModAction) string {
+	switch a.Action {
+	case modGrant, modRevoke:
+		return "role:" + a.Target
+	case modBan, modUnban:
+		return "ban:" + a.Target
+	case modMute, modUnmute:
+		return "mute:" + a.Target
+	}
+	return ""
+}
+
+// check reports whether action cm is allowed in the current state.
+func (rm *roomModeration) check(cm ChatMsg) error {
+	if cm.Mod == nil {
+		return errModAction
+	}
+	actor, a := cm.User, cm.Mod
+	if actor == "" {
+		return errModUnsigned
+	}
+	if key := targetKey(a); key != "" && a.At <= rm.latest[key] {
+		return errModStale
+	}
+	switch a.Action {
+	case modClaim:
+		if a.Target != "" && a.Target != actor {
+			return errModTarget
+		}
+		if rm.owner != "" && !rm.beats(cm) {
+			return errOwned
+		}
+		return nil
+	case modGrant, modRevoke:
+		if actor != rm.owner {
+			return errNotOwner
+		}
+		if a.Target == "" || a.Target == rm.owner {
+			return errModTarget
+		}
+		return nil
+	case modBan, modUnban, modMute, modUnmute, modKick:
+		if actor != rm.owner && !rm.moderators[actor] {
+			return errNotMod
+		}
+		if a.Target == "" || a.Target == actor {
+			return errModTarget
+		}
+		if a.Target == rm.owner || rm.moderators[a.Target] && actor != rm.owner {
+			return errModProtect
+		}
+		return nil
+	}
+	return errModAction
+}
+
+// beats reports whether claim cm takes the room from its owner.
+func (rm *roomModeration) beats(cm ChatMsg) bool {
+	at := cm.Mod.At
+	if at < rm.claimAt-claimWindow.Milliseconds() {
+		return false
+	}
+	return at < rm.claimAt || at == rm.claimAt && cm.User < rm.owner
+}
+
+// apply applies cm if it is allowed in the current state and appends it to
+// the records.
+func (rm *roomModeration) apply(cm ChatMsg) error {
+	if err := rm.check(cm); err != nil {
+		return err
+	}
+	a := cm.Mod
+	switch a.Action {
+	case modClaim:
+		if rm.owner != "" {
+			rm.replay(append([]ChatMsg{cm}, rm.records...))
+			return nil
+		}
+		rm.owner, rm.claimAt = cm.User, a.At
+	case modGrant:
+		rm.moderators[a.Target] = true
+	case modRevoke:
+		delete(rm.moderators, a.Target)
+	case modBan:
+		rm.bans[a.Target] = a.Until
+	case modUnban:
+		delete(rm.bans, a.Target)
+	case modMute:
+		rm.mutes[a.Target] = a.Until
+	case modUnmute:
+		delete(rm.mutes, a.Target)
+	}
+	if key := targetKey(a); key != "" {
+		rm.latest[key] = a.At
+	}
+	rm.records = append(rm.records, cm)
+	return nil
+}
+
+// replay rebuilds the state from recs in their order, skipping actions
+// that were not allowed at their turn.
+func (rm *roomModeration) replay(recs []ChatMsg) {
+	rm.owner, rm.claimAt, rm.records = "", 0, nil
+	rm.moderators, rm.bans, rm.mutes = map[string]bool{}, map[string]int64{}, map[string]int64{}
+	rm.latest = map[string]int64{}
+	for _, cm := range recs {
+		rm.apply(cm)
+	}
+	rm.records = compactRecords(rm.records)
+}
+
+// compactRecords keeps the claim, every role change and the last ban and
+// mute record per target of recs, in order. A ban's validity depends only
+// on the owner and the roles at its turn, so these records alone replay to
+// the same state.
+func compactRecords(recs []ChatMsg) []ChatMsg {
+	last := map[string]int{}
+	for i, cm := range recs {
+		last[targetKey(cm.Mod)] = i
+	}
+	var kept []ChatMsg
+	for i, cm := range recs {
+		switch cm.Mod.Action {
+		case modKick:
+			continue
+		case modBan, modUnban, modMute, modUnmute:
+			if last[targetKey(cm.Mod)] != i {
+				continue
+			}
+		}
+		kept = append(kept, cm)
+	}
+	return kept
+}
+
+// restricted reports whether id is banned or muted right now.
+func (rm *roomModeration) restricted(id string) (banned, muted bool) {
+	active := func(m map[string]int64) bool {
+		until, ok := m[id]
+		return ok && (until == 0 || until > time.Now().Unix())
+	}
+	return active(rm.bans), active(rm.mutes)
+}
+
+// moderationStore keeps the moderation records of every room in memory and
+// in one JSON file per room.
+type moderationStore struct {
+	dir      string
+	mu       sync.Mutex
+	rooms    map[string]*roomModeration
+	lastSync map[string]time.Time
+}
+
+func newModerationStore(dir string) *moderationStore {
+	return &moderationStore{dir: dir, rooms: map[string]*roomModeration{}, lastSync: map[string]time.Time{}}
+}
+
+func (ms *moderationStore) roomFile(room string) string {
+	return filepath.Join(ms.dir, safeFileName(room)+".json")
+}
+
+// room loads a room's records on first use. mu must be held.
+func (ms *moderationStore) room(name string) *roomModeration {
+	if rm, ok := ms.rooms[name]; ok {
+		return rm
+	}
+	rm := &roomModeration{}
+	var recs []ChatMsg
+	if b, err := os.ReadFile(ms.roomFile(name)); err == nil {
+		if err := json.Unmarshal(b, &recs); err != nil {
+			log.Println("moderation load:", err)
+		}
+	}
+	valid := recs[:0]
+	for _, cm := range recs {
+		if cm.Kind == kindModerate && checkModMsg(name, cm) == nil && verifyMsg(cm) == nil {
+			valid = append(valid, cm)
+		}
+	}
+	rm.replay(valid)
+	ms.rooms[name] = rm
+	return rm
+}
+
+// save writes a room's records. mu must be held.
+func (ms *moderationStore) save(name string, rm *roomModeration) {
+	if err := os.MkdirAll(ms.dir, 0o700); err != nil {
+		log.Println("moderation save:", err)
+		return
+	}
+	b, _ := json.Marshal(rm.records)
+	path := ms.roomFile(name)
+	if err := os.WriteFile(path+".tmp", b, 0o600); err != nil {
+		log.Println("moderation save:", err)
+		return
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		log.Println("moderation save:", err)
+	}
+}
+
+// known reports whether this node has seen the owner of room; without one
+// it cannot judge moderation actions there.
+func (ms *moderationStore) known(room string) bool {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return ms.room(room).owner != ""
+}
+
+// authorize checks a moderation action against the current state.
+func (ms *moderationStore) authorize(room string, cm ChatMsg) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return ms.room(room).check(cm)
+}
+
+// add applies verified records to the room in the order given and returns
+// the ones that took effect and are still current: kicks, and records now
+// part of the room's state. A record that a later one in recs already
+// superseded, or that a winning rival claim dropped, is applied without
+// being reported.
+func (ms *moderationStore) add(room string, recs ...ChatMsg) []ChatMsg {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	rm := ms.room(room)
+	seen := map[string]bool{}
+	for _, cm := range rm.records {
+		seen[cm.MsgID] = true
+	}
+	var applied []ChatMsg
+	for _, cm := range recs {
+		if seen[cm.MsgID] {
+			continue
+		}
+		seen[cm.MsgID] = true
+		if rm.apply(cm) == nil {
+			applied = append(applied, cm)
+		}
+	}
+	if len(applied) == 0 {
+		return nil
+	}
+	rm.records = compactRecords(rm.records)
+	kept := map[string]bool{}
+	for _, cm := range rm.records {
+		kept[cm.MsgID] = true
+	}
+	var fresh []ChatMsg
+	for _, cm := range applied {
+		if kept[cm.MsgID] || cm.Mod.Action == modKick {
+			fresh = append(fresh, cm)
+		}
+	}
+	if len(fresh) > 0 {
+		ms.save(room, rm)
+	}
+	return fresh
+}
+
+// restricted reports whether a message by user from node may not be
+// posted, either because the user or the whole node is banned or muted.
+func (ms *moderationStore) restricted(room, user, node string) (banned, muted bool) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	rm := ms.room(room)
+	for _, id := range []string{user, node} {
+		if id == "" {
+			continue
+		}
+		b, m := rm.restricted(id)
+		banned, muted = banned || b, muted || m
+	}
+	return banned, muted
+}
+
+// isModerator reports whether id is the room's owner or a moderator.
+func (ms *moderationStore) isModerator(room, id string) bool {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	rm := ms.room(room)
+	return id != "" && (id == rm.owner || rm.moderators[id])
+}
+
+// state returns the room's roles and current restrictions.
+func (ms *moderationStore) state(room string) moderationState {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	rm := ms.room(room)
+	st := moderationState{Room: room, Owner: rm.owner, Moderators: []string{}, Bans: map[string]int64{}, Mutes: map[string]int64{}}
+	for id := range rm.moderators {
+		st.Moderators = append(st.Moderators, id)
+	}
+	sort.Strings(st.Moderators)
+	for id, until := range rm.bans {
+		if b, _ := rm.restricted(id); b {
+			st.Bans[id] = until
+		}
+	}
+	for id, until := range rm.mutes {
+		if _, m := rm.restricted(id); m {
+			st.Mutes[id] = until
+		}
+	}
+	return st
+}
+
+// syncRecords returns the room's records if a sync is due.
+func (ms *moderationStore) syncRecords(room string) []ChatMsg {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	rm := ms.room(room)
+	if len(rm.records) == 0 || time.Since(ms.lastSync[room]) < modSyncEvery {
+		return nil
+	}
+	ms.lastSync[room] = time.Now()
+	return append([]ChatMsg(nil), rm.records...)
+}
+
+// checkModMsg checks the form of a moderation message, including every
+// record of a sync, without judging whether its author may act.
+func checkModMsg(room string, cm ChatMsg) error {
+	a := cm.Mod
+	if a == nil {
+		return errModAction
+	}
+	if len(a.Reason) > maxModReason || a.Until < 0 || a.At/1000 < cm.Ts-1 || a.At/1000 > cm.Ts+1 {
+		return errModAction
+	}
+	if strings.ContainsFunc(a.Reason, unicode.IsControl) {
+		return errModAction // reasons end up in IRC lines and client UIs
+	}
+	if a.Action != modSync {
+		if len(a.Records) > 0 {
+			return errModAction
+		}
+		if cm.User == "" {
+			return errModUnsigned
+		}
+		return nil
+	}
+	if len(a.Records) == 0 || len(a.Records) > maxSyncRecords {
+		return errModAction
+	}
+	// records in a sync may be old, but none may be dated ahead of this
+	// node's clock, where no later record could supersede it; kicks only
+	// act once and are never synced
+	ahead := time.Now().Add(defaultMaxClockSkew).UnixMilli()
+	for _, rec := range a.Records {
+		if rec.Kind != kindModerate || rec.Room != room || rec.Mod == nil || rec.Mod.Action == modSync || rec.Mod.Action == modKick {
+			return errModAction
+		}
+		if rec.Mod.At > ahead {
+			return errClockSkew
+		}
+		if err := checkModMsg(room, rec); err != nil {
+			return err
+		}
+		if err := verifyMsg(rec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resolveTarget turns a nick of a current room member into the ID to act
+// on: the member's user ID, or its peer ID for a node. IDs pass through.
+func (g *Gateway) resolveTarget(room, target string) (string, error) {
+	if _, err := peer.Decode(target); err == nil {
+		return target, nil
+	}
+	id := ""
+	for _, m := range g.presence(room).Members {
+		if m.Nick != target {
+			continue
+		}
+		if id != "" {
+			return "", errors.New("nick " + target + " is ambiguous; use the user ID")
+		}
+		id = m.User
+		if id == "" {
+			id = m.Peer
+		}
+	}
+	if id == "" {
+		return "", errModTarget
+	}
+	return id, nil
+}
+
+// moderatorIdentity is the identity a caller moderates with: their own, or
+// for anonymous gateway callers a per-node identity, since moderation
+// records must carry a user signature.
+func (g *Gateway) moderatorIdentity(u *userIdentity) (*userIdentity, error) {
+	if u != nil {
+		return u, nil
+	}
+	return g.idents.get("node:moderation")
+}
+
+// moderate publishes a moderation action in room on behalf of u.
+func (g *Gateway) moderate(ctx context.Context, room string, req moderatePayload, u *userIdentity) (ChatMsg, error) {
+	ident, err := g.moderatorIdentity(u)
+	if err != nil {
+		return ChatMsg{}, err
+	}
+	act := ModAction{Action: req.Action, At: time.Now().UnixMilli(), Reason: req.Reason}
+	switch req.Action {
+	case modSync:
+		return ChatMsg{}, rejectError{errModAction}
+	case modClaim:
+		act.Target = ident.id
+	default:
+		if act.Target, err = g.resolveTarget(room, req.Target); err != nil {
+			return ChatMsg{}, rejectError{err}
+		}
+	}
+	if req.Duration != "" && (req.Action == modBan || req.Action == modMute) {
+		d, err := time.ParseDuration(req.Duration)
+		if err != nil || d <= 0 {
+			return ChatMsg{}, rejectError{errors.New("invalid duration")}
+		}
+		act.Until = time.Now().Add(d).Unix()
+	}
+	return g.publish(ctx, room, ChatMsg{Kind: kindModerate, Mod: &act}, ident)
+}
+
+// applyModeration merges moderation records received on room, tells the
+// room's clients about the ones that took effect and removes banned or
+// kicked users' clients from the room.
+func (g *Gateway) applyModeration(room string, recs []ChatMsg) {
+	for _, cm := range g.mods.add(room, recs...) {
+		ev := newFrame(frameModerate, "", moderationEvent{Room: room, Actor: cm.User, Nick: cm.From, MsgID: cm.MsgID, Ts: cm.Ts, ModAction: *cm.Mod})
+		g.sendRoom(room, ev)
+		if a := cm.Mod.Action; a == modBan || a == modKick {
+			g.removeFromRoom(room, cm.Mod.Target, ev)
+		}
+	}
+}
+
+// removeFromRoom takes room away from every client of target, which is a
+// user or, for all of a node's users, this node's peer ID.
+func (g *Gateway) removeFromRoom(room, target string, notice []byte) {
+	node := target == g.h.ID().String()
+	g.mu.Lock()
+	var gone []*WSClient
+	for c := range g.clients {
+		if !c.rooms[room] || !node && (c.ident == nil || c.ident.id != target) {
+			continue
+		}
+		c.reply(notice)
+		delete(c.rooms, room)
+		gone = append(gone, c)
+	}
+	g.mu.Unlock()
+	for _, c := range gone {
+		g.userLeft(c.ident, room)
+	}
+	g.mu.Lock()
+	g.releaseRoom(room)
+	g.mu.Unlock()
+}
+
+// syncModeration publishes the room's records for nodes that joined after
+// they were made.
+func (g *Gateway) syncModeration(ctx context.Context, room string) {
+	recs := g.mods.syncRecords(room)
+	for len(recs) > 0 {
+		n := min(len(recs), maxSyncRecords)
+		cm := ChatMsg{Kind: kindModerate, Mod: &ModAction{Action: modSync, At: time.Now().UnixMilli(), Records: recs[:n]}}
+		if _, err := g.publish(ctx, room, cm, nil); err != nil {
+			log.Println("moderation sync:", err)
+			return
+		}
+		recs = recs[n:]
+	}
+}
+
+// validate runs the history checks and the room's moderation on a message
+// about to be published or just received.
+func (g *Gateway) validate(room string, cm ChatMsg) error {
+	if cm.Kind == kindModerate {
+		if err := checkModMsg(room, cm); err != nil {
+			return err
+		}
+		if cm.Mod.Action == modSync {
+			return nil
+		}
+		return g.mods.authorize(room, cm)
+	}
+	switch banned, muted := g.mods.restricted(room, cm.User, cm.ID); {
+	case banned:
+		return errBanned
+	case muted:
+		return errMuted
+	}
+	err := g.history.validateMsg(room, cm)
+	if errors.Is(err, errNotAuthor) && cm.Kind == kindDelete && g.mods.isModerator(room, author(cm)) {
+		return nil // moderators may delete any message
+	}
+	return err
+}
+
+// bannedFrom reports whether u, or the node when u is nil, is banned from
+// room.
+func (g *Gateway) bannedFrom(room string, u *userIdentity) bool {
+	user := ""
+	if u != nil {
+		user = u.id
+	}
+	banned, _ := g.mods.restricted(room, user, g.h.ID().String())
+	return banned
+}
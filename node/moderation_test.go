@@ -0,0 +1,245 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+const testRoom = "lobby"
+
+// testIdents returns n fresh user identities.
+func testIdents(t *testing.T, n int) []*userIdentity {
+	t.Helper()
+	store := newIdentityStore(t.TempDir())
+	var out []*userIdentity
+	for i := 0; i < n; i++ {
+		u, err := store.get("user:" + string(rune('a'+i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		out = append(out, u)
+	}
+	return out
+}
+
+// modMsg builds a moderation record by u, made at unix millisecond at.
+func modMsg(t *testing.T, u *userIdentity, action, target string, at int64) ChatMsg {
+	t.Helper()
+	cm := ChatMsg{
+		From: u.Nick(), ID: "node", Ts: at / 1000, Room: testRoom, MsgID: newMsgID(), Kind: kindModerate,
+		Mod: &ModAction{Action: action, At: at, Target: target},
+	}
+	if err := u.sign(&cm); err != nil {
+		t.Fatal(err)
+	}
+	return cm
+}
+
+func syncMsg(recs ...ChatMsg) ChatMsg {
+	now := time.Now()
+	return ChatMsg{From: "node", ID: "node", Ts: now.Unix(), Room: testRoom, MsgID: newMsgID(), Kind: kindModerate,
+		Mod: &ModAction{Action: modSync, At: now.UnixMilli(), Records: recs}}
+}
+
+func TestModerationBackdatedClaim(t *testing.T) {
+	ids := testIdents(t, 3)
+	owner, attacker, victim := ids[0], ids[1], ids[2]
+	now := time.Now().UnixMilli()
+	claim := modMsg(t, owner, modClaim, owner.id, now)
+
+	tests := []struct {
+		name string
+		recs []ChatMsg
+	}{
+		{"claim dated near the epoch", []ChatMsg{modMsg(t, attacker, modClaim, attacker.id, 1000)}},
+		{"claim dated just beyond the window", []ChatMsg{modMsg(t, attacker, modClaim, attacker.id, now-claimWindow.Milliseconds()-1)}},
+		{"claim dated after the owner's", []ChatMsg{modMsg(t, attacker, modClaim, attacker.id, now+1)}},
+		{"claim followed by a ban on the owner", []ChatMsg{
+			modMsg(t, attacker, modClaim, attacker.id, 1000),
+			modMsg(t, attacker, modBan, owner.id, 2000),
+		}},
+		{"claim followed by a grant", []ChatMsg{
+			modMsg(t, attacker, modClaim, attacker.id, 1000),
+			modMsg(t, attacker, modGrant, victim.id, 2000),
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := checkModMsg(testRoom, syncMsg(tt.recs...)); err != nil {
+				t.Fatalf("sync rejected by form check: %v", err)
+			}
+			ms := newModerationStore(t.TempDir())
+			ms.add(testRoom, claim)
+			if fresh := ms.add(testRoom, tt.recs...); len(fresh) != 0 {
+				t.Errorf("add applied %d records, want 0", len(fresh))
+			}
+			st := ms.state(testRoom)
+			if st.Owner != owner.id {
+				t.Errorf("owner = %s, want %s", st.Owner, owner.id)
+			}
+			if len(st.Bans) != 0 || len(st.Moderators) != 0 {
+				t.Errorf("state changed: bans %v, moderators %v", st.Bans, st.Moderators)
+			}
+			if err := ms.authorize(testRoom, tt.recs[0]); !errors.Is(err, errOwned) {
+				t.Errorf("authorize claim = %v, want %v", err, errOwned)
+			}
+		})
+	}
+}
+
+func TestModerationRivalClaims(t *testing.T) {
+	ids := testIdents(t, 3)
+	now := time.Now().UnixMilli()
+	low, high := ids[0], ids[1]
+	if high.id < low.id {
+		low, high = high, low
+	}
+	mod := ids[2]
+
+	early := modMsg(t, high, modClaim, high.id, now-1000)
+	late := modMsg(t, low, modClaim, low.id, now)
+	lateGrant := modMsg(t, low, modGrant, mod.id, now+1000)
+	tie := modMsg(t, low, modClaim, low.id, now-1000)
+
+	tests := []struct {
+		name  string
+		recs  []ChatMsg
+		owner string
+	}{
+		{"earlier claim wins", []ChatMsg{early, late}, high.id},
+		{"earlier claim wins over a used room", []ChatMsg{late, lateGrant, early}, high.id},
+		{"lower user ID wins a tie", []ChatMsg{early, tie}, low.id},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rev := make([]ChatMsg, len(tt.recs))
+			for i, cm := range tt.recs {
+				rev[len(rev)-1-i] = cm
+			}
+			// one node receives the records live, one by one, the other
+			// in reverse order inside a sync
+			a := newModerationStore(t.TempDir())
+			for _, cm := range tt.recs {
+				if err := a.authorize(testRoom, cm); err == nil {
+					a.add(testRoom, cm)
+				}
+			}
+			b := newModerationStore(t.TempDir())
+			if err := checkModMsg(testRoom, syncMsg(rev...)); err != nil {
+				t.Fatalf("sync rejected by form check: %v", err)
+			}
+			b.add(testRoom, rev...)
+			for i, ms := range []*moderationStore{a, b} {
+				st := ms.state(testRoom)
+				if st.Owner != tt.owner {
+					t.Errorf("node %d: owner = %s, want %s", i, st.Owner, tt.owner)
+				}
+				if len(st.Moderators) != 0 {
+					t.Errorf("node %d: moderators = %v, want none", i, st.Moderators)
+				}
+			}
+		})
+	}
+}
+
+func TestModerationSyncReplay(t *testing.T) {
+	ids := testIdents(t, 4)
+	owner, mod, user, other := ids[0], ids[1], ids[2], ids[3]
+	now := time.Now().UnixMilli()
+
+	claim := modMsg(t, owner, modClaim, owner.id, now-5000)
+	grant := modMsg(t, owner, modGrant, mod.id, now-4000)
+	ban := modMsg(t, mod, modBan, user.id, now-3000)
+	unban := modMsg(t, mod, modUnban, user.id, now-2000)
+	mute := modMsg(t, mod, modMute, other.id, now-1000)
+	revoke := modMsg(t, owner, modRevoke, mod.id, now)
+
+	src := newModerationStore(t.TempDir())
+	for _, cm := range []ChatMsg{claim, grant, ban, unban, mute, revoke} {
+		if err := src.authorize(testRoom, cm); err != nil {
+			t.Fatalf("%s: %v", cm.Mod.Action, err)
+		}
+		src.add(testRoom, cm)
+	}
+	recs := src.syncRecords(testRoom)
+
+	tests := []struct {
+		name      string
+		recs      []ChatMsg
+		moderator bool
+		banned    bool
+		muted     bool
+	}{
+		{"full sync", recs, false, false, true},
+		{"superseded ban replayed after the sync", append(append([]ChatMsg(nil), recs...), ban), false, false, true},
+		{"superseded grant replayed after the sync", append(append([]ChatMsg(nil), recs...), grant), false, false, true},
+		{"ban ahead of the grant it needs", []ChatMsg{claim, ban, grant}, true, false, false},
+		{"records in order", []ChatMsg{claim, grant, ban}, true, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			ms := newModerationStore(dir)
+			ms.add(testRoom, tt.recs...)
+			// a restart replays the saved records to the same state
+			for i, ms := range []*moderationStore{ms, newModerationStore(dir)} {
+				if got := ms.state(testRoom).Owner; got != owner.id {
+					t.Errorf("store %d: owner = %s, want %s", i, got, owner.id)
+				}
+				if got := ms.isModerator(testRoom, mod.id); got != tt.moderator {
+					t.Errorf("store %d: moderator = %v, want %v", i, got, tt.moderator)
+				}
+				if banned, _ := ms.restricted(testRoom, user.id, ""); banned != tt.banned {
+					t.Errorf("store %d: banned = %v, want %v", i, banned, tt.banned)
+				}
+				if _, muted := ms.restricted(testRoom, other.id, ""); muted != tt.muted {
+					t.Errorf("store %d: muted = %v, want %v", i, muted, tt.muted)
+				}
+			}
+		})
+	}
+}
+
+func TestCheckModMsg(t *testing.T) {
+	ids := testIdents(t, 2)
+	u, target := ids[0], ids[1]
+	now := time.Now().UnixMilli()
+
+	withReason := modMsg(t, u, modKick, target.id, now)
+	withReason.Mod.Reason = "bye\r\nPRIVMSG #x :spoof"
+	if err := u.sign(&withReason); err != nil {
+		t.Fatal(err)
+	}
+	skewed := modMsg(t, u, modBan, target.id, now)
+	skewed.Mod.At += 5000
+	if err := u.sign(&skewed); err != nil {
+		t.Fatal(err)
+	}
+	forged := modMsg(t, u, modBan, target.id, now)
+	forged.Mod.Target = u.id
+
+	tests := []struct {
+		name string
+		cm   ChatMsg
+		want error
+	}{
+		{"ban", modMsg(t, u, modBan, target.id, now), nil},
+		{"unsigned", ChatMsg{Ts: now / 1000, Kind: kindModerate, Mod: &ModAction{Action: modBan, At: now}}, errModUnsigned},
+		{"control characters in reason", withReason, errModAction},
+		{"at far from ts", skewed, errModAction},
+		{"sync of a ban", syncMsg(modMsg(t, u, modBan, target.id, now-time.Hour.Milliseconds())), nil},
+		{"empty sync", syncMsg(), errModAction},
+		{"sync of a kick", syncMsg(modMsg(t, u, modKick, target.id, now)), errModAction},
+		{"sync of a sync", syncMsg(syncMsg(modMsg(t, u, modBan, target.id, now))), errModAction},
+		{"sync of a future record", syncMsg(modMsg(t, u, modBan, target.id, now+time.Hour.Milliseconds())), errClockSkew},
+		{"sync of a forged record", syncMsg(forged), errBadSig},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := checkModMsg(testRoom, tt.cm); !errors.Is(err, tt.want) {
+				t.Errorf("checkModMsg = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
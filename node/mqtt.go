@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	mqttsrv "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/listeners"
+)
+
+const (
+	defaultMQTTPrefix = "mesh/"
+	mqttConnectWait   = 10 * time.Second
+	mqttQoS           = 1
+)
+
+// MQTTConfig bridges rooms to MQTT topics "<prefix><room>". With Listen set
+// and Broker empty the node runs its own broker for local devices.
+type MQTTConfig struct {
+	Broker   string   `yaml:"broker"` // e.g. tcp://broker.lan:1883
+	Listen   string   `yaml:"listen"` // embedded broker address, e.g. 127.0.0.1:1883
+	Prefix   string   `yaml:"prefix"`
+	Rooms    []string `yaml:"rooms"` // default: the node's room
+	Username string   `yaml:"username"`
+	Password string   `yaml:"password"`
+	ClientID string   `yaml:"client_id"`
+}
+
+// loadMQTTConfig applies the MQTT_* env vars over cfg.
+func loadMQTTConfig(cfg MQTTConfig) MQTTConfig {
+	cfg.Broker = firstNonEmpty(os.Getenv("MQTT_BROKER"), cfg.Broker)
+	cfg.Listen = firstNonEmpty(os.Getenv("MQTT_LISTEN"), cfg.Listen)
+	cfg.Prefix = firstNonEmpty(os.Getenv("MQTT_PREFIX"), cfg.Prefix, defaultMQTTPrefix)
+	cfg.Username = firstNonEmpty(os.Getenv("MQTT_USERNAME"), cfg.Username)
+	cfg.Password = firstNonEmpty(os.Getenv("MQTT_PASSWORD"), cfg.Password)
+	cfg.ClientID = firstNonEmpty(os.Getenv("MQTT_CLIENT_ID"), cfg.ClientID)
+	if v := os.Getenv("MQTT_ROOMS"); v != "" {
+		cfg.Rooms = strings.Split(v, ",")
+	}
+	return cfg
+}
+
+func (c MQTTConfig) enabled() bool { return c.Broker != "" || c.Listen != "" }
+
+// mqttBridge relays chat messages between rooms and MQTT topics. Messages
+// from MQTT are published by the bridge's own identity, with the device
+// name from the payload as nick.
+//
+// Loops are cut in both directions: messages written by the bridge are not
+// sent back to MQTT, and MQTT payloads whose msg_id is already in the room
+// history (mesh messages echoed by the broker) are not published again.
+type mqttBridge struct {
+	g      *Gateway
+	cfg    MQTTConfig
+	rooms  map[string]string // MQTT topic -> room
+	ident  *userIdentity
+	client mqtt.Client
+	broker *mqttsrv.Server
+}
+
+func newMQTTBridge(g *Gateway, cfg MQTTConfig) *mqttBridge {
+	return &mqttBridge{g: g, cfg: cfg, rooms: map[string]string{}}
+}
+
+// Start runs the embedded broker if configured, connects and starts
+// relaying. It runs once the gateway consumes its rooms.
+func (b *mqttBridge) Start(ctx context.Context) error {
+	rooms := b.cfg.Rooms
+	if len(rooms) == 0 {
+		rooms = []string{b.g.room}
+	}
+	for _, room := range rooms {
+		room = strings.TrimSpace(room)
+		if room == "" || strings.ContainsAny(room, "+#") {
+			log.Printf("mqtt: room %q cannot be an MQTT topic, skipped", room)
+			continue
+		}
+		b.rooms[b.cfg.Prefix+room] = room
+	}
+	broker := b.cfg.Broker
+	if broker == "" {
+		if err := b.serve(); err != nil {
+			return err
+		}
+		host, port, err := net.SplitHostPort(b.cfg.Listen)
+		if err != nil {
+			return err
+		}
+		if host == "" || host == "0.0.0.0" || host == "::" {
+			host = "127.0.0.1"
+		}
+		broker = "tcp://" + net.JoinHostPort(host, port)
+	}
+
+	ident, err := b.g.idents.get("bridge:mqtt")
+	if err != nil {
+		return err
+	}
+	if ident.Nick() == "bridge:mqtt" {
+		_ = ident.SetNick("mqtt")
+	}
+	b.ident = ident
+	names := make([]string, 0, len(b.rooms))
+	for _, room := range b.rooms {
+		names = append(names, room)
+	}
+	c, err := b.g.attach(ctx, ident, roleWrite, names)
+	if err != nil {
+		return err
+	}
+
+	clientID := b.cfg.ClientID
+	if clientID == "" {
+		clientID = "mesh-" + b.g.h.ID().String()
+		clientID = clientID[:min(len(clientID), 23)] // MQTT 3.1 limit
+	}
+	opts := mqtt.NewClientOptions().
+		AddBroker(broker).
+		SetClientID(clientID).
+		SetUsername(b.cfg.Username).
+		SetPassword(b.cfg.Password).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetOrderMatters(false).
+		SetOnConnectHandler(b.subscribe).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) { log.Println("mqtt: connection lost:", err) })
+	b.client = mqtt.NewClient(opts)
+	if tok := b.client.Connect(); !tok.WaitTimeout(mqttConnectWait) {
+		log.Println("mqtt: broker not reachable yet, retrying in background:", broker)
+	} else if tok.Error() != nil {
+		return tok.Error()
+	}
+	go b.run(ctx, c)
+	log.Printf("📡 MQTT bridge on %s for %d room(s)", broker, len(b.rooms))
+	return nil
+}
+
+// serve starts the embedded broker. It accepts any client, so bind it to a
+// local or otherwise trusted address.
+func (b *mqttBridge) serve() error {
+	srv := mqttsrv.New(&mqttsrv.Options{
+		Logger: slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelWarn})),
+	})
+	if err := srv.AddHook(new(auth.AllowHook), nil); err != nil {
+		return err
+	}
+	if err := srv.AddListener(listeners.NewTCP(listeners.Config{ID: "mesh", Address: b.cfg.Listen})); err != nil {
+		return err
+	}
+	if err := srv.Serve(); err != nil {
+		return err
+	}
+	b.broker = srv
+	log.Println("📡 embedded MQTT broker on", b.cfg.Listen)
+	return nil
+}
+
+func (b *mqttBridge) subscribe(c mqtt.Client) {
+	for topic := range b.rooms {
+		if tok := c.Subscribe(topic, mqttQoS, b.fromMQTT); tok.Wait() && tok.Error() != nil {
+			log.Println("mqtt subscribe", topic+":", tok.Error())
+		}
+	}
+}
+
+// run forwards room messages to MQTT until the gateway shuts down.
+func (b *mqttBridge) run(ctx context.Context, c *WSClient) {
+	defer func() {
+		b.g.dropClient(c)
+		b.client.Disconnect(250)
+		if b.broker != nil {
+			_ = b.broker.Close()
+		}
+	}()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-b.g.quit:
+			return
+		case raw, ok := <-c.send:
+			if !ok {
+				return
+			}
+			f := parseFrame(raw)
+			if f.Type != frameMessage {
+				continue
+			}
+			var cm ChatMsg
+			if err := json.Unmarshal(f.Payload, &cm); err != nil || cm.User == b.ident.id {
+				continue
+			}
+			if b.client.IsConnectionOpen() {
+				b.client.Publish(b.cfg.Prefix+cm.Room, mqttQoS, false, []byte(f.Payload))
+			}
+		}
+	}
+}
+
+// fromMQTT publishes an MQTT payload into its room. JSON payloads use the
+// ChatMsg fields (from, text, kind, ref); anything else is plain text.
+func (b *mqttBridge) fromMQTT(_ mqtt.Client, m mqtt.Message) {
+	room, ok := b.rooms[m.Topic()]
+	if !ok {
+		return
+	}
+	var in ChatMsg
+	if err := json.Unmarshal(m.Payload(), &in); err != nil {
+		in = ChatMsg{Text: string(m.Payload())}
+	}
+	if in.MsgID != "" {
+		if _, seen := b.g.history.Find(room, in.MsgID); seen {
+			return // our own forward, echoed by the broker
+		}
+	}
+	cm := ChatMsg{From: in.From, Text: in.Text, Kind: in.Kind, Ref: in.Ref, Remove: in.Remove}
+	if _, err := b.g.publish(context.Background(), room, cm, b.ident); err != nil && !errors.As(err, new(rejectError)) {
+		log.Println("mqtt -> mesh:", err)
+	}
+}
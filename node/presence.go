@@ -0,0 +1,412 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+var errRosterFull = errors.New("node has too many members in the room")
+
+const (
+	presenceInterval = 15 * time.Second // heartbeat period per room
+	presenceSweep    = 5 * time.Second  // how often timeouts are evaluated
+	awayAfter        = 45 * time.Second // missed heartbeats before "away"
+	offlineAfter     = 2 * time.Minute  // missed heartbeats before "offline"
+	typingTTL        = 6 * time.Second  // typing indicator lifetime
+	maxRosterPerPeer = 32               // roster members one node may add per room
+)
+
+const (
+	statusOnline  = "online"
+	statusAway    = "away"
+	statusOffline = "offline"
+)
+
+// PresenceMsg is the heartbeat published on "presence:<room>".
+type PresenceMsg struct {
+	Nick   string `json:"nick"`
+	Peer   string `json:"peer"`
+	User   string `json:"user,omitempty"` // gateway user on that node, if any
+	Status string `json:"status"`
+	Typing bool   `json:"typing,omitempty"`
+	Ts     int64  `json:"ts"`
+	Sig    []byte `json:"sig,omitempty"` // User's signature; see presenceSigningBytes
+}
+
+// presenceSigningBytes is what a user signs in a heartbeat. The room is
+// included so a heartbeat cannot be replayed into another room.
+func presenceSigningBytes(room string, pm PresenceMsg) []byte {
+	pm.Sig = nil
+	b, _ := json.Marshal(struct {
+		Room string `json:"room"`
+		PresenceMsg
+	}{room, pm})
+	return b
+}
+
+// signPresence stamps pm with the user's identity and signature.
+func (u *userIdentity) signPresence(room string, pm *PresenceMsg) error {
+	pm.User = u.id
+	sig, err := u.key.Sign(presenceSigningBytes(room, *pm))
+	if err != nil {
+		return err
+	}
+	pm.Sig = sig
+	return nil
+}
+
+// verifyPresence checks the user signature of a heartbeat that names a
+// user. Heartbeats of the node itself carry none.
+func verifyPresence(room string, pm PresenceMsg) error {
+	if pm.User == "" {
+		if len(pm.Sig) > 0 {
+			return errBadSig
+		}
+		return nil
+	}
+	if len(pm.Sig) == 0 {
+		return ignoreError{errBadSig} // a node from before signed heartbeats
+	}
+	id, err := peer.Decode(pm.User)
+	if err != nil {
+		return errBadUser
+	}
+	pub, err := id.ExtractPublicKey()
+	if err != nil {
+		return errBadUser
+	}
+	if ok, err := pub.Verify(presenceSigningBytes(room, pm), pm.Sig); err != nil || !ok {
+		return errBadSig
+	}
+	return nil
+}
+
+// rosterEntry is one room member as reported to websocket clients.
+type rosterEntry struct {
+	Peer     string `json:"peer"`
+	User     string `json:"user,omitempty"`
+	Nick     string `json:"nick"`
+	Status   string `json:"status"`
+	Typing   bool   `json:"typing,omitempty"`
+	LastSeen int64  `json:"last_seen"`
+
+	reported    string    // status carried by the last heartbeat
+	seen        time.Time // arrival time of the last heartbeat
+	typingUntil time.Time
+}
+
+// roster tracks the members of a single room from their heartbeats. A
+// member is a node, or a gateway user on a node.
+type roster struct {
+	mu      sync.Mutex
+	members map[string]*rosterEntry
+}
+
+func newRoster() *roster {
+	return &roster{members: map[string]*rosterEntry{}}
+}
+
+func rosterKey(from peer.ID, user string) string {
+	return from.String() + "/" + user
+}
+
+// effectiveStatus applies the heartbeat timeouts to a reported status.
+func effectiveStatus(reported string, since time.Duration) string {
+	switch {
+	case reported == statusOffline || since > offlineAfter:
+		return statusOffline
+	case since > awayAfter:
+		return statusAway
+	case reported == "":
+		return statusOnline
+	}
+	return reported
+}
+
+// update records a heartbeat and reports whether it is the first member of
+// its node, whether the roster changed and whether the member's typing
+// state changed. A node may add at most maxRosterPerPeer members.
+func (r *roster) update(from peer.ID, pm PresenceMsg, now time.Time) (newPeer, changed, typingChanged bool, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	key := rosterKey(from, pm.User)
+	e, ok := r.members[key]
+	if !ok {
+		n := 0
+		for _, m := range r.members {
+			if m.Peer == from.String() {
+				n++
+			}
+		}
+		if n >= maxRosterPerPeer {
+			return false, false, false, errRosterFull
+		}
+		e = &rosterEntry{Peer: from.String(), User: pm.User}
+		r.members[key] = e
+		newPeer, changed = n == 0, true
+	}
+	status := effectiveStatus(pm.Status, 0)
+	if e.Nick != pm.Nick || e.Status != status {
+		changed = true
+	}
+	if e.Typing != pm.Typing {
+		typingChanged = true
+	}
+	e.Nick, e.Status, e.reported, e.seen = pm.Nick, status, pm.Status, now
+	e.LastSeen = now.Unix()
+	e.Typing = pm.Typing
+	if pm.Typing {
+		e.typingUntil = now.Add(typingTTL)
+	}
+	return newPeer, changed, typingChanged, nil
+}
+
+// stopTyping clears a member's typing flag, e.g. once their message arrived.
+func (r *roster) stopTyping(from peer.ID, user string) (*rosterEntry, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	e, ok := r.members[rosterKey(from, user)]
+	if !ok || !e.Typing {
+		return nil, false
+	}
+	e.Typing = false
+	cp := *e
+	return &cp, true
+}
+
+// sweep applies timeouts. It returns whether the roster changed, the members
+// whose typing indicator expired, and drops members that went offline after
+// they have been reported once.
+func (r *roster) sweep(now time.Time) (changed bool, stopped []rosterEntry) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for id, e := range r.members {
+		if e.Status == statusOffline {
+			delete(r.members, id)
+			continue
+		}
+		if s := effectiveStatus(e.reported, now.Sub(e.seen)); s != e.Status {
+			e.Status = s
+			changed = true
+		}
+		if e.Typing && (now.After(e.typingUntil) || e.Status != statusOnline) {
+			e.Typing = false
+			stopped = append(stopped, *e)
+		}
+	}
+	return changed, stopped
+}
+
+// list returns the members sorted by nick.
+func (r *roster) list() []rosterEntry {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	out := make([]rosterEntry, 0, len(r.members))
+	for _, e := range r.members {
+		out = append(out, *e)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Nick != out[j].Nick {
+			return out[i].Nick < out[j].Nick
+		}
+		return out[i].Peer < out[j].Peer
+	})
+	return out
+}
+
+// joinPresence joins the presence topic of rm. mu must be held.
+func (g *Gateway) joinPresence(rm *gatewayRoom) error {
+	topic, err := g.guard.join(g.psub, "presence:"+rm.name)
+	if err != nil {
+		return err
+	}
+	sub, err := topic.Subscribe()
+	if err != nil {
+		topic.Close()
+		return err
+	}
+	rm.presTopic, rm.presSub, rm.roster = topic, sub, newRoster()
+	return nil
+}
+
+// consumePresence applies heartbeats from the room's presence topic.
+func (g *Gateway) consumePresence(ctx context.Context, rm *gatewayRoom) {
+	for {
+		msg, err := rm.presSub.Next(ctx)
+		if err != nil {
+			if ctx.Err() != nil || err == pubsub.ErrSubscriptionCancelled {
+				return
+			}
+			log.Println("presence sub.Next:", err)
+			continue
+		}
+		var pm PresenceMsg
+		if err := json.Unmarshal(msg.Data, &pm); err != nil {
+			continue
+		}
+		from := msg.GetFrom()
+		newPeer, changed, typingChanged, err := rm.roster.update(from, pm, time.Now())
+		if err != nil {
+			continue
+		}
+		if newPeer && from != g.h.ID() && pm.Status != statusOffline {
+			// answer new nodes right away instead of on the next tick
+			go g.heartbeat(ctx, rm.name)
+			go g.syncModeration(ctx, rm.name)
+		}
+		if changed {
+			g.pushRoster(rm)
+		}
+		if typingChanged {
+			g.pushTyping(rm.name, rosterEntry{Peer: from.String(), User: pm.User, Nick: pm.Nick, Typing: pm.Typing})
+		}
+	}
+}
+
+// publishPresence announces the state of user u, or of the node itself
+// when u is nil, in room. An empty status means the current one. Like
+// other nodes, it holds heartbeats to the presence rate limit.
+func (g *Gateway) publishPresence(ctx context.Context, room string, u *userIdentity, status string, typing bool) error {
+	g.mu.RLock()
+	rm := g.rooms[room]
+	pm := PresenceMsg{Nick: g.nick, Peer: g.h.ID().String(), Status: g.status, Typing: typing, Ts: time.Now().Unix()}
+	g.mu.RUnlock()
+	if rm == nil || rm.presTopic == nil {
+		return nil
+	}
+	if u != nil {
+		pm.Nick, pm.Status = u.Nick(), u.Status()
+	}
+	if status != "" {
+		pm.Status = status
+	}
+	if u != nil {
+		if err := u.signPresence(room, &pm); err != nil {
+			return err
+		}
+	}
+	if err := g.guard.allowOwn("presence:" + room); err != nil {
+		return err
+	}
+	b, _ := json.Marshal(pm)
+	return rm.presTopic.Publish(ctx, b)
+}
+
+// heartbeat publishes presence for the node and every user connected to
+// room through this gateway, up to the maxRosterPerPeer members other
+// nodes accept from it.
+func (g *Gateway) heartbeat(ctx context.Context, room string) {
+	if err := g.publishPresence(ctx, room, nil, "", false); err != nil {
+		log.Println("presence publish:", err)
+	}
+	users := g.roomUsers(room)
+	for _, u := range users[:min(len(users), maxRosterPerPeer-1)] {
+		if err := g.publishPresence(ctx, room, u, "", false); err != nil {
+			log.Println("presence publish:", err)
+		}
+	}
+}
+
+// roomUsers lists the distinct user identities with a client in room.
+func (g *Gateway) roomUsers(room string) []*userIdentity {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	seen := map[*userIdentity]bool{}
+	var out []*userIdentity
+	for c := range g.clients {
+		if c.ident != nil && c.rooms[room] && !seen[c.ident] {
+			seen[c.ident] = true
+			out = append(out, c.ident)
+		}
+	}
+	return out
+}
+
+// userLeft reports user u offline in room once their last client there is
+// gone. Call it after the leaving client no longer lists the room.
+func (g *Gateway) userLeft(u *userIdentity, room string) {
+	if u == nil {
+		return
+	}
+	for _, other := range g.roomUsers(room) {
+		if other == u {
+			return
+		}
+	}
+	_ = g.publishPresence(context.Background(), room, u, statusOffline, false)
+}
+
+// presenceLoop sends periodic heartbeats for every joined room and expires
+// members that stopped sending theirs.
+func (g *Gateway) presenceLoop(ctx context.Context) {
+	beat := time.NewTicker(presenceInterval)
+	defer beat.Stop()
+	sweep := time.NewTicker(presenceSweep)
+	defer sweep.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-beat.C:
+			for _, name := range g.roomNames() {
+				g.heartbeat(ctx, name)
+			}
+		case now := <-sweep.C:
+			g.mu.RLock()
+			rooms := make([]*gatewayRoom, 0, len(g.rooms))
+			for _, rm := range g.rooms {
+				if rm.roster != nil {
+					rooms = append(rooms, rm)
+				}
+			}
+			g.mu.RUnlock()
+			for _, rm := range rooms {
+				changed, stopped := rm.roster.sweep(now)
+				for _, e := range stopped {
+					g.pushTyping(rm.name, e)
+				}
+				if changed {
+					g.pushRoster(rm)
+				}
+			}
+		}
+	}
+}
+
+func (g *Gateway) roomNames() []string {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	names := make([]string, 0, len(g.rooms))
+	for name := range g.rooms {
+		names = append(names, name)
+	}
+	return names
+}
+
+// presence returns the current roster of a room.
+func (g *Gateway) presence(room string) presencePayload {
+	g.mu.RLock()
+	rm := g.rooms[room]
+	g.mu.RUnlock()
+	p := presencePayload{Room: room, Members: []rosterEntry{}}
+	if rm != nil && rm.roster != nil {
+		p.Members = rm.roster.list()
+	}
+	return p
+}
+
+func (g *Gateway) pushRoster(rm *gatewayRoom) {
+	g.sendRoom(rm.name, newFrame(framePresence, "", g.presence(rm.name)))
+}
+
+func (g *Gateway) pushTyping(room string, e rosterEntry) {
+	g.sendRoom(room, newFrame(frameTyping, "", typingPayload{Room: room, Peer: e.Peer, User: e.User, Nick: e.Nick, Typing: e.Typing}))
+}
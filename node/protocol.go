@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+)
+
+// protocolVersion is the websocket envelope version spoken by the gateway.
+// Clients may omit "v"; frames with a higher version are rejected.
+const protocolVersion = 1
+
+// Frame types exchanged over the gateway websocket.
+const (
+	frameSend     = "send"     // client -> server: publish a message
+	frameJoin     = "join"     // client -> server: subscribe to a room
+	frameLeave    = "leave"    // client -> server: unsubscribe from a room
+	frameHistory  = "history"  // both ways: request / return recent messages
+	framePresence = "presence" // both ways: request / return room roster
+	frameTyping   = "typing"   // both ways: typing indicator
+	frameMessage  = "message"  // server -> client: a chat message
+	frameError    = "error"    // server -> client: a request failed
+	frameAck      = "ack"      // server -> client: a request succeeded
+	frameModerate = "moderate" // both ways: moderation action / applied action
+)
+
+// Error codes carried in error frames.
+const (
+	errBadRequest    = "bad_request"
+	errUnsupported   = "unsupported_version"
+	errUnknownType   = "unknown_type"
+	errNotJoined     = "not_joined"
+	errJoinFailed    = "join_failed"
+	errPublishFailed = "publish_failed"
+	errRejected      = "rejected"
+	errForbidden     = "forbidden"
+)
+
+// Frame is the JSON envelope for every websocket message. ID is chosen by
+// the client and echoed back in the matching ack or error frame.
+type Frame struct {
+	V       int             `json:"v"`
+	Type    string          `json:"type"`
+	ID      string          `json:"id,omitempty"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+type sendPayload struct {
+	Room   string `json:"room,omitempty"`
+	Text   string `json:"text"`
+	Kind   string `json:"kind,omitempty"`
+	Ref    string `json:"ref,omitempty"`
+	Remove bool   `json:"remove,omitempty"`
+
+	Attachment *Attachment `json:"attachment,omitempty"`
+}
+
+type roomPayload struct {
+	Room string `json:"room"`
+}
+
+type historyRequest struct {
+	Room  string `json:"room,omitempty"`
+	Limit int    `json:"limit,omitempty"`
+}
+
+type historyPayload struct {
+	Room     string    `json:"room"`
+	Messages []ChatMsg `json:"messages"`
+}
+
+type presenceRequest struct {
+	Room   string `json:"room,omitempty"`
+	Status string `json:"status,omitempty"`
+}
+
+type presencePayload struct {
+	Room    string        `json:"room"`
+	Members []rosterEntry `json:"members"`
+}
+
+type typingRequest struct {
+	Room   string `json:"room,omitempty"`
+	Typing bool   `json:"typing"`
+}
+
+type typingPayload struct {
+	Room   string `json:"room"`
+	Peer   string `json:"peer"`
+	User   string `json:"user,omitempty"`
+	Nick   string `json:"nick"`
+	Typing bool   `json:"typing"`
+}
+
+// moderatePayload asks for a moderation action. Target is a user ID, a
+// peer ID or the nick of a current member; Duration limits a ban or mute.
+type moderatePayload struct {
+	Room     string `json:"room,omitempty"`
+	Action   string `json:"action"`
+	Target   string `json:"target,omitempty"`
+	Duration string `json:"duration,omitempty"` // e.g. "1h"
+	Reason   string `json:"reason,omitempty"`
+}
+
+// moderationEvent reports an action that took effect in a room.
+type moderationEvent struct {
+	Room  string `json:"room"`
+	Actor string `json:"actor"`
+	Nick  string `json:"nick"`
+	MsgID string `json:"msg_id"`
+	Ts    int64  `json:"ts"`
+	ModAction
+}
+
+type errorPayload struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// newFrame builds an outgoing frame, marshalling payload if it is non-nil.
+func newFrame(typ, id string, payload any) []byte {
+	f := Frame{V: protocolVersion, Type: typ, ID: id}
+	if payload != nil {
+		f.Payload, _ = json.Marshal(payload)
+	}
+	b, _ := json.Marshal(f)
+	return b
+}
+
+func errorFrame(id, code, msg string) []byte {
+	return newFrame(frameError, id, errorPayload{Code: code, Message: msg})
+}
+
+// parseFrame decodes an incoming websocket message. Anything that is not a
+// JSON envelope is treated as a legacy plain-text send to the default room.
+func parseFrame(data []byte) Frame {
+	var f Frame
+	if err := json.Unmarshal(data, &f); err != nil || f.Type == "" {
+		p, _ := json.Marshal(sendPayload{Text: string(data)})
+		return Frame{V: protocolVersion, Type: frameSend, Payload: p}
+	}
+	return f
+}
@@ -0,0 +1,569 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/peerstore"
+	clientv2 "github.com/libp2p/go-libp2p/p2p/protocol/circuitv2/client"
+	"github.com/libp2p/go-libp2p/p2p/protocol/ping"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+const (
+	defaultRelayCount = 2
+	relayCheckEvery   = 30 * time.Second
+	relayRetryEvery   = 10 * time.Second
+
+	relayProbeEvery     = time.Minute
+	relayPingTimeout    = 5 * time.Second
+	relayHistory        = 10  // probe and reservation outcomes kept per candidate
+	relayMaxCandidates  = 32  // known_peers.txt and announcements fill up to this
+	relaySwitchRatio    = 0.5 // a candidate must score this much better to replace a held relay
+	relayRebalanceEvery = 5 * time.Minute
+)
+
+// Candidate sources, in the order they are preferred before any are measured.
+const (
+	sourceConfig   = "config"
+	sourceAnnounce = "announce"
+	sourceKnown    = "known"
+)
+
+var circuitComponent = ma.StringCast("/p2p-circuit")
+
+// heldRelay is a reservation this node holds on a relay.
+type heldRelay struct {
+	addr       ma.Multiaddr // the address we reserved through, with /p2p
+	rsvp       *clientv2.Reservation
+	granted    time.Time
+	announced  time.Time // last time its record was published
+	announceAt time.Time // when it is next due
+}
+
+// refreshAt is two thirds into the reservation's lifetime, leaving time
+// for a retry before it runs out.
+func (hr *heldRelay) refreshAt() time.Time {
+	return hr.granted.Add(hr.rsvp.Expiration.Sub(hr.granted) * 2 / 3)
+}
+
+// relayCandidate is a relay the node could reserve on, with its measured
+// round trip time and recent reliability.
+type relayCandidate struct {
+	id       peer.ID
+	addr     ma.Multiaddr
+	source   string
+	rtt      time.Duration // moving average of ping round trips; 0 until one succeeds
+	outcomes []bool        // last relayHistory pings and reservations, oldest first
+	probed   time.Time
+	failedAt time.Time // last failed reservation
+	capacity int       // free slots per its last record; -1 if unknown
+	private  bool
+	expires  time.Time // when an announced candidate's record lapses
+	issued   int64     // of the record capacity and expires come from
+}
+
+func (c *relayCandidate) record(ok bool) {
+	c.outcomes = append(c.outcomes, ok)
+	if len(c.outcomes) > relayHistory {
+		c.outcomes = c.outcomes[len(c.outcomes)-relayHistory:]
+	}
+}
+
+func (c *relayCandidate) reliability() float64 {
+	if len(c.outcomes) == 0 {
+		return 0
+	}
+	n := 0
+	for _, ok := range c.outcomes {
+		if ok {
+			n++
+		}
+	}
+	return float64(n) / float64(len(c.outcomes))
+}
+
+// reachable is false when the last ping or reservation failed.
+func (c *relayCandidate) reachable() bool {
+	return len(c.outcomes) == 0 || c.outcomes[len(c.outcomes)-1]
+}
+
+// score is the round trip time in milliseconds divided by reliability;
+// lower is better. Candidates that never answered a ping score +Inf.
+func (c *relayCandidate) score() float64 {
+	if c.rtt == 0 {
+		return math.Inf(1)
+	}
+	return float64(c.rtt.Microseconds()) / 1000 / math.Max(c.reliability(), 0.05)
+}
+
+// relayManager keeps reservations on the want best relays, refreshes them
+// before they expire and advertises the resulting circuit addresses.
+// Candidates come from RELAY_ADDR, signed relay announcements and
+// known_peers.txt; those that could be needed are pinged every
+// relayProbeEvery and all are ranked by score.
+// The records of held relays are published for other nodes.
+type relayManager struct {
+	h        host.Host
+	tokens   []string
+	want     int
+	ps       *peerStore
+	announce chan<- []byte
+	wake     chan struct{}
+
+	mu         sync.Mutex
+	candidates map[peer.ID]*relayCandidate
+	order      []peer.ID // insertion order, the tie-break for equal scores
+	held       map[peer.ID]*heldRelay
+	rebalanced time.Time
+}
+
+func newRelayManager(addrs []ma.Multiaddr, tokens []string, want int, ps *peerStore, announce chan<- []byte) *relayManager {
+	if want <= 0 {
+		want = defaultRelayCount
+	}
+	rm := &relayManager{tokens: tokens, want: want, ps: ps, announce: announce, wake: make(chan struct{}, 1),
+		candidates: map[peer.ID]*relayCandidate{}, held: map[peer.ID]*heldRelay{}, rebalanced: time.Now()}
+	for _, maddr := range addrs {
+		rm.add(maddr, sourceConfig)
+	}
+	return rm
+}
+
+// circuitAddrs returns the /p2p-circuit addresses of the held
+// reservations, for the host's address factory.
+func (rm *relayManager) circuitAddrs() []ma.Multiaddr {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	var out []ma.Multiaddr
+	for _, hr := range rm.held {
+		addrs := hr.rsvp.Addrs
+		if len(addrs) == 0 {
+			addrs = []ma.Multiaddr{hr.addr}
+		}
+		for _, a := range addrs {
+			out = append(out, a.Encapsulate(circuitComponent))
+		}
+	}
+	return out
+}
+
+// offer records a validated relay announcement or fleet record. A new
+// relay becomes a candidate and wakes the manager; a known one takes the
+// capacity of the newer record. Nothing is dialled until the relay ranks
+// well enough.
+func (rm *relayManager) offer(rec *relayRecord) {
+	if rec.id == rm.h.ID() {
+		return
+	}
+	expires := time.Unix(rec.Expires, 0)
+	rm.h.Peerstore().AddAddrs(rec.id, rec.addrs, time.Until(expires))
+	rm.mu.Lock()
+	c := rm.candidates[rec.id]
+	if c == nil {
+		if len(rm.candidates) >= relayMaxCandidates {
+			rm.mu.Unlock()
+			return
+		}
+		c = &relayCandidate{id: rec.id, addr: rec.addrs[0].Encapsulate(ma.StringCast("/p2p/" + rec.id.String())), source: sourceAnnounce}
+		rm.candidates[rec.id] = c
+		rm.order = append(rm.order, rec.id)
+		defer func() {
+			select {
+			case rm.wake <- struct{}{}:
+			default:
+			}
+		}()
+	}
+	if rec.Issued >= c.issued {
+		c.capacity, c.private, c.expires, c.issued = rec.Capacity, rec.Private, expires, rec.Issued
+	}
+	rm.mu.Unlock()
+}
+
+// add records maddr as a candidate unless its peer is already one, or the
+// list is full and maddr is not from the config. It reports whether the
+// candidate is new.
+func (rm *relayManager) add(maddr ma.Multiaddr, source string) bool {
+	if _, err := maddr.ValueForProtocol(ma.P_CIRCUIT); err == nil {
+		return false // a peer reached through a relay is no relay itself
+	}
+	pi, err := peer.AddrInfoFromP2pAddr(maddr)
+	if err != nil || (rm.h != nil && pi.ID == rm.h.ID()) {
+		return false
+	}
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	if rm.candidates[pi.ID] != nil {
+		return false
+	}
+	if source != sourceConfig && len(rm.candidates) >= relayMaxCandidates {
+		return false
+	}
+	rm.candidates[pi.ID] = &relayCandidate{id: pi.ID, addr: maddr, source: source, capacity: -1}
+	rm.order = append(rm.order, pi.ID)
+	return true
+}
+
+func (rm *relayManager) run(ctx context.Context) {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		case <-rm.wake:
+		}
+		next := rm.maintain(ctx)
+		timer.Reset(time.Until(next))
+	}
+}
+
+// eligible reports whether c could serve a reservation for this node at
+// all: it has room, admits the node and, if identified, is a relay.
+func (rm *relayManager) eligible(c relayCandidate) bool {
+	if c.capacity == 0 || (c.private && len(rm.tokens) == 0) {
+		return false
+	}
+	if protos, _ := rm.h.Peerstore().GetProtocols(c.id); c.source == sourceKnown && len(protos) > 0 && !isRelayPeer(rm.h, c.id) {
+		return false // identified, and not a relay
+	}
+	return true
+}
+
+// probeDue picks the candidates to ping now and marks them probed: the
+// held relays, the configured ones and, in ranking order, as many eligible
+// others as it takes to fill want reservations plus one to challenge the
+// worst held relay. Other candidates, most announced and fleet relays
+// among them, are not dialled until they rank among those. A candidate
+// whose last attempt failed is retried every relayRebalanceEvery.
+func (rm *relayManager) probeDue(now time.Time) []relayCandidate {
+	ranked := rm.ranking()
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	spare := rm.want - len(rm.held) + 1
+	var due []relayCandidate
+	for _, c := range ranked {
+		need := rm.held[c.id] != nil || c.source == sourceConfig
+		if !need && spare > 0 && rm.eligible(c) && (c.reachable() || now.Sub(c.probed) >= relayRebalanceEvery) {
+			need, spare = true, spare-1
+		}
+		if need && now.Sub(c.probed) >= relayProbeEvery {
+			rm.candidates[c.id].probed = now
+			due = append(due, relayCandidate{id: c.id, addr: c.addr})
+		}
+	}
+	return due
+}
+
+// probe pings the candidates probeDue picks, dialing them first when
+// needed, and folds the results into their scores.
+func (rm *relayManager) probe(ctx context.Context) {
+	due := rm.probeDue(time.Now())
+
+	var wg sync.WaitGroup
+	for _, c := range due {
+		wg.Add(1)
+		go func(c relayCandidate) {
+			defer wg.Done()
+			pctx, cancel := context.WithTimeout(ctx, relayPingTimeout)
+			defer cancel()
+			var res ping.Result
+			pi, _ := peer.AddrInfoFromP2pAddr(c.addr)
+			rm.h.Peerstore().AddAddrs(pi.ID, pi.Addrs, peerstore.TempAddrTTL)
+			if err := rm.h.Connect(pctx, *pi); err != nil {
+				res.Error = err
+			} else {
+				res = <-ping.Ping(pctx, rm.h, c.id)
+			}
+			rm.mu.Lock()
+			defer rm.mu.Unlock()
+			cand := rm.candidates[c.id]
+			if cand == nil {
+				return
+			}
+			cand.record(res.Error == nil)
+			if res.Error == nil {
+				if cand.rtt == 0 {
+					cand.rtt = res.RTT
+				} else {
+					cand.rtt = (3*cand.rtt + res.RTT) / 4
+				}
+			}
+		}(c)
+	}
+	wg.Wait()
+}
+
+// ranking returns copies of the candidates, best score first. Candidates
+// without a measurement keep their insertion order behind the rest.
+func (rm *relayManager) ranking() []relayCandidate {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	out := make([]relayCandidate, 0, len(rm.order))
+	for _, id := range rm.order {
+		out = append(out, *rm.candidates[id])
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].score() < out[j].score() })
+	return out
+}
+
+// reserve connects to c and takes a reservation, recording the outcome.
+func (rm *relayManager) reserve(ctx context.Context, c relayCandidate) (*heldRelay, error) {
+	rsvp, err := connectToRelay(ctx, rm.h, c.addr, rm.tokens)
+	rm.mu.Lock()
+	if cand := rm.candidates[c.id]; cand != nil {
+		cand.record(err == nil)
+		if err != nil {
+			cand.failedAt = time.Now()
+		}
+	}
+	rm.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	hr := &heldRelay{addr: c.addr, rsvp: rsvp, granted: time.Now()}
+	rm.set(c.id, hr)
+	return hr, nil
+}
+
+// expire forgets announced candidates whose record lapsed, unless held.
+func (rm *relayManager) expire() {
+	now := time.Now()
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	order := rm.order[:0]
+	for _, id := range rm.order {
+		c := rm.candidates[id]
+		if c.source == sourceAnnounce && now.After(c.expires) && rm.held[id] == nil {
+			delete(rm.candidates, id)
+			continue
+		}
+		order = append(order, id)
+	}
+	rm.order = order
+}
+
+// reannounce brings the records of held relays forward to the earliest
+// time the topic accepts them again, e.g. because a peer joined after they
+// went out. Peers that already have a record ignore the repeat.
+func (rm *relayManager) reannounce() {
+	rm.mu.Lock()
+	for _, hr := range rm.held {
+		if t := hr.announced.Add(relayRecordMinGap + time.Second); t.Before(hr.announceAt) {
+			hr.announceAt = t
+		}
+	}
+	rm.mu.Unlock()
+	select {
+	case rm.wake <- struct{}{}:
+	default:
+	}
+}
+
+// publish fetches and hands on the signed records of held relays that are
+// due, every relayAnnounceEvery unless reannounce brings them forward.
+// Relays without relayRecordProtocol are not announced. It also asks each
+// for the fleet of relays it federates with and offers those as
+// candidates, so one relay is enough to learn the rest.
+func (rm *relayManager) publish(ctx context.Context) {
+	now := time.Now()
+	rm.mu.Lock()
+	var due []peer.ID
+	for id, hr := range rm.held {
+		if !now.Before(hr.announceAt) {
+			hr.announced, hr.announceAt = now, now.Add(relayAnnounceEvery)
+			due = append(due, id)
+		}
+	}
+	rm.mu.Unlock()
+	for _, id := range due {
+		if recs, err := fetchRelayFleet(ctx, rm.h, id); err == nil {
+			for _, rec := range recs {
+				rm.offer(rec)
+			}
+		}
+		data, err := fetchRelayRecord(ctx, rm.h, id)
+		if err != nil {
+			continue
+		}
+		select {
+		case rm.announce <- data:
+		default:
+		}
+	}
+}
+
+// maintain refreshes due reservations, drops lost ones, tops up to want
+// relays in ranking order, swaps a held relay for a much better one at most
+// every relayRebalanceEvery and returns when it next needs to run.
+func (rm *relayManager) maintain(ctx context.Context) time.Time {
+	for _, s := range rm.ps.List() {
+		if maddr, err := ma.NewMultiaddr(s); err == nil {
+			rm.add(maddr, sourceKnown)
+		}
+	}
+	rm.expire()
+	rm.probe(ctx)
+
+	now := time.Now()
+	rm.mu.Lock()
+	held := make(map[peer.ID]*heldRelay, len(rm.held))
+	for id, hr := range rm.held {
+		held[id] = hr
+	}
+	rm.mu.Unlock()
+
+	for id, hr := range held {
+		switch {
+		case rm.h.Network().Connectedness(id) != network.Connected || now.After(hr.rsvp.Expiration):
+			fmt.Println("Relay lost", hr.addr.String())
+			rm.drop(id)
+			delete(held, id)
+		case now.After(hr.refreshAt()):
+			// a private relay may have let our token grant lapse or
+			// revoked it since the last reservation
+			if err := presentRelayToken(ctx, rm.h, id, rm.tokens); err != nil {
+				fmt.Println("Relay refresh failed:", err)
+				continue
+			}
+			rsvp, err := clientv2.Reserve(ctx, rm.h, peer.AddrInfo{ID: id, Addrs: rm.h.Peerstore().Addrs(id)})
+			if err != nil {
+				fmt.Println("Relay refresh failed:", err)
+				// keep it until it expires; the next run retries
+				continue
+			}
+			rm.set(id, &heldRelay{addr: hr.addr, rsvp: rsvp, granted: time.Now(), announced: hr.announced, announceAt: hr.announceAt})
+		}
+	}
+
+	usable := func(c relayCandidate) bool {
+		return rm.eligible(c) && held[c.id] == nil && c.reachable() && time.Since(c.failedAt) >= relayProbeEvery
+	}
+	ranked := rm.ranking()
+	for _, c := range ranked {
+		if len(held) >= rm.want || ctx.Err() != nil {
+			break
+		}
+		if !usable(c) {
+			continue
+		}
+		hr, err := rm.reserve(ctx, c)
+		if err != nil {
+			continue
+		}
+		held[c.id] = hr
+		fmt.Printf("Relay connected via %s (reservation until %s)\n", c.addr, hr.rsvp.Expiration.Format(time.TimeOnly))
+	}
+
+	if len(held) >= rm.want && time.Since(rm.rebalanced) >= relayRebalanceEvery {
+		rm.rebalanced = time.Now()
+		var worst, best *relayCandidate
+		for i := range ranked {
+			c := &ranked[i]
+			if held[c.id] != nil {
+				worst = c // ranked is best first, so the last held one wins
+			} else if best == nil && usable(*c) {
+				best = c
+			}
+		}
+		if worst != nil && best != nil && best.score() < worst.score()*relaySwitchRatio {
+			if hr, err := rm.reserve(ctx, *best); err == nil {
+				rm.drop(worst.id)
+				delete(held, worst.id)
+				held[best.id] = hr
+				fmt.Printf("Relay switched from %s to %s (%.1fms vs %.1fms)\n", worst.addr, best.addr, best.score(), worst.score())
+			}
+		}
+	}
+
+	rm.publish(ctx)
+
+	now = time.Now()
+	next := now.Add(relayCheckEvery)
+	rm.mu.Lock()
+	for _, hr := range rm.held {
+		t := hr.refreshAt()
+		if t.Before(now) {
+			t = now.Add(relayRetryEvery) // a refresh failed
+		}
+		if t.Before(next) {
+			next = t
+		}
+		if hr.announceAt.Before(next) {
+			next = hr.announceAt
+		}
+	}
+	rm.mu.Unlock()
+	return next
+}
+
+func (rm *relayManager) set(id peer.ID, hr *heldRelay) {
+	rm.mu.Lock()
+	rm.held[id] = hr
+	rm.mu.Unlock()
+}
+
+func (rm *relayManager) drop(id peer.ID) {
+	rm.mu.Lock()
+	delete(rm.held, id)
+	rm.mu.Unlock()
+}
+
+// relayStatus is one ranked candidate as reported by GET /relays.
+type relayStatus struct {
+	Peer        string     `json:"peer"`
+	Addr        string     `json:"addr"`
+	Source      string     `json:"source"`
+	RTTMillis   float64    `json:"rtt_ms,omitempty"`
+	Reliability float64    `json:"reliability"`
+	Score       float64    `json:"score,omitempty"` // omitted until a ping succeeds
+	Capacity    *int       `json:"capacity,omitempty"`
+	Private     bool       `json:"private,omitempty"`
+	Held        bool       `json:"held"`
+	Expires     *time.Time `json:"expires,omitempty"`
+}
+
+// handleRelays reports the candidate relays best first, with their
+// measurements and the reservations currently held.
+func (rm *relayManager) handleRelays(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	resp := struct {
+		Want   int           `json:"want"`
+		Relays []relayStatus `json:"relays"`
+	}{Want: rm.want, Relays: []relayStatus{}}
+	ranked := rm.ranking()
+	rm.mu.Lock()
+	for _, c := range ranked {
+		st := relayStatus{Peer: c.id.String(), Addr: c.addr.String(), Source: c.source, Reliability: c.reliability()}
+		if c.rtt > 0 {
+			st.RTTMillis = float64(c.rtt.Microseconds()) / 1000
+			st.Score = c.score()
+		}
+		if c.capacity >= 0 {
+			st.Capacity = &c.capacity
+		}
+		if hr := rm.held[c.id]; hr != nil {
+			st.Held = true
+			exp := hr.rsvp.Expiration
+			st.Expires = &exp
+		}
+		resp.Relays = append(resp.Relays, st)
+	}
+	rm.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(resp)
+}
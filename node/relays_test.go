@@ -0,0 +1,83 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+func TestProbeDue(t *testing.T) {
+	h, err := libp2p.New(libp2p.NoListenAddrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { h.Close() })
+	now := time.Now()
+
+	// candidates in the order they were learned; ranked by score they are
+	// full, best, failed, good, then config, fresh and spare unmeasured
+	cands := []struct {
+		name   string
+		source string
+		edit   func(*relayCandidate)
+	}{
+		{"config", sourceConfig, nil},
+		{"best", sourceAnnounce, func(c *relayCandidate) { c.rtt, c.outcomes = 10*time.Millisecond, []bool{true} }},
+		{"good", sourceAnnounce, func(c *relayCandidate) { c.rtt, c.outcomes = 20*time.Millisecond, []bool{true} }},
+		{"full", sourceAnnounce, func(c *relayCandidate) { c.rtt, c.outcomes, c.capacity = 5*time.Millisecond, []bool{true}, 0 }},
+		{"failed", sourceAnnounce, func(c *relayCandidate) {
+			c.rtt, c.outcomes, c.probed = 8*time.Millisecond, []bool{true, false}, now.Add(-2*relayProbeEvery)
+		}},
+		{"fresh", sourceAnnounce, nil},
+		{"spare", sourceKnown, nil},
+	}
+
+	tests := []struct {
+		name string
+		want int
+		held []string
+		due  []string
+	}{
+		{"none held", 2, nil, []string{"best", "good", "config", "fresh"}},
+		{"one held", 2, []string{"spare"}, []string{"best", "good", "config", "spare"}},
+		{"all held", 1, []string{"fresh"}, []string{"best", "config", "fresh"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rm := newRelayManager(nil, nil, tt.want, nil, nil)
+			rm.h = h
+			names := map[peer.ID]string{}
+			ids := map[string]peer.ID{}
+			for _, c := range cands {
+				id, _ := testPeer(t)
+				names[id], ids[c.name] = c.name, id
+				rm.add(ma.StringCast("/ip4/192.0.2.1/tcp/4001/p2p/"+id.String()), c.source)
+				if c.edit != nil {
+					c.edit(rm.candidates[id])
+				}
+			}
+			for _, name := range tt.held {
+				rm.held[ids[name]] = &heldRelay{}
+			}
+
+			var got []string
+			for _, c := range rm.probeDue(now) {
+				got = append(got, names[c.id])
+			}
+			if len(got) != len(tt.due) {
+				t.Fatalf("due = %v, want %v", got, tt.due)
+			}
+			for i := range got {
+				if got[i] != tt.due[i] {
+					t.Fatalf("due = %v, want %v", got, tt.due)
+				}
+			}
+			if again := rm.probeDue(now.Add(time.Second)); len(again) != 0 {
+				t.Errorf("%d candidates due again within relayProbeEvery", len(again))
+			}
+		})
+	}
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	sseKeepAlive   = 25 * time.Second // comment line that keeps proxies from timing out
+	sseBuffer      = 64               // queued events per stream before drops
+	maxRESTMessage = 64 << 10         // request body limit for POST .../messages
+)
+
+// postPayload is the body of POST /rooms/{room}/messages. Nick overrides
+// the sender's nick for this message and needs admin access.
+type postPayload struct {
+	sendPayload
+	Nick string `json:"nick,omitempty"`
+}
+
+// handleRooms routes /rooms/{room}/events, /rooms/{room}/messages and
+// /rooms/{room}/moderation.
+func (g *Gateway) handleRooms(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.Path, "/rooms/")
+	i := strings.LastIndex(rest, "/")
+	if i <= 0 {
+		http.NotFound(w, r)
+		return
+	}
+	room, action := rest[:i], rest[i+1:]
+	switch {
+	case action == "events" && r.Method == http.MethodGet:
+		g.handleEvents(w, r, room)
+	case action == "messages" && r.Method == http.MethodPost:
+		g.handlePostMessage(w, r, room)
+	case action == "moderation" && r.Method == http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(g.mods.state(room))
+	case action == "moderation" && r.Method == http.MethodPost:
+		g.handleModerate(w, r, room)
+	case action == "events" || action == "messages" || action == "moderation":
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// handleEvents streams a room as Server-Sent Events. Event names are the
+// websocket frame types (message, presence, typing) and data is the frame
+// payload. Messages carry their msg_id as the event ID, so a reconnecting
+// client that sends Last-Event-ID gets what it missed from history.
+func (g *Gateway) handleEvents(w http.ResponseWriter, r *http.Request, room string) {
+	fl, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	s := sessionFrom(r)
+	ident, err := g.identityFor(s)
+	if err != nil {
+		http.Error(w, "identity unavailable", http.StatusInternalServerError)
+		return
+	}
+	if g.bannedFrom(room, ident) {
+		http.Error(w, errBanned.Error(), http.StatusForbidden)
+		return
+	}
+	c := &WSClient{send: make(chan []byte, sseBuffer), rooms: map[string]bool{}, ident: ident, role: s.role}
+	g.mu.Lock()
+	if g.closing {
+		g.mu.Unlock()
+		http.Error(w, "shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	g.clients[c] = true
+	g.mu.Unlock()
+	defer g.dropClient(c)
+	if _, err := g.joinRoom(c, room); err != nil {
+		http.Error(w, "join failed: "+err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	if last := r.Header.Get("Last-Event-ID"); last != "" {
+		missed := false
+		for _, cm := range g.history.Recent(room, historyLimit) {
+			if missed {
+				writeEvent(w, frameMessage, cm.MsgID, cm)
+			}
+			missed = missed || cm.MsgID == last
+		}
+	}
+	writeEvent(w, framePresence, "", g.presence(room))
+	fl.Flush()
+
+	ping := time.NewTicker(sseKeepAlive)
+	defer ping.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-g.quit:
+			return
+		case <-ping.C:
+			_, _ = io.WriteString(w, ": ping\n\n")
+		case b, ok := <-c.send:
+			if !ok {
+				return
+			}
+			f := parseFrame(b)
+			id := ""
+			if f.Type == frameMessage {
+				var cm ChatMsg
+				_ = json.Unmarshal(f.Payload, &cm)
+				id = cm.MsgID
+			}
+			writeEvent(w, f.Type, id, f.Payload)
+			if f.Type == frameModerate {
+				g.mu.RLock()
+				still := c.rooms[room]
+				g.mu.RUnlock()
+				if !still {
+					fl.Flush()
+					return // kicked or banned
+				}
+			}
+		}
+		fl.Flush()
+	}
+}
+
+// writeEvent writes one SSE event. JSON encodes to a single line, so data
+// never needs splitting.
+func writeEvent(w io.Writer, event, id string, data any) {
+	b, ok := data.(json.RawMessage)
+	if !ok {
+		b, _ = json.Marshal(data)
+	}
+	if id != "" {
+		fmt.Fprintf(w, "id: %s\n", id)
+	}
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, b)
+}
+
+// handlePostMessage publishes a message to a room, joining it for the
+// request if nothing holds it. The body is a JSON postPayload, or plain
+// text for the message text.
+func (g *Gateway) handlePostMessage(w http.ResponseWriter, r *http.Request, room string) {
+	s := sessionFrom(r)
+	if s.role < roleWrite {
+		http.Error(w, "write access required", http.StatusForbidden)
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxRESTMessage))
+	if err != nil {
+		http.Error(w, "body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	var p postPayload
+	if ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); ct == "application/json" {
+		if err := json.Unmarshal(body, &p); err != nil {
+			http.Error(w, "invalid json", http.StatusBadRequest)
+			return
+		}
+	} else {
+		p.Text = strings.TrimRight(string(body), "\r\n")
+	}
+	if p.Nick != "" && s.role < roleAdmin {
+		http.Error(w, "admin access required for nick override", http.StatusForbidden)
+		return
+	}
+	ident, err := g.identityFor(s)
+	if err != nil {
+		http.Error(w, "identity unavailable", http.StatusInternalServerError)
+		return
+	}
+	release, err := g.holdRoom(room)
+	if err != nil {
+		http.Error(w, "join failed: "+err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	defer release()
+	if p.Text == "" && p.Attachment != nil {
+		p.Text = p.Attachment.Name
+	}
+	cm, err := g.publish(r.Context(), room, ChatMsg{From: p.Nick, Text: p.Text, Kind: p.Kind, Ref: p.Ref, Remove: p.Remove, Attachment: p.Attachment}, ident)
+	if err != nil {
+		if errors.As(err, new(rejectError)) {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		log.Println("topic.Publish:", err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(cm)
+}
+
+// holdRoom keeps room joined until the returned func is called, through a
+// client that only exists to hold it.
+func (g *Gateway) holdRoom(room string) (func(), error) {
+	c := &WSClient{send: make(chan []byte, 1), rooms: map[string]bool{}}
+	g.mu.Lock()
+	if g.closing {
+		g.mu.Unlock()
+		return nil, errors.New("gateway is shutting down")
+	}
+	g.clients[c] = true
+	g.mu.Unlock()
+	if _, err := g.joinRoom(c, room); err != nil {
+		g.dropClient(c)
+		return nil, err
+	}
+	return func() { g.dropClient(c) }, nil
+}
+
+// handleModerate publishes a moderation action given as a JSON
+// moderatePayload. Whether the caller may take it is up to the room's
+// roles, not the gateway role.
+func (g *Gateway) handleModerate(w http.ResponseWriter, r *http.Request, room string) {
+	s := sessionFrom(r)
+	if s.role < roleWrite {
+		http.Error(w, "write access required", http.StatusForbidden)
+		return
+	}
+	var p moderatePayload
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRESTMessage)).Decode(&p); err != nil || p.Action == "" {
+		http.Error(w, "moderation requires a JSON body with action", http.StatusBadRequest)
+		return
+	}
+	ident, err := g.identityFor(s)
+	if err != nil {
+		http.Error(w, "identity unavailable", http.StatusInternalServerError)
+		return
+	}
+	g.mu.RLock()
+	_, joined := g.rooms[room]
+	g.mu.RUnlock()
+	if !joined {
+		http.Error(w, "room not joined; open a websocket or event stream to it first", http.StatusNotFound)
+		return
+	}
+	cm, err := g.moderate(r.Context(), room, p, ident)
+	if err != nil {
+		if errors.As(err, new(rejectError)) {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		log.Println("moderate:", err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(cm)
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	libp2ptls "github.com/libp2p/go-libp2p/p2p/security/tls"
+)
+
+// Gateway TLS modes.
+const (
+	tlsOff        = "off"
+	tlsFile       = "file"        // certificate and key from PEM files
+	tlsSelfSigned = "self-signed" // generated once and kept in the data dir
+	tlsPeer       = "peer"        // self-signed, bound to the libp2p key
+)
+
+const (
+	selfSignedValidity = 365 * 24 * time.Hour
+	selfSignedRenew    = 30 * 24 * time.Hour // regenerate this long before expiry
+)
+
+// GatewayTLS configures HTTPS/WSS for the web gateway.
+type GatewayTLS struct {
+	Mode     string   `yaml:"mode"`
+	CertFile string   `yaml:"cert_file"`
+	KeyFile  string   `yaml:"key_file"`
+	Hosts    []string `yaml:"hosts"` // extra names for generated certificates
+}
+
+// loadGatewayTLS builds the gateway's TLS config from cfg and the
+// GATEWAY_TLS* env vars. It returns nil when TLS is off.
+func loadGatewayTLS(cfg GatewayTLS, hostKey crypto.PrivKey, dir string) (*tls.Config, error) {
+	mode := strings.ToLower(firstNonEmpty(os.Getenv("GATEWAY_TLS"), cfg.Mode))
+	certFile := firstNonEmpty(os.Getenv("GATEWAY_TLS_CERT"), cfg.CertFile)
+	keyFile := firstNonEmpty(os.Getenv("GATEWAY_TLS_KEY"), cfg.KeyFile)
+	hosts := cfg.Hosts
+	if v := os.Getenv("GATEWAY_TLS_HOSTS"); v != "" {
+		hosts = strings.Split(v, ",")
+	}
+	if mode == "" && certFile != "" {
+		mode = tlsFile
+	}
+
+	conf := &tls.Config{MinVersion: tls.VersionTLS12}
+	switch mode {
+	case "", tlsOff:
+		return nil, nil
+	case tlsFile:
+		if certFile == "" || keyFile == "" {
+			return nil, errors.New("tls mode file needs GATEWAY_TLS_CERT and GATEWAY_TLS_KEY")
+		}
+		kp := &keyPairReloader{certFile: certFile, keyFile: keyFile}
+		if _, err := kp.GetCertificate(nil); err != nil {
+			return nil, err
+		}
+		conf.GetCertificate = kp.GetCertificate
+	case tlsSelfSigned:
+		cert, err := loadSelfSigned(dir, hosts)
+		if err != nil {
+			return nil, err
+		}
+		conf.Certificates = []tls.Certificate{*cert}
+	case tlsPeer:
+		cert, err := peerCertificate(hostKey, hosts)
+		if err != nil {
+			return nil, err
+		}
+		conf.Certificates = []tls.Certificate{*cert}
+	default:
+		return nil, fmt.Errorf("unknown gateway tls mode %q", mode)
+	}
+	if len(conf.Certificates) > 0 {
+		log.Printf("🔒 gateway TLS (%s) certificate sha256 %s", mode, certFingerprint(conf.Certificates[0].Certificate[0]))
+	}
+	return conf, nil
+}
+
+// keyPairReloader serves a certificate from files and picks up renewals
+// (e.g. by certbot) without a restart.
+type keyPairReloader struct {
+	certFile, keyFile string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+func (k *keyPairReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	st, err := os.Stat(k.certFile)
+	if err != nil {
+		if k.cert != nil {
+			return k.cert, nil
+		}
+		return nil, err
+	}
+	if k.cert != nil && st.ModTime().Equal(k.modTime) {
+		return k.cert, nil
+	}
+	cert, err := tls.LoadX509KeyPair(k.certFile, k.keyFile)
+	if err != nil {
+		if k.cert != nil {
+			log.Println("gateway tls reload:", err)
+			return k.cert, nil
+		}
+		return nil, err
+	}
+	k.cert, k.modTime = &cert, st.ModTime()
+	return k.cert, nil
+}
+
+// loadSelfSigned returns the self-signed certificate kept in dir, creating
+// or renewing it as needed so browsers only have to accept it once a year.
+func loadSelfSigned(dir string, hosts []string) (*tls.Certificate, error) {
+	certPath := filepath.Join(dir, "gateway_cert.pem")
+	keyPath := filepath.Join(dir, "gateway_key.pem")
+	if cert, err := tls.LoadX509KeyPair(certPath, keyPath); err == nil {
+		if leaf, err := x509.ParseCertificate(cert.Certificate[0]); err == nil && time.Until(leaf.NotAfter) > selfSignedRenew {
+			return &cert, nil
+		}
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	tmpl, err := certTemplate(hosts)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		return nil, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644); err != nil {
+		return nil, err
+	}
+	log.Println("gateway tls: generated self-signed certificate", certPath)
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+// peerCertificate creates a certificate carrying the libp2p TLS extension,
+// which signs the certificate key with the node's identity key. Clients can
+// pin the gateway by PeerID: libp2ptls.PubKeyFromCertChain on the served
+// chain yields the node's public key. The certificate key itself is
+// ephemeral, so it changes on every start while the PeerID stays the same.
+func peerCertificate(hostKey crypto.PrivKey, hosts []string) (*tls.Certificate, error) {
+	if hostKey == nil {
+		return nil, errors.New("tls mode peer needs the node key")
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	ext, err := libp2ptls.GenerateSignedExtension(hostKey, key.Public())
+	if err != nil {
+		return nil, err
+	}
+	tmpl, err := certTemplate(hosts)
+	if err != nil {
+		return nil, err
+	}
+	tmpl.ExtraExtensions = append(tmpl.ExtraExtensions, ext)
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+// certTemplate is a server certificate for localhost, this machine's
+// hostname and any extra hosts (names or IPs).
+func certTemplate(hosts []string) (*x509.Certificate, error) {
+	sn, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 62))
+	if err != nil {
+		return nil, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: sn,
+		Subject:      pkix.Name{CommonName: "p2p-mesh gateway"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(selfSignedValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	if name, err := os.Hostname(); err == nil && name != "" {
+		tmpl.DNSNames = append(tmpl.DNSNames, name)
+	}
+	for _, h := range hosts {
+		h = strings.TrimSpace(h)
+		if ip := net.ParseIP(h); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else if h != "" {
+			tmpl.DNSNames = append(tmpl.DNSNames, h)
+		}
+	}
+	return tmpl, nil
+}
+
+func certFingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,422 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"golang.org/x/time/rate"
+)
+
+const (
+	defaultMaxMessageSize = 64 << 10
+	defaultMaxTextLength  = 16 << 10
+	defaultMaxClockSkew   = 5 * time.Minute
+	defaultRateLimit      = 5 // messages per second
+	defaultRateBurst      = 20
+	maxNickLength         = 64
+	maxMsgIDLength        = 64
+	maxRelayAnnounce      = 4 << 10
+	limiterIdle           = 10 * time.Minute // unused rate limiters are dropped after this
+	// presence allows twice the heartbeats of a node with maxRosterPerPeer
+	// members, to leave room for typing and status changes
+	presenceRateLimit = 2 * maxRosterPerPeer / float64(presenceInterval/time.Second) // per second
+	presenceRateBurst = 2 * maxRosterPerPeer
+)
+
+var (
+	errTooLarge   = errors.New("message too large")
+	errTextLength = errors.New("message text too long")
+	errClockSkew  = errors.New("timestamp too far from local clock")
+	errBadFrom    = errors.New("nick missing or too long")
+	errBadMsgID   = errors.New("invalid msg_id")
+	errBadStatus  = errors.New("invalid presence status")
+	errBadPeer    = errors.New("presence peer does not match sender")
+	errRateLimit  = errors.New("rate limit exceeded, slow down")
+)
+
+// PubSubConfig is the "pubsub" section of config.yaml: the limits topic
+// validators apply before a message is forwarded, and peer scoring.
+type PubSubConfig struct {
+	MaxMessageSize int         `yaml:"max_message_size"` // bytes per pubsub message
+	MaxTextLength  int         `yaml:"max_text_length"`  // bytes of message text
+	MaxClockSkew   string      `yaml:"max_clock_skew"`   // e.g. "5m"
+	RateLimit      float64     `yaml:"rate_limit"`       // chat messages per second per origin peer and room
+	RateBurst      int         `yaml:"rate_burst"`
+	PeerScoring    PeerScoring `yaml:"peer_scoring"`
+}
+
+// PeerScoring configures GossipSub peer scoring. Invalid messages lower the
+// score of the peer that delivered them; below the thresholds a peer is no
+// longer gossiped with, no longer published to, and finally ignored.
+type PeerScoring struct {
+	Enabled           *bool   `yaml:"enabled"` // default true
+	InvalidWeight     float64 `yaml:"invalid_weight"`
+	GossipThreshold   float64 `yaml:"gossip_threshold"`
+	PublishThreshold  float64 `yaml:"publish_threshold"`
+	GraylistThreshold float64 `yaml:"graylist_threshold"`
+}
+
+// loadPubSubConfig applies the PUBSUB_* env vars over cfg and fills in
+// defaults.
+func loadPubSubConfig(cfg PubSubConfig) PubSubConfig {
+	envInt := func(name string, v *int) {
+		if n, err := strconv.Atoi(os.Getenv(name)); err == nil && n > 0 {
+			*v = n
+		}
+	}
+	envInt("PUBSUB_MAX_MESSAGE_SIZE", &cfg.MaxMessageSize)
+	envInt("PUBSUB_MAX_TEXT_LENGTH", &cfg.MaxTextLength)
+	envInt("PUBSUB_RATE_BURST", &cfg.RateBurst)
+	if f, err := strconv.ParseFloat(os.Getenv("PUBSUB_RATE_LIMIT"), 64); err == nil && f > 0 {
+		cfg.RateLimit = f
+	}
+	cfg.MaxClockSkew = firstNonEmpty(os.Getenv("PUBSUB_MAX_CLOCK_SKEW"), cfg.MaxClockSkew)
+	if v, err := strconv.ParseBool(os.Getenv("PUBSUB_PEER_SCORING")); err == nil {
+		cfg.PeerScoring.Enabled = &v
+	}
+
+	if cfg.MaxMessageSize <= 0 {
+		cfg.MaxMessageSize = defaultMaxMessageSize
+	}
+	if cfg.MaxTextLength <= 0 {
+		cfg.MaxTextLength = defaultMaxTextLength
+	}
+	if cfg.RateLimit <= 0 {
+		cfg.RateLimit = defaultRateLimit
+	}
+	if cfg.RateBurst <= 0 {
+		cfg.RateBurst = defaultRateBurst
+	}
+	if d, err := time.ParseDuration(cfg.MaxClockSkew); err != nil || d <= 0 {
+		cfg.MaxClockSkew = defaultMaxClockSkew.String()
+	}
+	ps := &cfg.PeerScoring
+	if ps.Enabled == nil {
+		on := true
+		ps.Enabled = &on
+	}
+	if ps.InvalidWeight >= 0 {
+		ps.InvalidWeight = -10
+	}
+	if ps.GossipThreshold >= 0 {
+		ps.GossipThreshold = -10
+	}
+	if ps.PublishThreshold >= 0 || ps.PublishThreshold > ps.GossipThreshold {
+		ps.PublishThreshold = min(-50, ps.GossipThreshold)
+	}
+	if ps.GraylistThreshold >= 0 || ps.GraylistThreshold > ps.PublishThreshold {
+		ps.GraylistThreshold = min(-80, ps.PublishThreshold)
+	}
+	return cfg
+}
+
+// topicGuard validates messages on the node's topics. Pubsub runs the
+// validators before delivering a message or forwarding it, so rejected
+// messages stop at the first honest node and count against the peer that
+// sent them.
+type topicGuard struct {
+	cfg  PubSubConfig
+	skew time.Duration
+	self peer.ID
+	mods *moderationStore
+
+	mu         sync.Mutex
+	registered map[string]bool
+	limiters   map[string]*peerLimiter // keyed by topic and origin peer
+	relaySeen  map[peer.ID]int64       // issue time of the last accepted record per relay
+	pruned     time.Time
+}
+
+// ignoreError marks a message this node drops without blaming the sender,
+// because the sender's node may lack the state that rules it out.
+type ignoreError struct{ error }
+
+func (e ignoreError) Unwrap() error { return e.error }
+
+type peerLimiter struct {
+	*rate.Limiter
+	used time.Time
+}
+
+func newTopicGuard(cfg PubSubConfig, self peer.ID, mods *moderationStore) *topicGuard {
+	skew, _ := time.ParseDuration(cfg.MaxClockSkew)
+	return &topicGuard{cfg: cfg, skew: skew, self: self, mods: mods, registered: map[string]bool{}, limiters: map[string]*peerLimiter{}, relaySeen: map[peer.ID]int64{}, pruned: time.Now()}
+}
+
+// options returns the GossipSub options for peer scoring, if enabled.
+func (tg *topicGuard) options() []pubsub.Option {
+	ps := tg.cfg.PeerScoring
+	if !*ps.Enabled {
+		return nil
+	}
+	params := &pubsub.PeerScoreParams{
+		Topics:                    map[string]*pubsub.TopicScoreParams{},
+		AppSpecificScore:          func(peer.ID) float64 { return 0 },
+		BehaviourPenaltyWeight:    -10,
+		BehaviourPenaltyThreshold: 6,
+		BehaviourPenaltyDecay:     pubsub.ScoreParameterDecay(time.Hour),
+		DecayInterval:             time.Second,
+		DecayToZero:               0.01,
+		RetainScore:               time.Hour,
+	}
+	thresholds := &pubsub.PeerScoreThresholds{
+		GossipThreshold:             ps.GossipThreshold,
+		PublishThreshold:            ps.PublishThreshold,
+		GraylistThreshold:           ps.GraylistThreshold,
+		OpportunisticGraftThreshold: 1,
+	}
+	return []pubsub.Option{pubsub.WithPeerScore(params, thresholds)}
+}
+
+// topicScore rewards peers for staying in the mesh and delivering first,
+// and penalises every invalid message they deliver.
+func (tg *topicGuard) topicScore() *pubsub.TopicScoreParams {
+	return &pubsub.TopicScoreParams{
+		TopicWeight:                    1,
+		TimeInMeshWeight:               0.01,
+		TimeInMeshQuantum:              time.Second,
+		TimeInMeshCap:                  300,
+		FirstMessageDeliveriesWeight:   1,
+		FirstMessageDeliveriesDecay:    pubsub.ScoreParameterDecay(10 * time.Minute),
+		FirstMessageDeliveriesCap:      10,
+		InvalidMessageDeliveriesWeight: tg.cfg.PeerScoring.InvalidWeight,
+		InvalidMessageDeliveriesDecay:  pubsub.ScoreParameterDecay(time.Hour),
+	}
+}
+
+// join registers the validator for topic, joins it and sets its score
+// parameters. Every topic the node joins goes through here.
+func (tg *topicGuard) join(psub *pubsub.PubSub, topic string) (*pubsub.Topic, error) {
+	tg.mu.Lock()
+	registered := tg.registered[topic]
+	tg.mu.Unlock()
+	if !registered {
+		var check func(pubsub.Message) error
+		switch {
+		case strings.HasPrefix(topic, "room:"):
+			check = tg.validateChat
+		case strings.HasPrefix(topic, "presence:"):
+			check = tg.validatePresence
+		case topic == "relays":
+			check = tg.validateRelay
+		}
+		if check != nil {
+			if err := psub.RegisterTopicValidator(topic, tg.validator(topic, check)); err != nil {
+				return nil, err
+			}
+		}
+		tg.mu.Lock()
+		tg.registered[topic] = true
+		tg.mu.Unlock()
+	}
+	t, err := psub.Join(topic)
+	if err != nil {
+		return nil, err
+	}
+	if *tg.cfg.PeerScoring.Enabled {
+		if err := t.SetScoreParams(tg.topicScore()); err != nil {
+			log.Println("topic score:", err)
+		}
+	}
+	return t, nil
+}
+
+// validator wraps check with the size limit and the rate limit. Flooding
+// is rejected when the flooder delivered the messages itself and ignored
+// otherwise, so forwarding peers are not penalised. The node's own
+// messages are limited before publishing instead; see allowOwn.
+func (tg *topicGuard) validator(topic string, check func(pubsub.Message) error) func(context.Context, peer.ID, *pubsub.Message) pubsub.ValidationResult {
+	return func(_ context.Context, from peer.ID, msg *pubsub.Message) pubsub.ValidationResult {
+		if len(msg.Data) > tg.cfg.MaxMessageSize {
+			return pubsub.ValidationReject
+		}
+		origin := msg.GetFrom()
+		if origin != tg.self && !tg.allow(topic, origin) {
+			if from == origin {
+				return pubsub.ValidationReject
+			}
+			return pubsub.ValidationIgnore
+		}
+		if err := check(*msg); err != nil {
+			if errors.As(err, new(ignoreError)) {
+				return pubsub.ValidationIgnore
+			}
+			return pubsub.ValidationReject
+		}
+		return pubsub.ValidationAccept
+	}
+}
+
+// allow takes a token from the origin's bucket for topic. Presence topics
+// have their own limit, sized for a node with maxRosterPerPeer users.
+func (tg *topicGuard) allow(topic string, origin peer.ID) bool {
+	now := time.Now()
+	key := topic + "/" + origin.String()
+	tg.mu.Lock()
+	defer tg.mu.Unlock()
+	if now.Sub(tg.pruned) > limiterIdle {
+		for k, l := range tg.limiters {
+			if now.Sub(l.used) > limiterIdle {
+				delete(tg.limiters, k)
+			}
+		}
+		for id, issued := range tg.relaySeen {
+			if now.Sub(time.Unix(issued, 0)) > maxRecordTTL {
+				delete(tg.relaySeen, id)
+			}
+		}
+		tg.pruned = now
+	}
+	l, ok := tg.limiters[key]
+	if !ok {
+		limit, burst := rate.Limit(tg.cfg.RateLimit), tg.cfg.RateBurst
+		if strings.HasPrefix(topic, "presence:") {
+			limit, burst = rate.Limit(presenceRateLimit), presenceRateBurst
+		}
+		l = &peerLimiter{Limiter: rate.NewLimiter(limit, burst)}
+		tg.limiters[key] = l
+	}
+	l.used = now
+	return l.AllowN(now, 1)
+}
+
+// allowOwn applies the rate limit other nodes enforce to a message this
+// node is about to publish, so that it refuses the message rather than
+// being penalised by its peers for it.
+func (tg *topicGuard) allowOwn(topic string) error {
+	if !tg.allow(topic, tg.self) {
+		return errRateLimit
+	}
+	return nil
+}
+
+// checkTs bounds a message timestamp to the allowed clock skew.
+func (tg *topicGuard) checkTs(ts int64) error {
+	d := time.Since(time.Unix(ts, 0))
+	if d > tg.skew || -d > tg.skew {
+		return errClockSkew
+	}
+	return nil
+}
+
+// checkChat checks the parts of a chat message that need no room history:
+// the schema, text length, timestamp and user signature. The gateway runs
+// it before publishing so that its clients get the reason for a refusal.
+func (tg *topicGuard) checkChat(cm ChatMsg) error {
+	if cm.From == "" || len(cm.From) > maxNickLength {
+		return errBadFrom
+	}
+	if len(cm.Text) > tg.cfg.MaxTextLength {
+		return errTextLength
+	}
+	if cm.MsgID != "" {
+		if _, err := hex.DecodeString(cm.MsgID); err != nil || len(cm.MsgID) > maxMsgIDLength {
+			return errBadMsgID
+		}
+	}
+	switch cm.Kind {
+	case kindText, kindReply, kindEdit, kindDelete, kindReaction:
+		if cm.Mod != nil {
+			return errModAction
+		}
+	case kindModerate:
+		if err := checkModMsg(cm.Room, cm); err != nil {
+			return err
+		}
+	default:
+		return errUnknownKind
+	}
+	if cm.Kind != kindText && cm.Kind != kindModerate && cm.Ref == "" {
+		return errRefMissing
+	}
+	if err := tg.checkTs(cm.Ts); err != nil {
+		return err
+	}
+	return verifyMsg(cm)
+}
+
+// validateChat decodes a room message the way consume does and checks it,
+// then applies the room's moderation as far as this node knows it.
+func (tg *topicGuard) validateChat(msg pubsub.Message) error {
+	var cm ChatMsg
+	if err := json.Unmarshal(msg.Data, &cm); err != nil {
+		return err
+	}
+	cm.ID = msg.GetFrom().String()
+	cm.Room = strings.TrimPrefix(msg.GetTopic(), "room:")
+	if err := tg.checkChat(cm); err != nil {
+		return err
+	}
+	if cm.Kind == kindModerate {
+		if cm.Mod.Action != modSync && tg.mods.known(cm.Room) {
+			if err := tg.mods.authorize(cm.Room, cm); err != nil {
+				return ignoreError{err}
+			}
+		}
+		return nil
+	}
+	if banned, muted := tg.mods.restricted(cm.Room, cm.User, cm.ID); banned || muted {
+		return ignoreError{errMuted}
+	}
+	return nil
+}
+
+func (tg *topicGuard) validatePresence(msg pubsub.Message) error {
+	var pm PresenceMsg
+	if err := json.Unmarshal(msg.Data, &pm); err != nil {
+		return err
+	}
+	if len(pm.Nick) > maxNickLength {
+		return errBadFrom
+	}
+	if pm.Peer != "" && pm.Peer != msg.GetFrom().String() {
+		return errBadPeer
+	}
+	switch pm.Status {
+	case "", statusOnline, statusAway, statusOffline:
+	default:
+		return errBadStatus
+	}
+	if err := tg.checkTs(pm.Ts); err != nil {
+		return err
+	}
+	return verifyPresence(strings.TrimPrefix(msg.GetTopic(), "presence:"), pm)
+}
+
+// validateRelay accepts relay records signed by the relay and issued
+// recently, at most one per relay every relayRecordMinGap. Repeats and
+// records arriving too soon are ignored rather than rejected, since any
+// node holding a reservation may vouch for the same relay.
+func (tg *topicGuard) validateRelay(msg pubsub.Message) error {
+	if len(msg.Data) > maxRelayAnnounce {
+		return errTooLarge
+	}
+	rec, err := parseRelayAnnouncement(msg.Data)
+	if err != nil {
+		return err
+	}
+	if err := tg.checkTs(rec.Issued); err != nil {
+		return err
+	}
+	tg.mu.Lock()
+	defer tg.mu.Unlock()
+	last, ok := tg.relaySeen[rec.id]
+	switch {
+	case ok && rec.Issued <= last:
+		return ignoreError{errStaleRecord}
+	case ok && time.Unix(rec.Issued, 0).Sub(time.Unix(last, 0)) < relayRecordMinGap:
+		return ignoreError{errRecordRate}
+	}
+	tg.relaySeen[rec.id] = rec.Issued
+	return nil
+}
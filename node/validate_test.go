@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	pb "github.com/libp2p/go-libp2p-pubsub/pb"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+func testPeer(t *testing.T) (peer.ID, crypto.PrivKey) {
+	t.Helper()
+	key, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := peer.IDFromPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id, key
+}
+
+func testGuard(t *testing.T) *topicGuard {
+	t.Helper()
+	self, _ := testPeer(t)
+	return newTopicGuard(loadPubSubConfig(PubSubConfig{}), self, newModerationStore(t.TempDir()))
+}
+
+func testMsg(topic string, from peer.ID, v any) pubsub.Message {
+	data, _ := json.Marshal(v)
+	return pubsub.Message{Message: &pb.Message{Data: data, Topic: &topic, From: []byte(from)}}
+}
+
+func TestValidatePresence(t *testing.T) {
+	tg := testGuard(t)
+	node, _ := testPeer(t)
+	u := testIdents(t, 1)[0]
+	now := time.Now().Unix()
+
+	signed := func(room string, edit func(*PresenceMsg)) PresenceMsg {
+		pm := PresenceMsg{Nick: "alice", Peer: node.String(), Status: statusOnline, Ts: now}
+		if err := u.signPresence(room, &pm); err != nil {
+			t.Fatal(err)
+		}
+		if edit != nil {
+			edit(&pm)
+		}
+		return pm
+	}
+
+	tests := []struct {
+		name   string
+		pm     PresenceMsg
+		want   error
+		ignore bool
+	}{
+		{"node heartbeat", PresenceMsg{Nick: "node", Peer: node.String(), Ts: now}, nil, false},
+		{"signed user heartbeat", signed(testRoom, nil), nil, false},
+		{"user without signature", PresenceMsg{Nick: "alice", User: u.id, Ts: now}, errBadSig, true},
+		{"forged user", signed(testRoom, func(pm *PresenceMsg) { pm.User = node.String() }), errBadSig, false},
+		{"changed nick", signed(testRoom, func(pm *PresenceMsg) { pm.Nick = "mallory" }), errBadSig, false},
+		{"replayed from another room", signed("other", nil), errBadSig, false},
+		{"signature without user", PresenceMsg{Nick: "node", Ts: now, Sig: []byte{1}}, errBadSig, false},
+		{"other node's peer", PresenceMsg{Nick: "node", Peer: u.id, Ts: now}, errBadPeer, false},
+		{"unknown status", PresenceMsg{Nick: "node", Status: "busy", Ts: now}, errBadStatus, false},
+		{"old timestamp", PresenceMsg{Nick: "node", Ts: now - 3600}, errClockSkew, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tg.validatePresence(testMsg("presence:"+testRoom, node, tt.pm))
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("validatePresence = %v, want %v", err, tt.want)
+			}
+			if ignored := errors.As(err, new(ignoreError)); ignored != tt.ignore {
+				t.Errorf("ignored = %v, want %v", ignored, tt.ignore)
+			}
+		})
+	}
+}
+
+func TestValidatorRateLimit(t *testing.T) {
+	tests := []struct {
+		topic string
+		check func(*topicGuard, pubsub.Message) error
+		msg   any
+		burst int
+	}{
+		{"room:" + testRoom, (*topicGuard).validateChat, ChatMsg{From: "bob", Text: "hi", Ts: time.Now().Unix()}, defaultRateBurst},
+		{"presence:" + testRoom, (*topicGuard).validatePresence, PresenceMsg{Nick: "bob", Ts: time.Now().Unix()}, presenceRateBurst},
+	}
+	for _, tt := range tests {
+		t.Run(tt.topic, func(t *testing.T) {
+			tg := testGuard(t)
+			validate := tg.validator(tt.topic, func(msg pubsub.Message) error { return tt.check(tg, msg) })
+			origin, _ := testPeer(t)
+			forwarder, _ := testPeer(t)
+			msg := testMsg(tt.topic, origin, tt.msg)
+			for i := 0; i < tt.burst; i++ {
+				if res := validate(context.Background(), origin, &msg); res != pubsub.ValidationAccept {
+					t.Fatalf("message %d: %v, want accept", i, res)
+				}
+			}
+			if res := validate(context.Background(), origin, &msg); res != pubsub.ValidationReject {
+				t.Errorf("flood from origin: %v, want reject", res)
+			}
+			if res := validate(context.Background(), forwarder, &msg); res != pubsub.ValidationIgnore {
+				t.Errorf("flood forwarded: %v, want ignore", res)
+			}
+		})
+	}
+}
+
+func TestRosterPerPeerCap(t *testing.T) {
+	r := newRoster()
+	a, _ := testPeer(t)
+	b, _ := testPeer(t)
+	now := time.Now()
+	for i := 0; i < maxRosterPerPeer; i++ {
+		newPeer, _, _, err := r.update(a, PresenceMsg{Nick: "u", User: fmt.Sprint(i)}, now)
+		if err != nil {
+			t.Fatalf("member %d: %v", i, err)
+		}
+		if newPeer != (i == 0) {
+			t.Errorf("member %d: newPeer = %v", i, newPeer)
+		}
+	}
+	if _, _, _, err := r.update(a, PresenceMsg{Nick: "u", User: "one more"}, now); !errors.Is(err, errRosterFull) {
+		t.Errorf("member over the cap: %v, want %v", err, errRosterFull)
+	}
+	if _, _, _, err := r.update(a, PresenceMsg{Nick: "renamed", User: "0"}, now); err != nil {
+		t.Errorf("known member: %v", err)
+	}
+	if newPeer, _, _, err := r.update(b, PresenceMsg{Nick: "v"}, now); err != nil || !newPeer {
+		t.Errorf("other node: newPeer %v, err %v", newPeer, err)
+	}
+	if n := len(r.list()); n != maxRosterPerPeer+1 {
+		t.Errorf("roster has %d members, want %d", n, maxRosterPerPeer+1)
+	}
+}
+
+// testAnnouncement signs a relay record for the relay with key.
+func testAnnouncement(t *testing.T, key crypto.PrivKey, edit func(*relayRecord)) []byte {
+	t.Helper()
+	id, err := peer.IDFromPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	rec := relayRecord{Peer: id.String(), Addrs: []string{"/ip4/192.0.2.1/tcp/4001"}, Capacity: 10,
+		Issued: now.Unix(), Expires: now.Add(30 * time.Minute).Unix()}
+	if edit != nil {
+		edit(&rec)
+	}
+	body, _ := json.Marshal(rec)
+	sig, err := key.Sign(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := json.Marshal(relayAnnouncement{Record: body, Sig: sig})
+	return data
+}
+
+func TestValidateRelay(t *testing.T) {
+	_, key := testPeer(t)
+	_, other := testPeer(t)
+	now := time.Now()
+	forged := testAnnouncement(t, other, nil)
+	var ann relayAnnouncement
+	_ = json.Unmarshal(testAnnouncement(t, key, nil), &ann)
+	ann.Sig = mustUnmarshalAnn(t, forged).Sig
+
+	tests := []struct {
+		name   string
+		data   []byte
+		want   error
+		ignore bool
+	}{
+		{"fresh record", testAnnouncement(t, key, nil), nil, false},
+		{"repeat", testAnnouncement(t, key, nil), errStaleRecord, true},
+		{"too soon", testAnnouncement(t, key, func(r *relayRecord) { r.Issued++ }), errRecordRate, true},
+		{"after the gap", testAnnouncement(t, key, func(r *relayRecord) { r.Issued += int64(relayRecordMinGap / time.Second) }), nil, false},
+		{"signed by another key", mustMarshal(ann), errRecordSig, false},
+		{"issued in the future", testAnnouncement(t, other, func(r *relayRecord) {
+			r.Issued, r.Expires = now.Add(time.Hour).Unix(), now.Add(time.Hour+time.Minute).Unix()
+		}), errBadRecord, false},
+		{"issued beyond the topic's skew", testAnnouncement(t, other, func(r *relayRecord) {
+			r.Issued, r.Expires = now.Add(-50*time.Minute).Unix(), now.Add(5*time.Minute).Unix()
+		}), errClockSkew, false},
+		{"expires too far ahead", testAnnouncement(t, other, func(r *relayRecord) {
+			r.Expires = now.Add(maxRecordTTL + time.Minute).Unix()
+		}), errBadRecord, false},
+		{"expired", testAnnouncement(t, other, func(r *relayRecord) { r.Expires = now.Add(-time.Minute).Unix() }), errBadRecord, false},
+		{"circuit address", testAnnouncement(t, other, func(r *relayRecord) {
+			r.Addrs = []string{"/ip4/192.0.2.1/tcp/4001/p2p/" + r.Peer + "/p2p-circuit"}
+		}), errBadRecord, false},
+	}
+	tg := testGuard(t)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			topic := "relays"
+			msg := pubsub.Message{Message: &pb.Message{Data: tt.data, Topic: &topic}}
+			err := tg.validateRelay(msg)
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("validateRelay = %v, want %v", err, tt.want)
+			}
+			if ignored := errors.As(err, new(ignoreError)); ignored != tt.ignore {
+				t.Errorf("ignored = %v, want %v", ignored, tt.ignore)
+			}
+		})
+	}
+}
+
+func mustUnmarshalAnn(t *testing.T, data []byte) relayAnnouncement {
+	t.Helper()
+	var ann relayAnnouncement
+	if err := json.Unmarshal(data, &ann); err != nil {
+		t.Fatal(err)
+	}
+	return ann
+}
+
+func mustMarshal(v any) []byte {
+	b, _ := json.Marshal(v)
+	return b
+}
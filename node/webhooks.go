@@ -0,0 +1,493 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// Webhook event types.
+const (
+	eventMessage    = "message"
+	eventPeerJoined = "peer.joined"
+	eventPeerLeft   = "peer.left"
+	eventRelayLost  = "relay.lost"
+)
+
+const (
+	webhookTimeout     = 10 * time.Second
+	webhookMaxAttempts = 8
+	webhookBackoffMax  = 5 * time.Minute
+	webhookLogSize     = 200  // delivery records kept for /webhooks/deliveries
+	webhookInbox       = 256  // events buffered between emitters and the router
+	webhookMaxPending  = 1000 // deliveries queued per webhook before the oldest are dropped
+)
+
+// Webhook subscribes an HTTP endpoint to mesh events.
+type Webhook struct {
+	Name   string   `yaml:"name" json:"name"`
+	URL    string   `yaml:"url" json:"url"`
+	Secret string   `yaml:"secret" json:"-"`
+	Events []string `yaml:"events" json:"events,omitempty"` // empty means all
+	Rooms  []string `yaml:"rooms" json:"rooms,omitempty"`   // filters message events; empty means all
+}
+
+func (wh Webhook) wants(ev webhookEvent) bool {
+	if len(wh.Events) > 0 && !slices.Contains(wh.Events, ev.Type) {
+		return false
+	}
+	return ev.Room == "" || len(wh.Rooms) == 0 || slices.Contains(wh.Rooms, ev.Room)
+}
+
+// webhookEvent is the JSON body POSTed to subscribers.
+type webhookEvent struct {
+	ID      string   `json:"id"`
+	Type    string   `json:"type"`
+	Ts      int64    `json:"ts"`
+	Node    string   `json:"node"`
+	Room    string   `json:"room,omitempty"`
+	Message *ChatMsg `json:"message,omitempty"`
+	Peer    string   `json:"peer,omitempty"`
+	Addr    string   `json:"addr,omitempty"`
+}
+
+// delivery is one event queued for one webhook. It is kept on disk until it
+// was delivered or given up, so pending events survive restarts.
+type delivery struct {
+	ID       string          `json:"id"`
+	Hook     string          `json:"hook"`
+	Event    string          `json:"event"`
+	Body     json.RawMessage `json:"body"`
+	Attempts int             `json:"attempts"`
+	Created  int64           `json:"created"`
+	Next     int64           `json:"next,omitempty"` // unix nanoseconds of the next retry
+}
+
+// deliveryRecord is one attempt as reported by the delivery log.
+type deliveryRecord struct {
+	ID      string `json:"id"`
+	Hook    string `json:"hook"`
+	Event   string `json:"event"`
+	Attempt int    `json:"attempt"`
+	Status  int    `json:"status,omitempty"` // HTTP status, if any
+	Error   string `json:"error,omitempty"`
+	Result  string `json:"result"` // delivered, retrying, failed or dropped
+	Ts      int64  `json:"ts"`
+}
+
+// hookWorker delivers the events of one webhook. New deliveries wait in
+// queue in order; one that failed waits in retry until its backoff is over,
+// so a failing event does not hold up the ones behind it. Together they
+// hold at most webhookMaxPending deliveries.
+type hookWorker struct {
+	hook    Webhook
+	mu      sync.Mutex
+	queue   []*delivery
+	retry   []*delivery
+	dropped int64
+	wake    chan struct{}
+}
+
+// push queues d, as a retry if it was attempted before, and returns the
+// oldest pending delivery if it had to be dropped to make room.
+func (w *hookWorker) push(d *delivery) *delivery {
+	w.mu.Lock()
+	var dropped *delivery
+	if len(w.queue)+len(w.retry) >= webhookMaxPending {
+		dropped = w.dropOldest()
+	}
+	if d.Attempts > 0 {
+		w.retry = append(w.retry, d)
+	} else {
+		w.queue = append(w.queue, d)
+	}
+	w.mu.Unlock()
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+	return dropped
+}
+
+// dropOldest removes the pending delivery created first. w.mu must be held.
+func (w *hookWorker) dropOldest() *delivery {
+	oldest := -1
+	for i, d := range w.retry {
+		if oldest < 0 || d.Created < w.retry[oldest].Created {
+			oldest = i
+		}
+	}
+	var d *delivery
+	if oldest >= 0 && (len(w.queue) == 0 || w.retry[oldest].Created < w.queue[0].Created) {
+		d = w.retry[oldest]
+		w.retry = slices.Delete(w.retry, oldest, oldest+1)
+	} else {
+		d = w.queue[0]
+		w.queue = w.queue[1:]
+	}
+	w.dropped++
+	return d
+}
+
+// next takes the delivery to attempt now: a retry that is due, else the
+// oldest new one. With nothing to send it returns how long until the next
+// retry is due, or 0 if none is waiting.
+func (w *hookWorker) next(now time.Time) (*delivery, time.Duration) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var wait time.Duration
+	for i, d := range w.retry {
+		due := time.Unix(0, d.Next).Sub(now)
+		if due <= 0 {
+			w.retry = slices.Delete(w.retry, i, i+1)
+			return d, 0
+		}
+		if wait == 0 || due < wait {
+			wait = due
+		}
+	}
+	if len(w.queue) > 0 {
+		d := w.queue[0]
+		w.queue = w.queue[1:]
+		return d, 0
+	}
+	return nil, wait
+}
+
+func (w *hookWorker) pending() (pending int, dropped int64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return len(w.queue) + len(w.retry), w.dropped
+}
+
+// webhookDispatcher fans events out to the matching webhooks.
+type webhookDispatcher struct {
+	dir     string
+	node    string
+	client  *http.Client
+	in      chan webhookEvent
+	workers []*hookWorker
+
+	mu  sync.Mutex
+	log []deliveryRecord
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// loadWebhooks merges the configured webhooks with the one described by
+// WEBHOOK_URL, WEBHOOK_SECRET, WEBHOOK_EVENTS and WEBHOOK_ROOMS.
+func loadWebhooks(cfg []Webhook) []Webhook {
+	hooks := append([]Webhook(nil), cfg...)
+	if u := os.Getenv("WEBHOOK_URL"); u != "" {
+		wh := Webhook{Name: "env", URL: u, Secret: os.Getenv("WEBHOOK_SECRET")}
+		if v := os.Getenv("WEBHOOK_EVENTS"); v != "" {
+			wh.Events = strings.Split(v, ",")
+		}
+		if v := os.Getenv("WEBHOOK_ROOMS"); v != "" {
+			wh.Rooms = strings.Split(v, ",")
+		}
+		hooks = append(hooks, wh)
+	}
+	var out []Webhook
+	seen := map[string]bool{}
+	for i, wh := range hooks {
+		if wh.Name == "" {
+			wh.Name = "hook-" + strconv.Itoa(i+1)
+		}
+		u, err := url.Parse(wh.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			log.Printf("webhook %q ignored: invalid url %q", wh.Name, wh.URL)
+			continue
+		}
+		if seen[wh.Name] {
+			log.Printf("webhook %q ignored: duplicate name", wh.Name)
+			continue
+		}
+		seen[wh.Name] = true
+		out = append(out, wh)
+	}
+	return out
+}
+
+func newWebhookDispatcher(hooks []Webhook, dir string, node peer.ID) *webhookDispatcher {
+	d := &webhookDispatcher{
+		dir:    dir,
+		node:   node.String(),
+		client: &http.Client{Timeout: webhookTimeout},
+		in:     make(chan webhookEvent, webhookInbox),
+	}
+	for _, wh := range hooks {
+		d.workers = append(d.workers, &hookWorker{hook: wh, wake: make(chan struct{}, 1)})
+	}
+	return d
+}
+
+// Start reloads deliveries left over from the last run and starts the
+// router and one delivery loop per webhook.
+func (d *webhookDispatcher) Start(ctx context.Context) {
+	ctx, d.cancel = context.WithCancel(ctx)
+	for _, dl := range d.loadQueue() {
+		if w := d.worker(dl.Hook); w != nil {
+			d.enqueue(w, dl)
+		} else {
+			_ = os.Remove(d.queuePath(dl.ID))
+		}
+	}
+	d.wg.Add(1)
+	go d.route(ctx)
+	for _, w := range d.workers {
+		d.wg.Add(1)
+		go d.run(ctx, w)
+	}
+}
+
+// Close stops delivery; undelivered events stay queued on disk.
+func (d *webhookDispatcher) Close() {
+	if d.cancel != nil {
+		d.cancel()
+	}
+	d.wg.Wait()
+}
+
+// Emit queues ev for the webhooks that want it without blocking the caller.
+func (d *webhookDispatcher) Emit(ev webhookEvent) {
+	if d == nil || len(d.workers) == 0 {
+		return
+	}
+	ev.ID = newMsgID()
+	ev.Ts = time.Now().Unix()
+	ev.Node = d.node
+	select {
+	case d.in <- ev:
+	default:
+		log.Println("webhook: inbox full, dropping", ev.Type, "event")
+	}
+}
+
+func (d *webhookDispatcher) worker(name string) *hookWorker {
+	for _, w := range d.workers {
+		if w.hook.Name == name {
+			return w
+		}
+	}
+	return nil
+}
+
+func (d *webhookDispatcher) route(ctx context.Context) {
+	defer d.wg.Done()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ev := <-d.in:
+			body, _ := json.Marshal(ev)
+			for _, w := range d.workers {
+				if !w.hook.wants(ev) {
+					continue
+				}
+				dl := &delivery{ID: newMsgID(), Hook: w.hook.Name, Event: ev.Type, Body: body, Created: time.Now().UnixNano()}
+				if err := d.save(dl); err != nil {
+					log.Println("webhook queue:", err)
+				}
+				d.enqueue(w, dl)
+			}
+		}
+	}
+}
+
+// enqueue pushes dl to w and forgets the delivery dropped to make room.
+func (d *webhookDispatcher) enqueue(w *hookWorker, dl *delivery) {
+	old := w.push(dl)
+	if old == nil {
+		return
+	}
+	_ = os.Remove(d.queuePath(old.ID))
+	log.Printf("webhook %s: %d deliveries pending, dropping %s event %s", old.Hook, webhookMaxPending, old.Event, old.ID)
+	d.record(deliveryRecord{ID: old.ID, Hook: old.Hook, Event: old.Event, Attempt: old.Attempts, Result: "dropped", Ts: time.Now().Unix()})
+}
+
+// run delivers w's events, new ones in order, and retries failed ones
+// with exponential backoff in between.
+func (d *webhookDispatcher) run(ctx context.Context, w *hookWorker) {
+	defer d.wg.Done()
+	for {
+		dl, wait := w.next(time.Now())
+		if dl == nil {
+			var due <-chan time.Time
+			if wait > 0 {
+				due = time.After(wait)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-w.wake:
+			case <-due:
+			}
+			continue
+		}
+		dl.Attempts++
+		status, err := d.send(ctx, w.hook, dl)
+		if ctx.Err() != nil {
+			return
+		}
+		rec := deliveryRecord{ID: dl.ID, Hook: dl.Hook, Event: dl.Event, Attempt: dl.Attempts, Status: status, Ts: time.Now().Unix()}
+		if err != nil {
+			rec.Error = err.Error()
+		}
+		switch {
+		case err == nil:
+			rec.Result = "delivered"
+		case dl.Attempts >= webhookMaxAttempts || permanentStatus(status):
+			rec.Result = "failed"
+			log.Printf("webhook %s: giving up on %s after %d attempts: %v", dl.Hook, dl.ID, dl.Attempts, err)
+		default:
+			rec.Result = "retrying"
+		}
+		d.record(rec)
+		if rec.Result != "retrying" {
+			_ = os.Remove(d.queuePath(dl.ID))
+			continue
+		}
+		backoff := time.Second << (dl.Attempts - 1)
+		if backoff > webhookBackoffMax {
+			backoff = webhookBackoffMax
+		}
+		dl.Next = time.Now().Add(backoff).UnixNano()
+		if err := d.save(dl); err != nil {
+			log.Println("webhook queue:", err)
+		}
+		d.enqueue(w, dl)
+	}
+}
+
+// permanentStatus reports client errors that a retry will not fix.
+func permanentStatus(status int) bool {
+	return status >= 400 && status < 500 && status != http.StatusRequestTimeout && status != http.StatusTooManyRequests
+}
+
+// send POSTs one delivery. The body is signed with HMAC-SHA256 over the raw
+// bytes, sent as X-Mesh-Signature: sha256=<hex>.
+func (d *webhookDispatcher) send(ctx context.Context, wh Webhook, dl *delivery) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, wh.URL, bytes.NewReader(dl.Body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "p2p-mesh-webhook")
+	req.Header.Set("X-Mesh-Event", dl.Event)
+	req.Header.Set("X-Mesh-Delivery", dl.ID)
+	if wh.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(wh.Secret))
+		mac.Write(dl.Body)
+		req.Header.Set("X-Mesh-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return resp.StatusCode, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+func (d *webhookDispatcher) record(rec deliveryRecord) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.log = append(d.log, rec)
+	if len(d.log) > webhookLogSize {
+		d.log = d.log[len(d.log)-webhookLogSize:]
+	}
+}
+
+func (d *webhookDispatcher) queuePath(id string) string {
+	return filepath.Join(d.dir, "queue", id+".json")
+}
+
+func (d *webhookDispatcher) save(dl *delivery) error {
+	if err := os.MkdirAll(filepath.Join(d.dir, "queue"), 0o700); err != nil {
+		return err
+	}
+	b, _ := json.Marshal(dl)
+	tmp := d.queuePath(dl.ID) + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, d.queuePath(dl.ID))
+}
+
+// loadQueue reads the pending deliveries in the order they were queued.
+func (d *webhookDispatcher) loadQueue() []*delivery {
+	files, _ := filepath.Glob(filepath.Join(d.dir, "queue", "*.json"))
+	var out []*delivery
+	for _, f := range files {
+		b, err := os.ReadFile(f)
+		if err != nil {
+			continue
+		}
+		var dl delivery
+		if err := json.Unmarshal(b, &dl); err != nil || dl.ID == "" {
+			_ = os.Remove(f)
+			continue
+		}
+		out = append(out, &dl)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Created < out[j].Created })
+	return out
+}
+
+// handleDeliveries reports the webhooks with their queue length and the
+// most recent delivery attempts, newest first. ?hook= filters by webhook
+// and ?limit= bounds the number of records.
+func (d *webhookDispatcher) handleDeliveries(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	type hookStatus struct {
+		Webhook
+		Pending int   `json:"pending"`
+		Dropped int64 `json:"dropped"` // deliveries dropped because too many were pending
+	}
+	resp := struct {
+		Hooks      []hookStatus     `json:"hooks"`
+		Deliveries []deliveryRecord `json:"deliveries"`
+	}{Hooks: []hookStatus{}, Deliveries: []deliveryRecord{}}
+	for _, wk := range d.workers {
+		pending, dropped := wk.pending()
+		resp.Hooks = append(resp.Hooks, hookStatus{Webhook: wk.hook, Pending: pending, Dropped: dropped})
+	}
+	hook := r.URL.Query().Get("hook")
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit <= 0 {
+		limit = 50
+	}
+	d.mu.Lock()
+	for i := len(d.log) - 1; i >= 0 && len(resp.Deliveries) < limit; i-- {
+		if hook == "" || d.log[i].Hook == hook {
+			resp.Deliveries = append(resp.Deliveries, d.log[i])
+		}
+	}
+	d.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// hookServer records the requests it receives on a channel.
+func hookServer(t *testing.T) (*httptest.Server, chan *http.Request, chan []byte) {
+	t.Helper()
+	reqs, bodies := make(chan *http.Request, 16), make(chan []byte, 16)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		reqs <- r
+		bodies <- b
+	}))
+	t.Cleanup(srv.Close)
+	return srv, reqs, bodies
+}
+
+func receive(t *testing.T, reqs chan *http.Request, bodies chan []byte) (*http.Request, []byte) {
+	t.Helper()
+	select {
+	case r := <-reqs:
+		return r, <-bodies
+	case <-time.After(5 * time.Second):
+		t.Fatal("no delivery")
+		return nil, nil
+	}
+}
+
+func TestWebhookSignature(t *testing.T) {
+	srv, reqs, bodies := hookServer(t)
+	self := peer.ID("node")
+	hooks := []Webhook{{Name: "signed", URL: srv.URL, Secret: "s3cret"}, {Name: "plain", URL: srv.URL}}
+	d := newWebhookDispatcher(hooks, t.TempDir(), self)
+	d.Start(context.Background())
+	defer d.Close()
+	d.Emit(webhookEvent{Type: eventPeerJoined, Peer: "p"})
+
+	got := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		r, body := receive(t, reqs, bodies)
+		if r.Header.Get("X-Mesh-Event") != eventPeerJoined {
+			t.Errorf("event header %q", r.Header.Get("X-Mesh-Event"))
+		}
+		var ev webhookEvent
+		if err := json.Unmarshal(body, &ev); err != nil || ev.Node != self.String() {
+			t.Errorf("body %s: %v", body, err)
+		}
+		sig := r.Header.Get("X-Mesh-Signature")
+		if sig == "" {
+			got["plain"] = true
+			continue
+		}
+		mac := hmac.New(sha256.New, []byte("s3cret"))
+		mac.Write(body)
+		if want := "sha256=" + hex.EncodeToString(mac.Sum(nil)); !hmac.Equal([]byte(sig), []byte(want)) {
+			t.Errorf("signature %s, want %s", sig, want)
+		}
+		got["signed"] = true
+	}
+	if !got["signed"] || !got["plain"] {
+		t.Errorf("deliveries: %v", got)
+	}
+}
+
+func TestWebhookQueueReload(t *testing.T) {
+	srv, reqs, bodies := hookServer(t)
+	self := peer.ID("node")
+	dir := t.TempDir()
+	hooks := []Webhook{{Name: "h", URL: srv.URL}}
+
+	// deliveries left by a previous run, saved out of order, and one for
+	// a webhook that is no longer configured
+	old := newWebhookDispatcher(hooks, dir, self)
+	now := time.Now().UnixNano()
+	for i, id := range []string{"second", "first", "third"} {
+		created := now + int64([]int{2, 1, 3}[i])
+		if err := old.save(&delivery{ID: id, Hook: "h", Event: eventMessage, Body: json.RawMessage(`"` + id + `"`), Created: created}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := old.save(&delivery{ID: "gone", Hook: "removed", Body: json.RawMessage(`"gone"`), Created: now}); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "queue", "junk.json"), []byte("{"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	d := newWebhookDispatcher(hooks, dir, self)
+	d.Start(context.Background())
+	defer d.Close()
+	for _, want := range []string{"first", "second", "third"} {
+		_, body := receive(t, reqs, bodies)
+		if string(body) != `"`+want+`"` {
+			t.Errorf("delivered %s, want %q", body, want)
+		}
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		left, _ := filepath.Glob(filepath.Join(dir, "queue", "*.json"))
+		if len(left) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("queue not drained: %v", left)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWebhookWants(t *testing.T) {
+	wh := Webhook{Events: []string{eventMessage}, Rooms: []string{"lobby"}}
+	tests := []struct {
+		ev   webhookEvent
+		want bool
+	}{
+		{webhookEvent{Type: eventMessage, Room: "lobby"}, true},
+		{webhookEvent{Type: eventMessage, Room: "other"}, false},
+		{webhookEvent{Type: eventPeerJoined}, false},
+	}
+	for _, tt := range tests {
+		if got := wh.wants(tt.ev); got != tt.want {
+			t.Errorf("wants(%s %s) = %v, want %v", tt.ev.Type, tt.ev.Room, got, tt.want)
+		}
+	}
+}
+
+func TestWebhookQueueCap(t *testing.T) {
+	dir := t.TempDir()
+	d := newWebhookDispatcher([]Webhook{{Name: "h", URL: "http://127.0.0.1:1"}}, dir, peer.ID("node"))
+	w := d.workers[0]
+	for i := 0; i <= webhookMaxPending; i++ {
+		dl := &delivery{ID: strconv.Itoa(i), Hook: "h", Event: eventMessage, Created: int64(i)}
+		if i == 1 {
+			dl.Attempts, dl.Next = 1, time.Now().Add(time.Hour).UnixNano()
+		}
+		if err := d.save(dl); err != nil {
+			t.Fatal(err)
+		}
+		d.enqueue(w, dl)
+	}
+	if pending, dropped := w.pending(); pending != webhookMaxPending || dropped != 1 {
+		t.Fatalf("pending %d, dropped %d; want %d, 1", pending, dropped, webhookMaxPending)
+	}
+	if _, err := os.Stat(d.queuePath("0")); !os.IsNotExist(err) {
+		t.Errorf("dropped delivery still on disk: %v", err)
+	}
+	if len(d.log) != 1 || d.log[0].ID != "0" || d.log[0].Result != "dropped" {
+		t.Errorf("log = %+v, want delivery 0 dropped", d.log)
+	}
+
+	// the next drop is the retry, which is now the oldest
+	d.enqueue(w, &delivery{ID: "new", Hook: "h", Created: webhookMaxPending + 1})
+	if len(w.retry) != 0 || d.log[1].ID != "1" {
+		t.Errorf("retry list %d, dropped %s; want the retry dropped", len(w.retry), d.log[1].ID)
+	}
+}
+
+func TestWebhookRetryDoesNotBlock(t *testing.T) {
+	attempts := make(chan string, 16)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var ev webhookEvent
+		_ = json.NewDecoder(r.Body).Decode(&ev)
+		attempts <- ev.Peer
+		if ev.Peer == "bad" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+	d := newWebhookDispatcher([]Webhook{{Name: "h", URL: srv.URL}}, t.TempDir(), peer.ID("node"))
+	d.Start(context.Background())
+	defer d.Close()
+	d.Emit(webhookEvent{Type: eventPeerJoined, Peer: "bad"})
+	d.Emit(webhookEvent{Type: eventPeerJoined, Peer: "good"})
+
+	var got []string
+	for len(got) < 3 {
+		select {
+		case p := <-attempts:
+			got = append(got, p)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("attempts so far: %v", got)
+		}
+	}
+	// the failed event waits out its backoff behind the next one
+	if want := []string{"bad", "good", "bad"}; !slices.Equal(got, want) {
+		t.Errorf("attempts = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	relayv2 "github.com/libp2p/go-libp2p/p2p/protocol/circuitv2/relay"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+const (
+	// authProtocol lets a peer present a relay token before it reserves.
+	authProtocol     = "/mesh/relay-auth/1.0.0"
+	authTimeout      = 10 * time.Second
+	allowFileRefresh = 10 * time.Second
+	defaultTokenTTL  = 30 * 24 * time.Hour
+)
+
+// RelayACL lists the peers a private relay serves. Peers may also present
+// a token signed with the relay key.
+type RelayACL struct {
+	AllowPeers []string `yaml:"allow_peers"`
+	AllowFile  string   `yaml:"allow_file"`
+}
+
+// relayToken is the signed part of a token. It is bound to one peer.
+type relayToken struct {
+	Peer string `json:"peer"`
+	Exp  int64  `json:"exp"`
+}
+
+// relayACL is the relay service's ACL filter. A public relay allows
+// everything but revoked peers. A private one grants reservations to authorised peers and
+// circuits to authorised sources; the destination already passed the check
+// when it reserved.
+type relayACL struct {
+	private bool
+	key     crypto.PrivKey
+	file    string
+
+	mu       sync.Mutex
+	static   map[peer.ID]bool
+	listed   map[peer.ID]bool
+	fileMod  time.Time
+	checked  time.Time
+	tokens   map[peer.ID]time.Time
+	blocked  map[peer.ID]time.Time
+	reserves atomic.Int64
+	connects atomic.Int64
+	quotas   *relayQuotas // set before the relay starts
+}
+
+var _ relayv2.ACLFilter = (*relayACL)(nil)
+
+func newRelayACL(private bool, cfg RelayACL, key crypto.PrivKey) (*relayACL, error) {
+	a := &relayACL{private: private, key: key, file: firstNonEmpty(os.Getenv("RELAY_ALLOW_FILE"), cfg.AllowFile),
+		static: map[peer.ID]bool{}, tokens: map[peer.ID]time.Time{}, blocked: map[peer.ID]time.Time{}}
+	allow := cfg.AllowPeers
+	if env := os.Getenv("RELAY_ALLOW_PEERS"); env != "" {
+		allow = strings.Split(env, ",")
+	}
+	for _, s := range allow {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		id, err := peer.Decode(s)
+		if err != nil {
+			return nil, fmt.Errorf("allow_peers %q: %w", s, err)
+		}
+		a.static[id] = true
+	}
+	if a.file != "" {
+		if err := a.reload(); err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+// reload reads the allow file if it changed. Lines hold one peer ID;
+// blank lines and # comments are skipped. Call with mu held or before use.
+func (a *relayACL) reload() error {
+	a.checked = time.Now()
+	fi, err := os.Stat(a.file)
+	if err != nil {
+		return fmt.Errorf("allow_file: %w", err)
+	}
+	if fi.ModTime().Equal(a.fileMod) {
+		return nil
+	}
+	b, err := os.ReadFile(a.file)
+	if err != nil {
+		return fmt.Errorf("allow_file: %w", err)
+	}
+	listed := map[peer.ID]bool{}
+	for n, line := range strings.Split(string(b), "\n") {
+		line, _, _ = strings.Cut(line, "#")
+		if line = strings.TrimSpace(line); line == "" {
+			continue
+		}
+		id, err := peer.Decode(line)
+		if err != nil {
+			return fmt.Errorf("allow_file line %d: %w", n+1, err)
+		}
+		listed[id] = true
+	}
+	a.listed, a.fileMod = listed, fi.ModTime()
+	return nil
+}
+
+func (a *relayACL) allowed(p peer.ID) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.file != "" && time.Since(a.checked) > allowFileRefresh {
+		if err := a.reload(); err != nil {
+			fmt.Println("Keeping previous allow list:", err)
+		}
+	}
+	if a.static[p] || a.listed[p] {
+		return true
+	}
+	exp, ok := a.tokens[p]
+	if ok && time.Now().After(exp) {
+		delete(a.tokens, p)
+		return false
+	}
+	return ok
+}
+
+// revoke forgets p's token and refuses it until the given time.
+func (a *relayACL) revoke(p peer.ID, until time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.tokens, p)
+	if until.After(time.Now()) {
+		a.blocked[p] = until
+	}
+}
+
+func (a *relayACL) isBlocked(p peer.ID) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	until, ok := a.blocked[p]
+	if ok && time.Now().After(until) {
+		delete(a.blocked, p)
+		return false
+	}
+	return ok
+}
+
+func (a *relayACL) AllowReserve(p peer.ID, addr ma.Multiaddr) bool {
+	if a.quotas.exhausted(p, ipOf(addr)) {
+		a.reserves.Add(1)
+		fmt.Printf("🚫 Reservation denied for %s (%s): bandwidth quota used up\n", p, addr)
+		return false
+	}
+	if !a.isBlocked(p) && (!a.private || a.allowed(p)) {
+		return true
+	}
+	a.reserves.Add(1)
+	fmt.Printf("🚫 Reservation denied for %s (%s)\n", p, addr)
+	return false
+}
+
+func (a *relayACL) AllowConnect(src peer.ID, srcAddr ma.Multiaddr, dest peer.ID) bool {
+	if a.quotas.exhausted(dest, ipOf(srcAddr)) {
+		a.connects.Add(1)
+		fmt.Printf("🚫 Circuit denied from %s (%s) to %s: bandwidth quota used up\n", src, srcAddr, dest)
+		return false
+	}
+	if !a.isBlocked(src) && (!a.private || a.allowed(src)) {
+		return true
+	}
+	a.connects.Add(1)
+	fmt.Printf("🚫 Circuit denied from %s (%s) to %s\n", src, srcAddr, dest)
+	return false
+}
+
+// handleAuth accepts a token line and answers "ok" or "denied: <reason>".
+func (a *relayACL) handleAuth(s network.Stream) {
+	defer s.Close()
+	_ = s.SetDeadline(time.Now().Add(authTimeout))
+	line, err := bufio.NewReader(io.LimitReader(s, 1024)).ReadString('\n')
+	if err != nil {
+		s.Reset()
+		return
+	}
+	p := s.Conn().RemotePeer()
+	exp, err := a.verify(strings.TrimSpace(line), p)
+	if err != nil {
+		fmt.Printf("🚫 Token refused for %s: %v\n", p, err)
+		_, _ = fmt.Fprintf(s, "denied: %v\n", err)
+		return
+	}
+	a.mu.Lock()
+	a.tokens[p] = exp
+	a.mu.Unlock()
+	_, _ = io.WriteString(s, "ok\n")
+}
+
+// issue signs a token that lets p use the relay until ttl from now.
+func (a *relayACL) issue(p peer.ID, ttl time.Duration) (string, error) {
+	body, err := json.Marshal(relayToken{Peer: p.String(), Exp: time.Now().Add(ttl).Unix()})
+	if err != nil {
+		return "", err
+	}
+	sig, err := a.key.Sign(body)
+	if err != nil {
+		return "", err
+	}
+	enc := base64.RawURLEncoding
+	return enc.EncodeToString(body) + "." + enc.EncodeToString(sig), nil
+}
+
+func (a *relayACL) verify(tok string, p peer.ID) (time.Time, error) {
+	enc := base64.RawURLEncoding
+	b64, s64, ok := strings.Cut(tok, ".")
+	if !ok {
+		return time.Time{}, errors.New("malformed token")
+	}
+	body, err1 := enc.DecodeString(b64)
+	sig, err2 := enc.DecodeString(s64)
+	if err1 != nil || err2 != nil {
+		return time.Time{}, errors.New("malformed token")
+	}
+	if ok, err := a.key.GetPublic().Verify(body, sig); err != nil || !ok {
+		return time.Time{}, errors.New("bad signature")
+	}
+	var t relayToken
+	if err := json.Unmarshal(body, &t); err != nil {
+		return time.Time{}, errors.New("malformed token")
+	}
+	if t.Peer != p.String() {
+		return time.Time{}, errors.New("token issued to another peer")
+	}
+	exp := time.Unix(t.Exp, 0)
+	if time.Now().After(exp) {
+		return time.Time{}, errors.New("token expired")
+	}
+	return exp, nil
+}
+
+// serve starts answering token requests. Only private relays need them.
+func (a *relayACL) serve(h host.Host) {
+	if a.private {
+		h.SetStreamHandler(authProtocol, a.handleAuth)
+	}
+}
+
+// issueToken implements "p2p-relay token <peer-id> [ttl]".
+func issueToken(key crypto.PrivKey, args []string) error {
+	if len(args) < 1 {
+		return errors.New("usage: p2p-relay token <peer-id> [ttl]")
+	}
+	id, err := peer.Decode(args[0])
+	if err != nil {
+		return err
+	}
+	ttl := defaultTokenTTL
+	if len(args) > 1 {
+		if ttl, err = time.ParseDuration(args[1]); err != nil || ttl <= 0 {
+			return fmt.Errorf("invalid ttl %q", args[1])
+		}
+	}
+	tok, err := (&relayACL{key: key}).issue(id, ttl)
+	if err != nil {
+		return err
+	}
+	fmt.Println(tok)
+	return nil
+}
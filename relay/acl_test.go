@@ -0,0 +1,156 @@
+package main
+
+import (
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+func testKey(t *testing.T) (peer.ID, crypto.PrivKey) {
+	t.Helper()
+	key, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := peer.IDFromPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id, key
+}
+
+func TestACLVerify(t *testing.T) {
+	_, key := testKey(t)
+	_, otherKey := testKey(t)
+	p, _ := testKey(t)
+	q, _ := testKey(t)
+	a := &relayACL{key: key}
+	other := &relayACL{key: otherKey}
+
+	issue := func(a *relayACL, p peer.ID, ttl time.Duration) string {
+		tok, err := a.issue(p, ttl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tok
+	}
+	valid := issue(a, p, time.Hour)
+	body, sig, _ := strings.Cut(valid, ".")
+
+	tests := []struct {
+		name string
+		tok  string
+		ok   bool
+	}{
+		{"valid", valid, true},
+		{"issued to another peer", issue(a, q, time.Hour), false},
+		{"expired", issue(a, p, -time.Minute), false},
+		{"signed by another relay", issue(other, p, time.Hour), false},
+		{"signature of another token", body + "." + strings.SplitN(issue(a, p, 2*time.Hour), ".", 2)[1], false},
+		{"no signature", body, false},
+		{"bad encoding", body + "." + sig + "!", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			exp, err := a.verify(tt.tok, p)
+			if (err == nil) != tt.ok {
+				t.Fatalf("verify = %v, want ok %v", err, tt.ok)
+			}
+			if tt.ok && time.Until(exp) <= 0 {
+				t.Errorf("expiry %v is not in the future", exp)
+			}
+		})
+	}
+}
+
+func TestACLAllow(t *testing.T) {
+	t.Setenv("RELAY_ALLOW_PEERS", "")
+	t.Setenv("RELAY_ALLOW_FILE", "")
+	static, _ := testKey(t)
+	listed, _ := testKey(t)
+	token, _ := testKey(t)
+	lapsed, _ := testKey(t)
+	revoked, _ := testKey(t)
+	stranger, _ := testKey(t)
+
+	dir := t.TempDir()
+	file := filepath.Join(dir, "allow.txt")
+	if err := os.WriteFile(file, []byte("# relay users\n"+listed.String()+"  # bob\n\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	addr := ma.StringCast("/ip4/192.0.2.1/tcp/4001")
+
+	newACL := func(private bool) *relayACL {
+		a, err := newRelayACL(private, RelayACL{AllowPeers: []string{static.String(), revoked.String()}, AllowFile: file}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		a.quotas = newRelayQuotas(RelayQuotas{}, filepath.Join(dir, "usage.json"))
+		a.tokens[token] = time.Now().Add(time.Hour)
+		a.tokens[lapsed] = time.Now().Add(-time.Second)
+		a.revoke(revoked, time.Now().Add(time.Hour))
+		return a
+	}
+
+	tests := []struct {
+		name    string
+		p       peer.ID
+		private bool
+		public  bool
+	}{
+		{"allow_peers", static, true, true},
+		{"allow_file", listed, true, true},
+		{"token", token, true, true},
+		{"lapsed token", lapsed, false, true},
+		{"revoked", revoked, false, false},
+		{"stranger", stranger, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, mode := range []struct {
+				private bool
+				want    bool
+			}{{true, tt.private}, {false, tt.public}} {
+				a := newACL(mode.private)
+				if got := a.AllowReserve(tt.p, addr); got != mode.want {
+					t.Errorf("private %v: AllowReserve = %v, want %v", mode.private, got, mode.want)
+				}
+				if got := a.AllowConnect(tt.p, addr, static); got != mode.want {
+					t.Errorf("private %v: AllowConnect = %v, want %v", mode.private, got, mode.want)
+				}
+			}
+		})
+	}
+}
+
+func TestNewRelayACL(t *testing.T) {
+	t.Setenv("RELAY_ALLOW_PEERS", "")
+	t.Setenv("RELAY_ALLOW_FILE", "")
+	dir := t.TempDir()
+	bad := filepath.Join(dir, "bad.txt")
+	if err := os.WriteFile(bad, []byte("not-a-peer\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		cfg  RelayACL
+	}{
+		{"bad allow_peers entry", RelayACL{AllowPeers: []string{"not-a-peer"}}},
+		{"missing allow_file", RelayACL{AllowFile: filepath.Join(dir, "missing.txt")}},
+		{"bad allow_file line", RelayACL{AllowFile: bad}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := newRelayACL(true, tt.cfg, nil); err == nil {
+				t.Error("newRelayACL accepted the config")
+			}
+		})
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// relayAdmin is the operator API under /admin/. Every request needs the
+// admin token as a bearer token.
+type relayAdmin struct {
+	token  string
+	reg    *relayRegistry
+	acl    *relayACL
+	quotas *relayQuotas
+}
+
+// handle routes GET /admin/reservations, GET /admin/circuits,
+// GET /admin/usage and DELETE /admin/reservations/{peer}. A revoke takes an
+// optional ?block= duration during which the peer may not reserve again.
+func (a *relayAdmin) handle(w http.ResponseWriter, r *http.Request) {
+	tok, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(tok), []byte(a.token)) != 1 {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	path := strings.TrimPrefix(r.URL.Path, "/admin/")
+	switch {
+	case path == "reservations" && r.Method == http.MethodGet:
+		writeJSON(w, a.reg.active())
+	case path == "circuits" && r.Method == http.MethodGet:
+		writeJSON(w, a.reg.open())
+	case path == "usage" && r.Method == http.MethodGet:
+		a.usage(w, r)
+	case strings.HasPrefix(path, "reservations/") && r.Method == http.MethodDelete:
+		a.revoke(w, r, strings.TrimPrefix(path, "reservations/"))
+	case path == "reservations" || path == "circuits" || path == "usage" || strings.HasPrefix(path, "reservations/"):
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (a *relayAdmin) revoke(w http.ResponseWriter, r *http.Request, id string) {
+	p, err := peer.Decode(id)
+	if err != nil {
+		http.Error(w, "invalid peer ID", http.StatusBadRequest)
+		return
+	}
+	var block time.Duration
+	if s := r.URL.Query().Get("block"); s != "" {
+		if block, err = time.ParseDuration(s); err != nil || block < 0 {
+			http.Error(w, "invalid block duration", http.StatusBadRequest)
+			return
+		}
+	}
+	a.acl.revoke(p, time.Now().Add(block))
+	if !a.reg.revoke(p) {
+		http.Error(w, "no reservation", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// usage reports the quotas and the heaviest reserving peers and source IPs
+// of the last day, ?limit= of each.
+func (a *relayAdmin) usage(w http.ResponseWriter, r *http.Request) {
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit <= 0 {
+		limit = defaultTopN
+	}
+	peers, ips := a.quotas.top(limit)
+	writeJSON(w, struct {
+		Quotas RelayQuotas `json:"quotas"`
+		Cut    int64       `json:"circuits_cut"`
+		Peers  []consumer  `json:"peers"`
+		IPs    []consumer  `json:"ips"`
+	}{a.quotas.limits, a.quotas.cut.Load(), peers, ips})
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+const (
+	// recordProtocol hands out a freshly signed relayRecord. Nodes holding
+	// a reservation fetch it and publish it on the "relays" topic.
+	recordProtocol = "/mesh/relay-record/1.0.0"
+	recordTTL      = 30 * time.Minute
+	maxRecordAddrs = 8
+	maxRecordTTL   = time.Hour
+	maxRecordSkew  = 5 * time.Minute // how far ahead of our clock a record may be issued
+)
+
+var errBadRecord = errors.New("invalid relay record")
+
+// relayRecord describes a relay to the mesh. It is signed with that
+// relay's key, so whoever passes it on cannot change it.
+type relayRecord struct {
+	Peer     string   `json:"peer"`
+	Addrs    []string `json:"addrs"`
+	Capacity int      `json:"capacity"` // free reservation slots when signed
+	Private  bool     `json:"private,omitempty"`
+	Issued   int64    `json:"issued"`
+	Expires  int64    `json:"expires"`
+
+	id    peer.ID
+	addrs []ma.Multiaddr
+}
+
+// relayAnnouncement is a record together with its signature, as published.
+type relayAnnouncement struct {
+	Record []byte `json:"record"`
+	Sig    []byte `json:"sig"`
+}
+
+// recordSigner signs relayRecords for this relay's current addresses and
+// free capacity.
+type recordSigner struct {
+	h       host.Host
+	key     crypto.PrivKey
+	reg     *relayRegistry
+	res     RelayResources
+	private bool
+}
+
+func (rs *recordSigner) sign() ([]byte, error) {
+	rec := relayRecord{Peer: rs.h.ID().String(), Capacity: max(rs.res.MaxReservations-len(rs.reg.active()), 0), Private: rs.private}
+	for _, a := range rs.h.Addrs() {
+		if _, err := a.ValueForProtocol(ma.P_CIRCUIT); err == nil || len(rec.Addrs) == maxRecordAddrs {
+			continue
+		}
+		rec.Addrs = append(rec.Addrs, a.String())
+	}
+	now := time.Now()
+	rec.Issued, rec.Expires = now.Unix(), now.Add(recordTTL).Unix()
+	body, err := json.Marshal(rec)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := rs.key.Sign(body)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(relayAnnouncement{Record: body, Sig: sig})
+}
+
+// serveRecord answers recordProtocol with a freshly signed record.
+func serveRecord(h host.Host, rs *recordSigner) {
+	h.SetStreamHandler(recordProtocol, func(s network.Stream) {
+		defer s.Close()
+		_ = s.SetDeadline(time.Now().Add(authTimeout))
+		data, err := rs.sign()
+		if err != nil {
+			s.Reset()
+			return
+		}
+		_, _ = s.Write(append(data, '\n'))
+	})
+}
+
+// parseAnnouncement checks the relay's signature of an announcement and
+// that its record is well formed and current: not expired, not issued in
+// the future and expiring within maxRecordTTL from now. It mirrors the
+// node's topic validator.
+func parseAnnouncement(data []byte) (*relayRecord, error) {
+	var ann relayAnnouncement
+	if err := json.Unmarshal(data, &ann); err != nil {
+		return nil, errBadRecord
+	}
+	var rec relayRecord
+	if err := json.Unmarshal(ann.Record, &rec); err != nil {
+		return nil, errBadRecord
+	}
+	id, err := peer.Decode(rec.Peer)
+	if err != nil {
+		return nil, errBadRecord
+	}
+	pub, err := id.ExtractPublicKey()
+	if err != nil {
+		return nil, errBadRecord
+	}
+	if ok, err := pub.Verify(ann.Record, ann.Sig); err != nil || !ok {
+		return nil, errors.New("relay record not signed by the relay")
+	}
+	now := time.Now()
+	issued, expires := time.Unix(rec.Issued, 0), time.Unix(rec.Expires, 0)
+	if rec.Capacity < 0 || !expires.After(now) || expires.Sub(issued) > maxRecordTTL {
+		return nil, errBadRecord
+	}
+	if issued.After(now.Add(maxRecordSkew)) || expires.After(now.Add(maxRecordTTL)) {
+		return nil, errBadRecord
+	}
+	if len(rec.Addrs) == 0 || len(rec.Addrs) > maxRecordAddrs {
+		return nil, errBadRecord
+	}
+	for _, s := range rec.Addrs {
+		a, err := ma.NewMultiaddr(s)
+		if err != nil {
+			return nil, errBadRecord
+		}
+		if _, err := a.ValueForProtocol(ma.P_CIRCUIT); err == nil {
+			return nil, errBadRecord
+		}
+		rec.addrs = append(rec.addrs, a)
+	}
+	rec.id = id
+	return &rec, nil
+}
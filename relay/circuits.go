@@ -0,0 +1,260 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	pbv2 "github.com/libp2p/go-libp2p/p2p/protocol/circuitv2/pb"
+	relayproto "github.com/libp2p/go-libp2p/p2p/protocol/circuitv2/proto"
+	"google.golang.org/protobuf/proto"
+)
+
+// maxHopMessage bounds the handshake bytes buffered per hop stream.
+const maxHopMessage = 4096
+
+// reservation is a slot the relay granted, as seen on the hop stream.
+type reservation struct {
+	Peer    string    `json:"peer"`
+	Addr    string    `json:"addr"`
+	Expires time.Time `json:"expires"`
+	id      peer.ID
+}
+
+// circuitInfo describes one relayed connection. BytesIn flows from the
+// source to the destination and BytesOut back.
+type circuitInfo struct {
+	ID       uint64    `json:"id"`
+	Src      string    `json:"src"`
+	SrcAddr  string    `json:"src_addr"`
+	Dest     string    `json:"dest"`
+	Opened   time.Time `json:"opened"`
+	BytesIn  int64     `json:"bytes_in"`
+	BytesOut int64     `json:"bytes_out"`
+}
+
+type circuit struct {
+	circuitInfo
+	in, out atomic.Int64
+	dest    peer.ID
+	srcIP   string
+	cut     atomic.Bool // reset for running over quota
+}
+
+// relayRegistry records reservations and circuits by watching the hop
+// protocol. The relay service keeps its own state private, so this is what
+// the admin API reports and revokes from.
+type relayRegistry struct {
+	h      host.Host
+	quotas *relayQuotas
+	nextID atomic.Uint64
+
+	mu           sync.Mutex
+	reservations map[peer.ID]*reservation
+	circuits     map[uint64]*circuit
+}
+
+func newRelayRegistry(h host.Host) *relayRegistry {
+	return &relayRegistry{h: h, reservations: map[peer.ID]*reservation{}, circuits: map[uint64]*circuit{}}
+}
+
+// relayHost hands the relay service a host whose hop streams are tracked.
+type relayHost struct {
+	host.Host
+	reg *relayRegistry
+}
+
+func (rh relayHost) SetStreamHandler(pid protocol.ID, handler network.StreamHandler) {
+	if pid == relayproto.ProtoIDv2Hop {
+		inner := handler
+		handler = func(s network.Stream) { inner(&hopStream{Stream: s, reg: rh.reg}) }
+	}
+	rh.Host.SetStreamHandler(pid, handler)
+}
+
+// hopStream decodes the hop request the relay reads and the status it
+// writes back. After a successful CONNECT it counts the relayed bytes and
+// resets the circuit once they exceed the quota.
+type hopStream struct {
+	network.Stream
+	reg *relayRegistry
+
+	mu      sync.Mutex
+	req     []byte
+	resp    []byte
+	reqMsg  *pbv2.HopMessage
+	done    bool
+	circuit *circuit
+}
+
+func (s *hopStream) Read(p []byte) (int, error) {
+	n, err := s.Stream.Read(p)
+	s.mu.Lock()
+	c := s.circuit
+	s.mu.Unlock()
+	if c != nil {
+		c.in.Add(int64(n))
+		s.account(c, n)
+		return n, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case !s.done && s.reqMsg == nil:
+		s.req = append(s.req, p[:n]...)
+		if msg, ok := decodeHop(s.req); ok {
+			s.reqMsg, s.req = msg, nil
+		} else if len(s.req) > maxHopMessage {
+			s.done = true
+		}
+	}
+	return n, err
+}
+
+func (s *hopStream) Write(p []byte) (int, error) {
+	n, err := s.Stream.Write(p)
+	s.mu.Lock()
+	c := s.circuit
+	s.mu.Unlock()
+	if c != nil {
+		c.out.Add(int64(n))
+		s.account(c, n)
+		return n, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case !s.done && s.reqMsg != nil:
+		s.resp = append(s.resp, p[:n]...)
+		if msg, ok := decodeHop(s.resp); ok {
+			s.done, s.resp = true, nil
+			if msg.GetStatus() == pbv2.Status_OK {
+				s.circuit = s.reg.granted(s.Stream, s.reqMsg, msg)
+			}
+		} else if len(s.resp) > maxHopMessage {
+			s.done = true
+		}
+	}
+	return n, err
+}
+
+// account charges n relayed bytes to the circuit's quotas and resets the
+// circuit when they run out.
+func (s *hopStream) account(c *circuit, n int) {
+	if n == 0 || s.reg.quotas.add(c.dest, c.srcIP, int64(n)) || !c.cut.CompareAndSwap(false, true) {
+		return
+	}
+	s.reg.quotas.cut.Add(1)
+	fmt.Printf("🚫 Circuit %d from %s to %s reset: bandwidth quota used up\n", c.ID, c.Src, c.Dest)
+	_ = s.Reset()
+}
+
+func (s *hopStream) Close() error {
+	s.closed()
+	return s.Stream.Close()
+}
+
+func (s *hopStream) Reset() error {
+	s.closed()
+	return s.Stream.Reset()
+}
+
+func (s *hopStream) closed() {
+	s.mu.Lock()
+	c := s.circuit
+	s.mu.Unlock()
+	if c != nil {
+		s.reg.mu.Lock()
+		delete(s.reg.circuits, c.ID)
+		s.reg.mu.Unlock()
+	}
+}
+
+// decodeHop parses one varint-delimited HopMessage once b holds all of it.
+func decodeHop(b []byte) (*pbv2.HopMessage, bool) {
+	size, n := binary.Uvarint(b)
+	if n <= 0 || uint64(len(b)-n) < size {
+		return nil, false
+	}
+	var msg pbv2.HopMessage
+	if proto.Unmarshal(b[n:n+int(size)], &msg) != nil {
+		return nil, false
+	}
+	return &msg, true
+}
+
+// granted records an accepted RESERVE or CONNECT. It returns the circuit
+// for a CONNECT.
+func (r *relayRegistry) granted(s network.Stream, req, resp *pbv2.HopMessage) *circuit {
+	src := s.Conn().RemotePeer()
+	addr := s.Conn().RemoteMultiaddr().String()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	switch req.GetType() {
+	case pbv2.HopMessage_RESERVE:
+		exp := time.Unix(int64(resp.GetReservation().GetExpire()), 0)
+		r.reservations[src] = &reservation{Peer: src.String(), Addr: addr, Expires: exp, id: src}
+	case pbv2.HopMessage_CONNECT:
+		dest, err := peer.IDFromBytes(req.GetPeer().GetId())
+		if err != nil {
+			return nil
+		}
+		c := &circuit{circuitInfo: circuitInfo{ID: r.nextID.Add(1), Src: src.String(), SrcAddr: addr, Dest: dest.String(), Opened: time.Now()},
+			dest: dest, srcIP: ipOf(s.Conn().RemoteMultiaddr())}
+		r.circuits[c.ID] = c
+		return c
+	}
+	return nil
+}
+
+// active returns the live reservations, oldest expiry first. The relay
+// drops a reservation when it expires or the peer disconnects.
+func (r *relayRegistry) active() []reservation {
+	now := time.Now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	out := []reservation{}
+	for p, rv := range r.reservations {
+		if rv.Expires.Before(now) || r.h.Network().Connectedness(p) != network.Connected {
+			delete(r.reservations, p)
+			continue
+		}
+		out = append(out, *rv)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Expires.Before(out[j].Expires) })
+	return out
+}
+
+// open returns the circuits that are relaying, oldest first.
+func (r *relayRegistry) open() []circuitInfo {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	out := []circuitInfo{}
+	for _, c := range r.circuits {
+		ci := c.circuitInfo
+		ci.BytesIn, ci.BytesOut = c.in.Load(), c.out.Load()
+		out = append(out, ci)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out
+}
+
+// revoke ends p's reservation by closing its connections, which also tears
+// down its circuits. It reports whether p held a reservation.
+func (r *relayRegistry) revoke(p peer.ID) bool {
+	r.mu.Lock()
+	_, ok := r.reservations[p]
+	delete(r.reservations, p)
+	r.mu.Unlock()
+	if ok {
+		_ = r.h.Network().ClosePeer(p)
+	}
+	return ok
+}
@@ -14,6 +14,21 @@ type Config struct {
 	EnableHolePunch   bool     `yaml:"enable_holepunch"`
 	EnableUPnP        bool     `yaml:"enable_upnp"`
 	AnnounceAddrs     []string `yaml:"announce_addrs"`
+	ShutdownTimeout   string   `yaml:"shutdown_timeout"`
+
+	Resources  RelayResources `yaml:"relay_resources"`
+	Quotas     RelayQuotas    `yaml:"relay_quotas"`
+	StatusAddr string         `yaml:"relay_status_addr"`
+	AdminToken string         `yaml:"relay_admin_token"`
+	DHT        bool           `yaml:"relay_dht"`
+	DHTPeers   []string       `yaml:"relay_dht_peers"`
+	WSCert     string         `yaml:"relay_ws_cert"`
+	WSKey      string         `yaml:"relay_ws_key"`
+	Private    bool           `yaml:"relay_private"`
+	ACL        RelayACL       `yaml:"relay_acl"`
+
+	Federation      bool     `yaml:"relay_federation"`
+	FederationPeers []string `yaml:"relay_federation_peers"`
 }
 
 func loadConfig() Config {
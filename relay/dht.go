@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	dht "github.com/libp2p/go-libp2p-kad-dht"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/peerstore"
+	ma "github.com/multiformats/go-multiaddr"
+	mh "github.com/multiformats/go-multihash"
+)
+
+// bootstrapCID is the record public peers provide so others can find
+// them. It must match the node's.
+var bootstrapCID = func() cid.Cid {
+	h, _ := mh.Sum([]byte("mesh-bootstrap"), mh.SHA2_256, -1)
+	return cid.NewCidV1(cid.Raw, h)
+}()
+
+// ipValidator accepts the node's /publicip records as they are.
+type ipValidator struct{}
+
+func (ipValidator) Validate(string, []byte) error        { return nil }
+func (ipValidator) Select(string, [][]byte) (int, error) { return 0, nil }
+
+// startDHT runs the mesh DHT in server mode. The relay then answers DHT
+// queries, stores the "room:" provider records nodes use as rendezvous
+// and provides the bootstrap record, so nodes can bootstrap from it.
+func startDHT(ctx context.Context, h host.Host, bootstrap []string) (*dht.IpfsDHT, error) {
+	kdht, err := dht.New(ctx, h,
+		dht.Mode(dht.ModeServer),
+		dht.ProtocolPrefix("/mesh"),
+		dht.NamespacedValidator("publicip", ipValidator{}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range bootstrap {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		maddr, err := ma.NewMultiaddr(s)
+		if err != nil {
+			fmt.Println("Invalid DHT bootstrap peer, skipping:", err)
+			continue
+		}
+		pi, err := peer.AddrInfoFromP2pAddr(maddr)
+		if err != nil {
+			fmt.Println("Invalid DHT bootstrap peer, skipping:", err)
+			continue
+		}
+		h.Peerstore().AddAddrs(pi.ID, pi.Addrs, peerstore.PermanentAddrTTL)
+		if err := h.Connect(ctx, *pi); err != nil {
+			fmt.Println("DHT bootstrap connect failed:", err)
+		}
+	}
+	if err := kdht.Bootstrap(ctx); err != nil {
+		_ = kdht.Close()
+		return nil, err
+	}
+	go func() {
+		ticker := time.NewTicker(10 * time.Minute)
+		defer ticker.Stop()
+		for {
+			// alone the relay keeps the record locally and answers with it;
+			// with other DHT servers around it is published to them too
+			if err := kdht.Provide(ctx, bootstrapCID, kdht.RoutingTable().Size() > 0); err != nil {
+				fmt.Println("DHT provide bootstrap:", err)
+			}
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return kdht, nil
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/peerstore"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+const (
+	// fleetProtocol exchanges lists of signed relay records. The caller
+	// writes its list, which may be empty, and reads the relay's.
+	fleetProtocol = "/mesh/relay-fleet/1.0.0"
+	fleetEvery    = 5 * time.Minute
+	fleetTimeout  = 30 * time.Second
+	maxFleet      = 64
+	maxFleetBytes = maxFleet * 4 << 10
+)
+
+// relayFleet is what this relay knows about other relays: the newest
+// signed record of each. With federation on it swaps records with the
+// configured peer relays, and through their lists learns the relays they
+// trust. Nodes query it to learn the fleet from a single relay.
+type relayFleet struct {
+	h        host.Host
+	signer   *recordSigner
+	federate bool
+	peers    []peer.AddrInfo
+
+	mu      sync.Mutex
+	records map[peer.ID]fleetRecord
+}
+
+type fleetRecord struct {
+	data json.RawMessage
+	rec  *relayRecord
+}
+
+// fleetStatus is one known relay as reported by GET /status.
+type fleetStatus struct {
+	Peer     string    `json:"peer"`
+	Addrs    []string  `json:"addrs"`
+	Capacity int       `json:"capacity"`
+	Private  bool      `json:"private,omitempty"`
+	Issued   time.Time `json:"issued"`
+	Expires  time.Time `json:"expires"`
+}
+
+func newRelayFleet(h host.Host, signer *recordSigner, federate bool, peers []string) (*relayFleet, error) {
+	f := &relayFleet{h: h, signer: signer, federate: federate, records: map[peer.ID]fleetRecord{}}
+	for _, s := range peers {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		maddr, err := ma.NewMultiaddr(s)
+		if err != nil {
+			return nil, fmt.Errorf("federation peer %q: %w", s, err)
+		}
+		pi, err := peer.AddrInfoFromP2pAddr(maddr)
+		if err != nil {
+			return nil, fmt.Errorf("federation peer %q: %w", s, err)
+		}
+		f.peers = append(f.peers, *pi)
+	}
+	return f, nil
+}
+
+// list returns this relay's own record, freshly signed, followed by the
+// unexpired records of the other relays it knows.
+func (f *relayFleet) list() []json.RawMessage {
+	out := []json.RawMessage{}
+	if data, err := f.signer.sign(); err == nil {
+		out = append(out, data)
+	}
+	now := time.Now().Unix()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for id, fr := range f.records {
+		if fr.rec.Expires <= now {
+			delete(f.records, id)
+			continue
+		}
+		out = append(out, fr.data)
+	}
+	return out
+}
+
+// merge keeps the records that verify and are newer than the ones known,
+// and returns how many relays were new. With maxFleet relays known, a new
+// record replaces the one expiring first if it outlives it.
+func (f *relayFleet) merge(list []json.RawMessage) int {
+	added := 0
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, data := range list {
+		rec, err := parseAnnouncement(data)
+		if err != nil || rec.id == f.h.ID() {
+			continue
+		}
+		old, known := f.records[rec.id]
+		if known && rec.Issued <= old.rec.Issued {
+			continue
+		}
+		if !known && len(f.records) >= maxFleet {
+			first := f.expiringFirst()
+			if rec.Expires <= f.records[first].rec.Expires {
+				continue
+			}
+			delete(f.records, first)
+		}
+		if !known {
+			added++
+		}
+		f.records[rec.id] = fleetRecord{data: data, rec: rec}
+		f.h.Peerstore().AddAddrs(rec.id, rec.addrs, time.Until(time.Unix(rec.Expires, 0)))
+	}
+	return added
+}
+
+// expiringFirst returns the known relay whose record expires first. f.mu
+// must be held.
+func (f *relayFleet) expiringFirst() peer.ID {
+	var first peer.ID
+	for id, fr := range f.records {
+		if first == "" || fr.rec.Expires < f.records[first].rec.Expires {
+			first = id
+		}
+	}
+	return first
+}
+
+// trusted reports whether this relay takes p's list of relays, which is
+// only when p is one of the configured federation peers. Every record is
+// signed by the relay it describes, but anyone can run a relay and sign
+// records, so a list is only worth as much as whoever picked its entries.
+func (f *relayFleet) trusted(p peer.ID) bool {
+	for _, pi := range f.peers {
+		if pi.ID == p {
+			return true
+		}
+	}
+	return false
+}
+
+// handle answers fleetProtocol. The caller's list is merged only when
+// federating and the caller is a trusted relay; nodes send an empty one.
+func (f *relayFleet) handle(s network.Stream) {
+	defer s.Close()
+	_ = s.SetDeadline(time.Now().Add(fleetTimeout))
+	var in []json.RawMessage
+	if err := json.NewDecoder(io.LimitReader(s, maxFleetBytes)).Decode(&in); err != nil {
+		s.Reset()
+		return
+	}
+	if f.federate && len(in) > 0 && f.trusted(s.Conn().RemotePeer()) {
+		if n := f.merge(in); n > 0 {
+			fmt.Printf("🤝 Fleet: %s told us about %d new relays\n", s.Conn().RemotePeer(), n)
+		}
+	}
+	_ = json.NewEncoder(s).Encode(f.list())
+}
+
+// exchange swaps lists with relay p and keeps p's when it is trusted.
+func (f *relayFleet) exchange(ctx context.Context, p peer.ID) error {
+	s, err := f.h.NewStream(ctx, p, fleetProtocol)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	_ = s.SetDeadline(time.Now().Add(fleetTimeout))
+	if err := json.NewEncoder(s).Encode(f.list()); err != nil {
+		s.Reset()
+		return err
+	}
+	var out []json.RawMessage
+	if err := json.NewDecoder(io.LimitReader(s, maxFleetBytes)).Decode(&out); err != nil {
+		s.Reset()
+		return err
+	}
+	if !f.trusted(p) {
+		return nil
+	}
+	if n := f.merge(out); n > 0 {
+		fmt.Printf("🤝 Fleet: %s told us about %d new relays\n", p, n)
+	}
+	return nil
+}
+
+// run exchanges lists with the configured peers every fleetEvery. Other
+// relays are not asked, since their lists would not be kept.
+func (f *relayFleet) run(ctx context.Context) {
+	ticker := time.NewTicker(fleetEvery)
+	defer ticker.Stop()
+	for _, pi := range f.peers {
+		f.h.Peerstore().AddAddrs(pi.ID, pi.Addrs, peerstore.PermanentAddrTTL)
+	}
+	for {
+		for _, pi := range f.peers {
+			if pi.ID == f.h.ID() {
+				continue
+			}
+			ectx, cancel := context.WithTimeout(ctx, fleetTimeout)
+			if err := f.exchange(ectx, pi.ID); err != nil && ctx.Err() == nil {
+				fmt.Printf("Fleet exchange with %s failed: %v\n", pi.ID, err)
+			}
+			cancel()
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// serve starts answering fleet queries, and with federation on starts
+// exchanging with other relays.
+func (f *relayFleet) serve(ctx context.Context) {
+	f.h.SetStreamHandler(fleetProtocol, f.handle)
+	if f.federate {
+		go f.run(ctx)
+	}
+}
+
+// status lists the other relays known, most free capacity first.
+func (f *relayFleet) status() []fleetStatus {
+	now := time.Now().Unix()
+	out := []fleetStatus{}
+	f.mu.Lock()
+	for _, fr := range f.records {
+		if fr.rec.Expires <= now {
+			continue
+		}
+		out = append(out, fleetStatus{Peer: fr.rec.Peer, Addrs: fr.rec.Addrs, Capacity: fr.rec.Capacity, Private: fr.rec.Private,
+			Issued: time.Unix(fr.rec.Issued, 0), Expires: time.Unix(fr.rec.Expires, 0)})
+	}
+	f.mu.Unlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].Capacity > out[j].Capacity })
+	return out
+}
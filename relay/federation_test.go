@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// testRecord signs a relay record for the relay with key.
+func testRecord(t *testing.T, key crypto.PrivKey, edit func(*relayRecord)) json.RawMessage {
+	t.Helper()
+	id, _ := peer.IDFromPrivateKey(key)
+	now := time.Now()
+	rec := relayRecord{Peer: id.String(), Addrs: []string{"/ip4/192.0.2.1/tcp/4001"}, Capacity: 10,
+		Issued: now.Unix(), Expires: now.Add(recordTTL).Unix()}
+	if edit != nil {
+		edit(&rec)
+	}
+	body, _ := json.Marshal(rec)
+	sig, err := key.Sign(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := json.Marshal(relayAnnouncement{Record: body, Sig: sig})
+	return data
+}
+
+// testFleet returns a federating fleet on a loopback host that signs its
+// own records.
+func testFleet(t *testing.T, peers ...string) *relayFleet {
+	t.Helper()
+	h, err := libp2p.New(libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { h.Close() })
+	signer := &recordSigner{h: h, key: h.Peerstore().PrivKey(h.ID()), reg: newRelayRegistry(h), res: RelayResources{MaxReservations: 10}}
+	f, err := newRelayFleet(h, signer, true, peers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func TestParseAnnouncement(t *testing.T) {
+	_, key := testKey(t)
+	_, other := testKey(t)
+	now := time.Now()
+	var forged relayAnnouncement
+	_ = json.Unmarshal(testRecord(t, key, nil), &forged)
+	forged.Sig, _ = other.Sign(forged.Record)
+	forgedData, _ := json.Marshal(forged)
+
+	tests := []struct {
+		name string
+		data []byte
+		ok   bool
+	}{
+		{"fresh", testRecord(t, key, nil), true},
+		{"issued a minute ahead", testRecord(t, key, func(r *relayRecord) { r.Issued = now.Add(time.Minute).Unix() }), true},
+		{"issued in the future", testRecord(t, key, func(r *relayRecord) {
+			r.Issued, r.Expires = now.Add(time.Hour).Unix(), now.Add(time.Hour+time.Minute).Unix()
+		}), false},
+		{"expires too far ahead", testRecord(t, key, func(r *relayRecord) {
+			r.Issued, r.Expires = now.Add(maxRecordSkew).Unix(), now.Add(maxRecordTTL+maxRecordSkew).Unix()
+		}), false},
+		{"lifetime over maxRecordTTL", testRecord(t, key, func(r *relayRecord) {
+			r.Issued = now.Add(-maxRecordTTL).Unix()
+		}), false},
+		{"expired", testRecord(t, key, func(r *relayRecord) { r.Expires = now.Add(-time.Minute).Unix() }), false},
+		{"negative capacity", testRecord(t, key, func(r *relayRecord) { r.Capacity = -1 }), false},
+		{"circuit address", testRecord(t, key, func(r *relayRecord) {
+			r.Addrs = []string{"/ip4/192.0.2.1/tcp/4001/p2p/" + r.Peer + "/p2p-circuit"}
+		}), false},
+		{"signed by another key", forgedData, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := parseAnnouncement(tt.data); (err == nil) != tt.ok {
+				t.Errorf("parseAnnouncement = %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+}
+
+func TestFleetMerge(t *testing.T) {
+	f := testFleet(t)
+	now := time.Now()
+	expiring := func(d time.Duration) func(*relayRecord) {
+		return func(r *relayRecord) { r.Expires = now.Add(d).Unix() }
+	}
+
+	var first peer.ID
+	var list []json.RawMessage
+	for i := 0; i < maxFleet; i++ {
+		id, key := testKey(t)
+		if i == 0 {
+			first = id
+		}
+		list = append(list, testRecord(t, key, expiring(10*time.Minute+time.Duration(i)*time.Second)))
+	}
+	if n := f.merge(list); n != maxFleet {
+		t.Fatalf("merged %d relays, want %d", n, maxFleet)
+	}
+
+	_, short := testKey(t)
+	if n := f.merge([]json.RawMessage{testRecord(t, short, expiring(5*time.Minute))}); n != 0 {
+		t.Errorf("full fleet took a record expiring before all known ones")
+	}
+	longID, long := testKey(t)
+	if n := f.merge([]json.RawMessage{testRecord(t, long, nil)}); n != 1 {
+		t.Fatalf("full fleet refused a record outliving the first to expire")
+	}
+	if _, ok := f.records[first]; ok {
+		t.Errorf("record expiring first was kept")
+	}
+	if _, ok := f.records[longID]; !ok || len(f.records) != maxFleet {
+		t.Errorf("fleet has %d records, new one kept %v", len(f.records), ok)
+	}
+
+	older := testRecord(t, long, func(r *relayRecord) { r.Issued-- })
+	newer := testRecord(t, long, func(r *relayRecord) { r.Issued++ })
+	if f.merge([]json.RawMessage{older}); string(f.records[longID].data) == string(older) {
+		t.Errorf("older record replaced a newer one")
+	}
+	if f.merge([]json.RawMessage{newer}); string(f.records[longID].data) != string(newer) {
+		t.Errorf("newer record was not kept")
+	}
+}
+
+func TestFleetTrusted(t *testing.T) {
+	configured, _ := testKey(t)
+	stranger, _ := testKey(t)
+	f := testFleet(t, "/ip4/192.0.2.1/tcp/4001/p2p/"+configured.String())
+	f.records[stranger] = fleetRecord{}
+
+	tests := []struct {
+		name string
+		p    peer.ID
+		want bool
+	}{
+		{"configured peer", configured, true},
+		{"known relay", stranger, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := f.trusted(tt.p); got != tt.want {
+				t.Errorf("trusted = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFleetExchange(t *testing.T) {
+	far, farKey := testKey(t)
+	remote := testFleet(t)
+	remote.h.SetStreamHandler(fleetProtocol, remote.handle)
+	remote.merge([]json.RawMessage{testRecord(t, farKey, nil)})
+	addr := remote.h.Addrs()[0].String() + "/p2p/" + remote.h.ID().String()
+
+	tests := []struct {
+		name  string
+		peers []string
+		want  bool
+	}{
+		{"configured peer", []string{addr}, true},
+		{"unconfigured relay", nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := testFleet(t, tt.peers...)
+			f.h.Peerstore().AddAddrs(remote.h.ID(), remote.h.Addrs(), time.Minute)
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			if err := f.exchange(ctx, remote.h.ID()); err != nil {
+				t.Fatal(err)
+			}
+			for _, id := range []peer.ID{remote.h.ID(), far} {
+				if _, ok := f.records[id]; ok != tt.want {
+					t.Errorf("%s kept = %v, want %v", id, ok, tt.want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"time"
+
+	relayv2 "github.com/libp2p/go-libp2p/p2p/protocol/circuitv2/relay"
+)
+
+// RelayResources limits what the Circuit Relay v2 service hands out.
+// Zero values keep the libp2p defaults; CircuitData -1 lifts the data
+// limit. A peer holds at most one reservation, so there is no per-peer
+// reservation limit.
+type RelayResources struct {
+	MaxReservations       int    `yaml:"max_reservations" json:"max_reservations"`
+	MaxCircuits           int    `yaml:"max_circuits" json:"max_circuits"`
+	BufferSize            int    `yaml:"buffer_size" json:"buffer_size"`
+	MaxReservationsPerIP  int    `yaml:"max_reservations_per_ip" json:"max_reservations_per_ip"`
+	MaxReservationsPerASN int    `yaml:"max_reservations_per_asn" json:"max_reservations_per_asn"`
+	ReservationTTL        string `yaml:"reservation_ttl" json:"reservation_ttl"`
+	CircuitDuration       string `yaml:"circuit_duration" json:"circuit_duration"`
+	CircuitData           int64  `yaml:"circuit_data" json:"circuit_data"`
+}
+
+// unlimitedData is the CircuitData value that lifts the data limit.
+const unlimitedData = -1
+
+// loadResources merges the RELAY_* environment over the config file, fills
+// in the libp2p defaults and checks the result. A malformed or inconsistent
+// limit is an error so the relay refuses to start with it.
+func loadResources(cfg RelayResources) (RelayResources, relayv2.Resources, error) {
+	def := relayv2.DefaultResources()
+	var errs []error
+	envInt := func(name string, v *int) {
+		s := os.Getenv(name)
+		if s == "" {
+			return
+		}
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+			return
+		}
+		*v = n
+	}
+	envInt("RELAY_MAX_RESERVATIONS", &cfg.MaxReservations)
+	envInt("RELAY_MAX_CIRCUITS", &cfg.MaxCircuits)
+	envInt("RELAY_BUFFER_SIZE", &cfg.BufferSize)
+	envInt("RELAY_MAX_RESERVATIONS_PER_IP", &cfg.MaxReservationsPerIP)
+	envInt("RELAY_MAX_RESERVATIONS_PER_ASN", &cfg.MaxReservationsPerASN)
+	if s := os.Getenv("RELAY_CIRCUIT_DATA"); s != "" {
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("RELAY_CIRCUIT_DATA: %w", err))
+		}
+		cfg.CircuitData = n
+	}
+	cfg.ReservationTTL = firstNonEmpty(os.Getenv("RELAY_RESERVATION_TTL"), cfg.ReservationTTL)
+	cfg.CircuitDuration = firstNonEmpty(os.Getenv("RELAY_CIRCUIT_DURATION"), cfg.CircuitDuration)
+	if len(errs) > 0 {
+		return cfg, def, errs[0]
+	}
+
+	orDefault := func(v *int, d int) {
+		if *v == 0 {
+			*v = d
+		}
+	}
+	orDefault(&cfg.MaxReservations, def.MaxReservations)
+	orDefault(&cfg.MaxCircuits, def.MaxCircuits)
+	orDefault(&cfg.BufferSize, def.BufferSize)
+	// an unset per-ASN limit grows to fit the per-IP one
+	orDefault(&cfg.MaxReservationsPerIP, def.MaxReservationsPerIP)
+	orDefault(&cfg.MaxReservationsPerASN, max(def.MaxReservationsPerASN, cfg.MaxReservationsPerIP))
+	if cfg.CircuitData == 0 {
+		cfg.CircuitData = def.Limit.Data
+	}
+	ttl, err := parseLimit("reservation_ttl", cfg.ReservationTTL, def.ReservationTTL)
+	if err != nil {
+		return cfg, def, err
+	}
+	dur, err := parseLimit("circuit_duration", cfg.CircuitDuration, def.Limit.Duration)
+	if err != nil {
+		return cfg, def, err
+	}
+	cfg.ReservationTTL, cfg.CircuitDuration = ttl.String(), dur.String()
+
+	switch {
+	case cfg.MaxReservations < 0 || cfg.MaxCircuits < 0 || cfg.BufferSize < 0 || cfg.CircuitData < unlimitedData ||
+		cfg.MaxReservationsPerIP < 0 || cfg.MaxReservationsPerASN < 0:
+		return cfg, def, fmt.Errorf("relay limits must not be negative, except circuit_data -1 for no data limit")
+	case cfg.BufferSize < 512:
+		return cfg, def, fmt.Errorf("buffer_size %d is below 512 bytes", cfg.BufferSize)
+	case ttl < time.Minute:
+		return cfg, def, fmt.Errorf("reservation_ttl %s is below 1m", ttl)
+	case cfg.MaxReservationsPerIP > cfg.MaxReservationsPerASN:
+		return cfg, def, fmt.Errorf("max_reservations_per_ip (%d) exceeds max_reservations_per_asn (%d)", cfg.MaxReservationsPerIP, cfg.MaxReservationsPerASN)
+	}
+
+	data := cfg.CircuitData
+	if data == unlimitedData {
+		// libp2p only lifts both limits together, by a nil Limit
+		data = math.MaxInt64
+	}
+	return cfg, relayv2.Resources{
+		Limit:                 &relayv2.RelayLimit{Duration: dur, Data: data},
+		ReservationTTL:        ttl,
+		MaxReservations:       cfg.MaxReservations,
+		MaxCircuits:           cfg.MaxCircuits,
+		BufferSize:            cfg.BufferSize,
+		MaxReservationsPerIP:  cfg.MaxReservationsPerIP,
+		MaxReservationsPerASN: cfg.MaxReservationsPerASN,
+	}, nil
+}
+
+func parseLimit(name, s string, def time.Duration) (time.Duration, error) {
+	if s == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", name, err)
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("%s must be positive", name)
+	}
+	return d, nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestLoadResources(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     RelayResources
+		env     map[string]string
+		wantErr bool
+		check   func(*testing.T, RelayResources, int64)
+	}{
+		{name: "defaults", check: func(t *testing.T, cfg RelayResources, data int64) {
+			if cfg.MaxReservations != 128 || cfg.MaxReservationsPerIP != 8 || cfg.CircuitData != 131072 || data != 131072 {
+				t.Errorf("got %+v, data %d", cfg, data)
+			}
+		}},
+		{name: "env over file", cfg: RelayResources{MaxReservations: 10}, env: map[string]string{"RELAY_MAX_RESERVATIONS": "20"},
+			check: func(t *testing.T, cfg RelayResources, _ int64) {
+				if cfg.MaxReservations != 20 {
+					t.Errorf("max_reservations = %d, want 20", cfg.MaxReservations)
+				}
+			}},
+		{name: "per-ASN grows to the per-IP limit", cfg: RelayResources{MaxReservationsPerIP: 64},
+			check: func(t *testing.T, cfg RelayResources, _ int64) {
+				if cfg.MaxReservationsPerASN != 64 {
+					t.Errorf("max_reservations_per_asn = %d, want 64", cfg.MaxReservationsPerASN)
+				}
+			}},
+		{name: "unlimited data", cfg: RelayResources{CircuitData: unlimitedData},
+			check: func(t *testing.T, cfg RelayResources, data int64) {
+				if cfg.CircuitData != unlimitedData || data != math.MaxInt64 {
+					t.Errorf("circuit_data = %d, libp2p data = %d", cfg.CircuitData, data)
+				}
+			}},
+		{name: "malformed env", env: map[string]string{"RELAY_MAX_CIRCUITS": "many"}, wantErr: true},
+		{name: "negative", cfg: RelayResources{MaxCircuits: -1}, wantErr: true},
+		{name: "data below -1", cfg: RelayResources{CircuitData: -2}, wantErr: true},
+		{name: "small buffer", cfg: RelayResources{BufferSize: 100}, wantErr: true},
+		{name: "short ttl", cfg: RelayResources{ReservationTTL: "30s"}, wantErr: true},
+		{name: "bad duration", cfg: RelayResources{CircuitDuration: "soon"}, wantErr: true},
+		{name: "per-IP above per-ASN", cfg: RelayResources{MaxReservationsPerIP: 16, MaxReservationsPerASN: 8}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			cfg, res, err := loadResources(tt.cfg)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if res.Limit == nil || res.Limit.Duration != 2*time.Minute {
+				t.Errorf("limit = %+v", res.Limit)
+			}
+			if tt.check != nil {
+				tt.check(t, cfg, res.Limit.Data)
+			}
+		})
+	}
+}
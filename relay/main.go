@@ -4,14 +4,18 @@ import (
 	"context"
 	"crypto/ed25519"
 	"crypto/rand"
+	"errors"
 	"fmt"
+	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
 	"strings"
 	"syscall"
+	"time"
 
 	libp2p "github.com/libp2p/go-libp2p"
+	dht "github.com/libp2p/go-libp2p-kad-dht"
 	"github.com/libp2p/go-libp2p/core/crypto"
 	relayv2 "github.com/libp2p/go-libp2p/p2p/protocol/circuitv2/relay"
 	ma "github.com/multiformats/go-multiaddr"
@@ -41,12 +45,20 @@ func main() {
 	cfg := loadConfig()
 
 	// อ่าน config จาก ENV/ไฟล์
-	listen := os.Getenv("RELAY_LISTEN")
-	if listen == "" {
-		listen = cfg.RelayListen
+	listenOpts, err := listenOptions(cfg)
+	if err != nil {
+		fmt.Println("Invalid relay listen config:", err)
+		os.Exit(1)
 	}
-	if listen == "" {
-		listen = "/ip4/0.0.0.0/tcp/4003"
+	limits, resources, err := loadResources(cfg.Resources)
+	if err != nil {
+		fmt.Println("Invalid relay resources:", err)
+		os.Exit(1)
+	}
+	quotaLimits, err := loadQuotas(cfg.Quotas)
+	if err != nil {
+		fmt.Println("Invalid relay quotas:", err)
+		os.Exit(1)
 	}
 	announce := cfg.AnnounceAddrs
 	if env := os.Getenv("ANNOUNCE_ADDRS"); env != "" {
@@ -58,6 +70,19 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
+	if len(os.Args) > 1 && os.Args[1] == "token" {
+		if err := issueToken(priv, os.Args[2:]); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return
+	}
+	private := getenvBool("RELAY_PRIVATE", cfg.Private)
+	acl, err := newRelayACL(private, cfg.ACL, priv)
+	if err != nil {
+		fmt.Println("Invalid relay ACL:", err)
+		os.Exit(1)
+	}
 
 	// สร้าง host ที่ฟังที่ listen address
 	var announceAddrs []ma.Multiaddr
@@ -71,11 +96,10 @@ func main() {
 		}
 		announceAddrs = append(announceAddrs, m)
 	}
-	opts := []libp2p.Option{
+	opts := append([]libp2p.Option{
 		libp2p.Identity(priv),
-		libp2p.ListenAddrStrings(listen),
 		libp2p.EnableRelay(),
-	}
+	}, listenOpts...)
 	if len(announceAddrs) > 0 {
 		opts = append(opts, libp2p.AddrsFactory(func(addrs []ma.Multiaddr) []ma.Multiaddr {
 			return append(addrs, announceAddrs...)
@@ -88,22 +112,130 @@ func main() {
 	defer h.Close()
 
 	// เปิด Circuit Relay v2
-	_, err = relayv2.New(h)
+	stats := newRelayStats()
+	reg := newRelayRegistry(h)
+	quotas := newRelayQuotas(quotaLimits, usageFile)
+	reg.quotas, acl.quotas = quotas, quotas
+	relay, err := relayv2.New(relayHost{Host: h, reg: reg}, relayv2.WithResources(resources), relayv2.WithMetricsTracer(stats), relayv2.WithACL(acl))
 	if err != nil {
 		panic(err)
 	}
 
+	acl.serve(h)
+	signer := &recordSigner{h: h, key: priv, reg: reg, res: limits, private: private}
+	serveRecord(h, signer)
+	federate := getenvBool("RELAY_FEDERATION", cfg.Federation)
+	fedPeers := cfg.FederationPeers
+	if env := os.Getenv("RELAY_FEDERATION_PEERS"); env != "" {
+		fedPeers = strings.Split(env, ",")
+	}
+	fleet, err := newRelayFleet(h, signer, federate, fedPeers)
+	if err != nil {
+		fmt.Println("Invalid relay federation config:", err)
+		os.Exit(1)
+	}
+
 	fmt.Printf("✅ Relay PeerID: %s\n", h.ID())
 	for _, a := range h.Addrs() {
 		fmt.Printf("📡 Listening on: %s/p2p/%s\n", a, h.ID())
 	}
+	fmt.Printf("🔒 Limits: %d reservations (ttl %s, %d/IP, %d/ASN), %d circuits/peer, %s and %s per circuit\n",
+		limits.MaxReservations, limits.ReservationTTL, limits.MaxReservationsPerIP,
+		limits.MaxReservationsPerASN, limits.MaxCircuits, limits.CircuitDuration, quotaString(max(limits.CircuitData, 0)))
+	fmt.Printf("📏 Quotas: %s/hour and %s/day per peer, %s/hour and %s/day per IP\n",
+		quotaString(quotaLimits.PeerHourly), quotaString(quotaLimits.PeerDaily), quotaString(quotaLimits.IPHourly), quotaString(quotaLimits.IPDaily))
 
-	// รอ signal เพื่อปิด
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
+	var kdht *dht.IpfsDHT
+	if getenvBool("RELAY_DHT", cfg.DHT) {
+		peers := cfg.DHTPeers
+		if env := os.Getenv("RELAY_DHT_PEERS"); env != "" {
+			peers = strings.Split(env, ",")
+		}
+		if kdht, err = startDHT(ctx, h, peers); err != nil {
+			panic(err)
+		}
+		fmt.Println("🌍 DHT server and rendezvous point on /mesh")
+	}
+	fleet.serve(ctx)
+	go quotas.run(ctx)
+	if federate {
+		fmt.Printf("🤝 Federating with %d configured relays\n", len(fleet.peers))
+	}
+	if private {
+		fmt.Printf("🔐 Private relay: %d allowed peers, tokens accepted on %s\n", len(acl.static)+len(acl.listed), authProtocol)
+	}
+
+	// status endpoint
+	var status *http.Server
+	if addr := firstNonEmpty(os.Getenv("RELAY_STATUS_ADDR"), cfg.StatusAddr); addr != "" {
+		admin := &relayAdmin{token: firstNonEmpty(os.Getenv("RELAY_ADMIN_TOKEN"), cfg.AdminToken), reg: reg, acl: acl, quotas: quotas}
+		status = statusServer(addr, h, limits, stats, acl, admin, fleet)
+		go func() {
+			if err := status.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				fmt.Println("status server:", err)
+			}
+		}()
+		fmt.Printf("📊 Status on http://%s/status, metrics on /metrics\n", addr)
+		if admin.token != "" {
+			fmt.Printf("🛠 Admin API on http://%s/admin/\n", addr)
+		}
+	}
+
+	// รอ signal เพื่อปิด
 	ch := make(chan os.Signal, 1)
 	signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM)
 	<-ch
-	fmt.Println("🛑 Shutting down relay...")
-	_ = ctx
+
+	timeout := 10 * time.Second
+	if d, err := time.ParseDuration(firstNonEmpty(os.Getenv("SHUTDOWN_TIMEOUT"), cfg.ShutdownTimeout)); err == nil && d > 0 {
+		timeout = d
+	}
+	fmt.Printf("🛑 Shutting down relay (timeout %s)...\n", timeout)
+	sctx, scancel := context.WithTimeout(context.Background(), timeout)
+	defer scancel()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if status != nil {
+			_ = status.Shutdown(sctx)
+		}
+		if kdht != nil {
+			_ = kdht.Close()
+		}
+		// stop granting reservations and circuits, then drop connections
+		_ = relay.Close()
+		_ = h.Close()
+		if err := quotas.save(); err != nil {
+			fmt.Println("Saving relay usage failed:", err)
+		}
+	}()
+	select {
+	case <-done:
+		fmt.Println("👋 Relay stopped")
+	case <-sctx.Done():
+		fmt.Println("shutdown timed out, exiting")
+		os.Exit(1)
+	case <-ch:
+		fmt.Println("second signal, exiting")
+		os.Exit(1)
+	}
+}
+
+func getenvBool(k string, def bool) bool {
+	v := strings.TrimSpace(strings.ToLower(os.Getenv(k)))
+	if v == "" {
+		return def
+	}
+	return v == "1" || v == "true" || v == "yes" || v == "y"
+}
+
+func firstNonEmpty(v ...string) string {
+	for _, s := range v {
+		if strings.TrimSpace(s) != "" {
+			return s
+		}
+	}
+	return ""
 }
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+const (
+	usageFile      = "/data/relay_usage.json"
+	usageSaveEvery = time.Minute
+	defaultTopN    = 10
+)
+
+// RelayQuotas caps the bytes relayed per reserving peer and per source IP
+// over a rolling hour and day. Zero means no cap.
+type RelayQuotas struct {
+	PeerHourly int64 `yaml:"peer_hourly" json:"peer_hourly"`
+	PeerDaily  int64 `yaml:"peer_daily" json:"peer_daily"`
+	IPHourly   int64 `yaml:"ip_hourly" json:"ip_hourly"`
+	IPDaily    int64 `yaml:"ip_daily" json:"ip_daily"`
+}
+
+// loadQuotas merges the RELAY_QUOTA_* environment over the config file and
+// checks the result.
+func loadQuotas(cfg RelayQuotas) (RelayQuotas, error) {
+	for name, v := range map[string]*int64{
+		"RELAY_QUOTA_PEER_HOURLY": &cfg.PeerHourly,
+		"RELAY_QUOTA_PEER_DAILY":  &cfg.PeerDaily,
+		"RELAY_QUOTA_IP_HOURLY":   &cfg.IPHourly,
+		"RELAY_QUOTA_IP_DAILY":    &cfg.IPDaily,
+	} {
+		if s := os.Getenv(name); s != "" {
+			n, err := strconv.ParseInt(s, 10, 64)
+			if err != nil {
+				return cfg, fmt.Errorf("%s: %w", name, err)
+			}
+			*v = n
+		}
+	}
+	switch {
+	case cfg.PeerHourly < 0 || cfg.PeerDaily < 0 || cfg.IPHourly < 0 || cfg.IPDaily < 0:
+		return cfg, fmt.Errorf("relay quotas must not be negative")
+	case cfg.PeerDaily > 0 && cfg.PeerHourly > cfg.PeerDaily:
+		return cfg, fmt.Errorf("peer_hourly (%d) exceeds peer_daily (%d)", cfg.PeerHourly, cfg.PeerDaily)
+	case cfg.IPDaily > 0 && cfg.IPHourly > cfg.IPDaily:
+		return cfg, fmt.Errorf("ip_hourly (%d) exceeds ip_daily (%d)", cfg.IPHourly, cfg.IPDaily)
+	}
+	return cfg, nil
+}
+
+func quotaString(n int64) string {
+	if n == 0 {
+		return "unlimited"
+	}
+	return strconv.FormatInt(n, 10) + " bytes"
+}
+
+// usage is a rolling count of bytes: per minute for the last hour and per
+// hour for the last day. Minute and Hour are the Unix minute and hour of
+// the newest bucket.
+type usage struct {
+	Minutes [60]int64 `json:"minutes"`
+	Minute  int64     `json:"minute"`
+	Hours   [24]int64 `json:"hours"`
+	Hour    int64     `json:"hour"`
+}
+
+// advance clears the buckets that fell out of the windows since the last
+// update.
+func (u *usage) advance(now time.Time) {
+	m, h := now.Unix()/60, now.Unix()/3600
+	for ; u.Minute < m; u.Minute++ {
+		if m-u.Minute > int64(len(u.Minutes)) {
+			u.Minutes, u.Minute = [60]int64{}, m
+			break
+		}
+		u.Minutes[(u.Minute+1)%60] = 0
+	}
+	for ; u.Hour < h; u.Hour++ {
+		if h-u.Hour > int64(len(u.Hours)) {
+			u.Hours, u.Hour = [24]int64{}, h
+			break
+		}
+		u.Hours[(u.Hour+1)%24] = 0
+	}
+}
+
+func (u *usage) add(n int64, now time.Time) {
+	u.advance(now)
+	u.Minutes[u.Minute%60] += n
+	u.Hours[u.Hour%24] += n
+}
+
+// totals returns the bytes of the last hour and of the last day.
+func (u *usage) totals(now time.Time) (hour, day int64) {
+	u.advance(now)
+	for _, n := range u.Minutes {
+		hour += n
+	}
+	for _, n := range u.Hours {
+		day += n
+	}
+	return hour, day
+}
+
+// consumer is one peer or IP as reported by GET /admin/usage.
+type consumer struct {
+	Key       string `json:"key"`
+	Hour      int64  `json:"hour"`
+	Day       int64  `json:"day"`
+	Exhausted bool   `json:"exhausted,omitempty"`
+}
+
+// relayQuotas accounts the bytes of every circuit to its reserving peer
+// and its source IP and refuses reservations and circuits once either is
+// over quota. Counters are saved to usageFile so a restart does not reset
+// them.
+type relayQuotas struct {
+	limits RelayQuotas
+	path   string
+	cut    atomic.Int64 // circuits reset for running over quota
+
+	mu    sync.Mutex
+	peers map[string]*usage
+	ips   map[string]*usage
+}
+
+func newRelayQuotas(limits RelayQuotas, path string) *relayQuotas {
+	q := &relayQuotas{limits: limits, path: path, peers: map[string]*usage{}, ips: map[string]*usage{}}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return q
+	}
+	var saved struct {
+		Peers map[string]*usage `json:"peers"`
+		IPs   map[string]*usage `json:"ips"`
+	}
+	if err := json.Unmarshal(b, &saved); err != nil {
+		fmt.Println("Ignoring unreadable relay usage file:", err)
+		return q
+	}
+	if saved.Peers != nil {
+		q.peers = saved.Peers
+	}
+	if saved.IPs != nil {
+		q.ips = saved.IPs
+	}
+	return q
+}
+
+// ipOf returns the IP address of a multiaddr, or "" if it has none.
+func ipOf(addr ma.Multiaddr) string {
+	if addr == nil {
+		return ""
+	}
+	if ip, err := addr.ValueForProtocol(ma.P_IP4); err == nil {
+		return ip
+	}
+	if ip, err := addr.ValueForProtocol(ma.P_IP6); err == nil {
+		return ip
+	}
+	return ""
+}
+
+func over(u *usage, hourly, daily int64, now time.Time) bool {
+	if u == nil {
+		return false
+	}
+	hour, day := u.totals(now)
+	return (hourly > 0 && hour >= hourly) || (daily > 0 && day >= daily)
+}
+
+// exhausted reports whether reserving peer p or source IP ip has used up
+// its quota.
+func (q *relayQuotas) exhausted(p peer.ID, ip string) bool {
+	now := time.Now()
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return over(q.peers[p.String()], q.limits.PeerHourly, q.limits.PeerDaily, now) ||
+		(ip != "" && over(q.ips[ip], q.limits.IPHourly, q.limits.IPDaily, now))
+}
+
+// add accounts n bytes of a circuit to its reserving peer and source IP
+// and reports whether both are still within quota.
+func (q *relayQuotas) add(p peer.ID, ip string, n int64) bool {
+	now := time.Now()
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	u := q.peers[p.String()]
+	if u == nil {
+		u = &usage{}
+		q.peers[p.String()] = u
+	}
+	u.add(n, now)
+	ok := !over(u, q.limits.PeerHourly, q.limits.PeerDaily, now)
+	if ip != "" {
+		u := q.ips[ip]
+		if u == nil {
+			u = &usage{}
+			q.ips[ip] = u
+		}
+		u.add(n, now)
+		ok = ok && !over(u, q.limits.IPHourly, q.limits.IPDaily, now)
+	}
+	return ok
+}
+
+// top returns the n heaviest peers and IPs of the last day.
+func (q *relayQuotas) top(n int) (peers, ips []consumer) {
+	now := time.Now()
+	rank := func(m map[string]*usage, hourly, daily int64) []consumer {
+		out := []consumer{}
+		for k, u := range m {
+			hour, day := u.totals(now)
+			if day == 0 {
+				continue
+			}
+			out = append(out, consumer{Key: k, Hour: hour, Day: day, Exhausted: over(u, hourly, daily, now)})
+		}
+		sort.Slice(out, func(i, j int) bool { return out[i].Day > out[j].Day })
+		return out[:min(n, len(out))]
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return rank(q.peers, q.limits.PeerHourly, q.limits.PeerDaily), rank(q.ips, q.limits.IPHourly, q.limits.IPDaily)
+}
+
+// save drops the counters that are empty for the last day and writes the
+// rest to the usage file.
+func (q *relayQuotas) save() error {
+	now := time.Now()
+	q.mu.Lock()
+	for _, m := range []map[string]*usage{q.peers, q.ips} {
+		for k, u := range m {
+			if _, day := u.totals(now); day == 0 {
+				delete(m, k)
+			}
+		}
+	}
+	b, err := json.Marshal(struct {
+		Peers map[string]*usage `json:"peers"`
+		IPs   map[string]*usage `json:"ips"`
+	}{q.peers, q.ips})
+	q.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	_ = os.MkdirAll(filepath.Dir(q.path), 0o755)
+	tmp := q.path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, q.path)
+}
+
+// run saves the counters every usageSaveEvery until ctx is done.
+func (q *relayQuotas) run(ctx context.Context) {
+	ticker := time.NewTicker(usageSaveEvery)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := q.save(); err != nil {
+				fmt.Println("Saving relay usage failed:", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
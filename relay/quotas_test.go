@@ -0,0 +1,118 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+func TestUsageWindows(t *testing.T) {
+	start := time.Unix(1_700_000_000/3600*3600, 0)
+	tests := []struct {
+		name      string
+		after     time.Duration
+		hour, day int64
+	}{
+		{"same minute", 30 * time.Second, 100, 100},
+		{"last minute of the hour", 59 * time.Minute, 100, 100},
+		{"an hour later", time.Hour, 0, 100},
+		{"last hour of the day", 23*time.Hour + 59*time.Minute, 0, 100},
+		{"a day later", 24 * time.Hour, 0, 0},
+		{"long idle", 100 * time.Hour, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var u usage
+			u.add(100, start)
+			if hour, day := u.totals(start.Add(tt.after)); hour != tt.hour || day != tt.day {
+				t.Errorf("totals = %d, %d, want %d, %d", hour, day, tt.hour, tt.day)
+			}
+		})
+	}
+
+	var u usage
+	for i := 0; i < 90; i++ {
+		u.add(10, start.Add(time.Duration(i)*time.Minute))
+	}
+	if hour, day := u.totals(start.Add(89 * time.Minute)); hour != 600 || day != 900 {
+		t.Errorf("rolling totals = %d, %d, want 600, 900", hour, day)
+	}
+}
+
+func TestLoadQuotas(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     RelayQuotas
+		env     map[string]string
+		want    RelayQuotas
+		wantErr bool
+	}{
+		{name: "unlimited"},
+		{name: "hourly without daily", cfg: RelayQuotas{PeerHourly: 10}, want: RelayQuotas{PeerHourly: 10}},
+		{name: "env over file", cfg: RelayQuotas{IPDaily: 10}, env: map[string]string{"RELAY_QUOTA_IP_DAILY": "20"}, want: RelayQuotas{IPDaily: 20}},
+		{name: "malformed env", env: map[string]string{"RELAY_QUOTA_PEER_DAILY": "1GB"}, wantErr: true},
+		{name: "negative", cfg: RelayQuotas{IPHourly: -1}, wantErr: true},
+		{name: "peer hourly over daily", cfg: RelayQuotas{PeerHourly: 20, PeerDaily: 10}, wantErr: true},
+		{name: "ip hourly over daily", cfg: RelayQuotas{IPHourly: 20, IPDaily: 10}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, name := range []string{"RELAY_QUOTA_PEER_HOURLY", "RELAY_QUOTA_PEER_DAILY", "RELAY_QUOTA_IP_HOURLY", "RELAY_QUOTA_IP_DAILY"} {
+				t.Setenv(name, tt.env[name])
+			}
+			got, err := loadQuotas(tt.cfg)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if err == nil && got != tt.want {
+				t.Errorf("quotas = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRelayQuotas(t *testing.T) {
+	a, _ := testKey(t)
+	b, _ := testKey(t)
+	const ip = "192.0.2.1"
+	path := filepath.Join(t.TempDir(), "usage.json")
+	q := newRelayQuotas(RelayQuotas{PeerHourly: 100, IPDaily: 150}, path)
+
+	steps := []struct {
+		name      string
+		p         peer.ID
+		ip        string
+		n         int64
+		ok        bool
+		exhausted bool
+	}{
+		{"within the peer quota", a, ip, 60, true, false},
+		{"over the peer quota", a, ip, 50, false, true},
+		{"other peer, same IP, within", b, ip, 30, true, false},
+		{"other peer, same IP, over", b, ip, 20, false, true},
+		{"other peer, no IP", b, "", 10, true, false},
+	}
+	for _, st := range steps {
+		if ok := q.add(st.p, st.ip, st.n); ok != st.ok {
+			t.Errorf("%s: add = %v, want %v", st.name, ok, st.ok)
+		}
+		if got := q.exhausted(st.p, st.ip); got != st.exhausted {
+			t.Errorf("%s: exhausted = %v, want %v", st.name, got, st.exhausted)
+		}
+	}
+
+	// counters survive a restart
+	if err := q.save(); err != nil {
+		t.Fatal(err)
+	}
+	again := newRelayQuotas(q.limits, path)
+	if !again.exhausted(a, "") || !again.exhausted(b, ip) || again.exhausted(b, "") {
+		t.Errorf("reloaded counters differ")
+	}
+	peers, ips := again.top(defaultTopN)
+	if len(peers) != 2 || peers[0].Day != 110 || len(ips) != 1 || ips[0].Day != 160 || !ips[0].Exhausted {
+		t.Errorf("top = %+v, %+v", peers, ips)
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	pbv2 "github.com/libp2p/go-libp2p/p2p/protocol/circuitv2/pb"
+	relayv2 "github.com/libp2p/go-libp2p/p2p/protocol/circuitv2/relay"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// relayStats counts reservations, circuits and relayed bytes for the status
+// endpoint and Prometheus. It plugs into the relay service as its metrics
+// tracer.
+type relayStats struct {
+	reservations, circuits           atomic.Int64
+	reservationsTotal, circuitsTotal atomic.Int64
+	reservationsRefused              atomic.Int64
+	circuitsRefused                  atomic.Int64
+	bytesRelayed                     atomic.Int64
+
+	registry *prometheus.Registry
+	rejected *prometheus.CounterVec
+}
+
+var _ relayv2.MetricsTracer = (*relayStats)(nil)
+
+func newRelayStats() *relayStats {
+	s := &relayStats{
+		registry: prometheus.NewRegistry(),
+		rejected: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "relay_rejections_total",
+			Help: "Refused reservation and circuit requests by reason.",
+		}, []string{"request", "reason"}),
+	}
+	gauge := func(name, help string, v *atomic.Int64) prometheus.Collector {
+		return prometheus.NewGaugeFunc(prometheus.GaugeOpts{Name: name, Help: help}, func() float64 { return float64(v.Load()) })
+	}
+	counter := func(name, help string, v *atomic.Int64) prometheus.Collector {
+		return prometheus.NewCounterFunc(prometheus.CounterOpts{Name: name, Help: help}, func() float64 { return float64(v.Load()) })
+	}
+	s.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		gauge("relay_reservations", "Active reservations.", &s.reservations),
+		gauge("relay_circuits", "Active relayed connections.", &s.circuits),
+		counter("relay_reservations_total", "Reservations granted, renewals excluded.", &s.reservationsTotal),
+		counter("relay_circuits_total", "Relayed connections opened.", &s.circuitsTotal),
+		counter("relay_bytes_relayed_total", "Bytes relayed in both directions.", &s.bytesRelayed),
+		s.rejected,
+	)
+	return s
+}
+
+func (s *relayStats) RelayStatus(bool)               {}
+func (s *relayStats) ConnectionOpened()              { s.circuits.Add(1); s.circuitsTotal.Add(1) }
+func (s *relayStats) ConnectionClosed(time.Duration) { s.circuits.Add(-1) }
+func (s *relayStats) BytesTransferred(n int)         { s.bytesRelayed.Add(int64(n)) }
+func (s *relayStats) ReservationClosed(n int)        { s.reservations.Add(-int64(n)) }
+func (s *relayStats) ConnectionRequestHandled(st pbv2.Status) {
+	if st != pbv2.Status_OK {
+		s.circuitsRefused.Add(1)
+		s.rejected.WithLabelValues("circuit", strings.ToLower(st.String())).Inc()
+	}
+}
+
+func (s *relayStats) ReservationAllowed(renewal bool) {
+	if !renewal {
+		s.reservations.Add(1)
+		s.reservationsTotal.Add(1)
+	}
+}
+
+func (s *relayStats) ReservationRequestHandled(st pbv2.Status) {
+	if st != pbv2.Status_OK {
+		s.reservationsRefused.Add(1)
+		s.rejected.WithLabelValues("reservation", strings.ToLower(st.String())).Inc()
+	}
+}
+
+// relayStatus is the body of GET /status.
+type relayStatus struct {
+	PeerID    string         `json:"peer_id"`
+	Addrs     []string       `json:"addrs"`
+	Uptime    string         `json:"uptime"`
+	Resources RelayResources `json:"resources"`
+	Quotas    RelayQuotas    `json:"quotas"`
+	Private   bool           `json:"private"`
+
+	Reservations        int64 `json:"reservations"`
+	Circuits            int64 `json:"circuits"`
+	ReservationsTotal   int64 `json:"reservations_total"`
+	ReservationsRefused int64 `json:"reservations_refused"`
+	CircuitsTotal       int64 `json:"circuits_total"`
+	CircuitsRefused     int64 `json:"circuits_refused"`
+	BytesRelayed        int64 `json:"bytes_relayed"`
+	DeniedReservations  int64 `json:"denied_reservations"`
+	DeniedCircuits      int64 `json:"denied_circuits"`
+
+	Fleet []fleetStatus `json:"fleet"` // other relays known through federation
+}
+
+// statusServer serves the relay's limits and current usage as JSON, its
+// Prometheus metrics and, with an admin token, the admin API.
+func statusServer(addr string, h host.Host, res RelayResources, stats *relayStats, acl *relayACL, admin *relayAdmin, fleet *relayFleet) *http.Server {
+	started := time.Now()
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(stats.registry, promhttp.HandlerOpts{}))
+	if admin.token != "" {
+		mux.HandleFunc("/admin/", admin.handle)
+	}
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		st := relayStatus{
+			PeerID:              h.ID().String(),
+			Addrs:               []string{},
+			Uptime:              time.Since(started).Round(time.Second).String(),
+			Resources:           res,
+			Quotas:              acl.quotas.limits,
+			Reservations:        stats.reservations.Load(),
+			Circuits:            stats.circuits.Load(),
+			ReservationsTotal:   stats.reservationsTotal.Load(),
+			ReservationsRefused: stats.reservationsRefused.Load(),
+			CircuitsTotal:       stats.circuitsTotal.Load(),
+			CircuitsRefused:     stats.circuitsRefused.Load(),
+			BytesRelayed:        stats.bytesRelayed.Load(),
+			Private:             acl.private,
+			DeniedReservations:  acl.reserves.Load(),
+			DeniedCircuits:      acl.connects.Load(),
+			Fleet:               fleet.status(),
+		}
+		for _, a := range h.Addrs() {
+			st.Addrs = append(st.Addrs, a.String()+"/p2p/"+h.ID().String())
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(st)
+	})
+	return &http.Server{Addr: addr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	libp2p "github.com/libp2p/go-libp2p"
+	quic "github.com/libp2p/go-libp2p/p2p/transport/quic"
+	tcp "github.com/libp2p/go-libp2p/p2p/transport/tcp"
+	libp2pwebrtc "github.com/libp2p/go-libp2p/p2p/transport/webrtc"
+	websocket "github.com/libp2p/go-libp2p/p2p/transport/websocket"
+	webtransport "github.com/libp2p/go-libp2p/p2p/transport/webtransport"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// defaultListen covers TCP and QUIC on the port docker-compose maps.
+var defaultListen = []string{"/ip4/0.0.0.0/tcp/4003", "/ip4/0.0.0.0/udp/4003/quic-v1"}
+
+// listenOptions parses the relay's listen addresses and sets up the
+// transports. RELAY_LISTEN and relay_listen take a comma-separated list
+// mixing TCP, QUIC-v1, WebTransport and WebSocket addresses. Secure
+// WebSocket (/wss or /tls/ws) needs a certificate from RELAY_WS_CERT and
+// RELAY_WS_KEY.
+func listenOptions(cfg Config) ([]libp2p.Option, error) {
+	var addrs []string
+	for _, s := range strings.Split(firstNonEmpty(os.Getenv("RELAY_LISTEN"), cfg.RelayListen), ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			addrs = append(addrs, s)
+		}
+	}
+	if len(addrs) == 0 {
+		addrs = defaultListen
+	}
+	secure := false
+	for _, s := range addrs {
+		m, err := ma.NewMultiaddr(s)
+		if err != nil {
+			return nil, fmt.Errorf("listen address %q: %w", s, err)
+		}
+		if isSecureWS(m) {
+			secure = true
+		}
+	}
+
+	var wsOpts []interface{}
+	if secure {
+		certFile := firstNonEmpty(os.Getenv("RELAY_WS_CERT"), cfg.WSCert)
+		keyFile := firstNonEmpty(os.Getenv("RELAY_WS_KEY"), cfg.WSKey)
+		if certFile == "" || keyFile == "" {
+			return nil, errors.New("secure WebSocket listen address needs RELAY_WS_CERT and RELAY_WS_KEY")
+		}
+		kp := &keyPairReloader{certFile: certFile, keyFile: keyFile}
+		if _, err := kp.GetCertificate(nil); err != nil {
+			return nil, fmt.Errorf("websocket certificate: %w", err)
+		}
+		wsOpts = append(wsOpts, websocket.WithTLSConfig(&tls.Config{MinVersion: tls.VersionTLS12, GetCertificate: kp.GetCertificate}))
+	}
+	return []libp2p.Option{
+		libp2p.ListenAddrStrings(addrs...),
+		libp2p.Transport(tcp.NewTCPTransport),
+		libp2p.Transport(quic.NewTransport),
+		libp2p.Transport(webtransport.New),
+		libp2p.Transport(websocket.New, wsOpts...),
+		libp2p.Transport(libp2pwebrtc.New),
+	}, nil
+}
+
+func isSecureWS(m ma.Multiaddr) bool {
+	tls := false
+	for _, c := range m {
+		switch c.Protocol().Code {
+		case ma.P_WSS:
+			return true
+		case ma.P_TLS:
+			tls = true
+		case ma.P_WS:
+			return tls
+		}
+	}
+	return false
+}
+
+// keyPairReloader serves a certificate from files and picks up renewals
+// without a restart.
+type keyPairReloader struct {
+	certFile, keyFile string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+func (k *keyPairReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	st, err := os.Stat(k.certFile)
+	if err != nil {
+		if k.cert != nil {
+			return k.cert, nil
+		}
+		return nil, err
+	}
+	if k.cert != nil && st.ModTime().Equal(k.modTime) {
+		return k.cert, nil
+	}
+	cert, err := tls.LoadX509KeyPair(k.certFile, k.keyFile)
+	if err != nil {
+		if k.cert != nil {
+			fmt.Println("websocket tls reload:", err)
+			return k.cert, nil
+		}
+		return nil, err
+	}
+	k.cert, k.modTime = &cert, st.ModTime()
+	return k.cert, nil
+}